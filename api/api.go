@@ -3,35 +3,34 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
-	"github.com/thehowl/go-osuapi"
-
 	raven "github.com/getsentry/raven-go"
 	"github.com/julienschmidt/httprouter"
 
+	"github.com/osukurikku/cheesegull/dbmirror"
 	"github.com/osukurikku/cheesegull/downloader"
 	"github.com/osukurikku/cheesegull/housekeeper"
+	"github.com/osukurikku/cheesegull/models"
 )
 
 // Context is the information that is passed to all request handlers in relation
 // to the request, and how to answer it.
 type Context struct {
 	Request  *http.Request
-	DB       *sql.DB
-	SearchDB *sql.DB
+	DB       models.Repository
 	House    *housekeeper.House
 	DLClient *downloader.Client
 	writer   http.ResponseWriter
 	params   httprouter.Params
-	OsuAPI   osuapi.Client
+	OsuAPI   dbmirror.Source
 	secretCI string
 }
 
@@ -73,6 +72,18 @@ func (c *Context) CheckSecret(token string) bool {
 	return true
 }
 
+// CheckAdmin checks the secret token sent to the admin endpoints in the
+// Authorization header, as "Bearer <token>": unlike the query string, it does
+// not end up in the access logs.
+func (c *Context) CheckAdmin() bool {
+	const prefix = "Bearer "
+	auth := c.ReadHeader("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return c.CheckSecret(strings.TrimPrefix(auth, prefix))
+}
+
 // WriteJSON writes JSON to the response.
 func (c *Context) WriteJSON(code int, v interface{}) error {
 	c.WriteHeader("Content-Type", "application/json; charset=utf-8")
@@ -82,13 +93,18 @@ func (c *Context) WriteJSON(code int, v interface{}) error {
 
 var envSentryDSN = os.Getenv("SENTRY_DSN")
 
-// Err attempts to log an error to Sentry, as well as stdout.
+// Err attempts to log an error to Sentry, as well as stdout. Contexts created
+// outside of a request, with a nil Request, can use it as well.
 func (c *Context) Err(err error) {
 	if err == nil {
 		return
 	}
 	if envSentryDSN != "" {
-		raven.CaptureError(err, nil, raven.NewHttp(c.Request))
+		var interfaces []raven.Interface
+		if c.Request != nil {
+			interfaces = append(interfaces, raven.NewHttp(c.Request))
+		}
+		raven.CaptureError(err, nil, interfaces...)
 	}
 	log.Println(err)
 }
@@ -112,7 +128,7 @@ func POST(path string, f func(c *Context)) {
 
 // CreateHandler creates a new http.Handler using the handlers registered
 // through GET and POST.
-func CreateHandler(db, searchDB *sql.DB, house *housekeeper.House, dlc *downloader.Client, osuApi osuapi.Client, secretCI string) http.Handler {
+func CreateHandler(db models.Repository, house *housekeeper.House, dlc *downloader.Client, osuApi dbmirror.Source, secretCI string) http.Handler {
 	r := httprouter.New()
 	for _, h := range handlers {
 		// Create local copy that we know won't change as the loop proceeds.
@@ -122,7 +138,6 @@ func CreateHandler(db, searchDB *sql.DB, house *housekeeper.House, dlc *download
 			ctx := &Context{
 				Request:  r,
 				DB:       db,
-				SearchDB: searchDB,
 				House:    house,
 				DLClient: dlc,
 				writer:   w,
@@ -135,6 +150,10 @@ func CreateHandler(db, searchDB *sql.DB, house *housekeeper.House, dlc *download
 				if err == nil {
 					return
 				}
+				if err == http.ErrAbortHandler {
+					// the handler wants the connection to be aborted.
+					panic(err)
+				}
 				switch err := err.(type) {
 				case error:
 					ctx.Err(err)
@@ -2,10 +2,16 @@
 package download
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/osukurikku/cheesegull/api"
@@ -35,7 +41,7 @@ func Download(c *api.Context) {
 	}
 
 	// fetch beatmap set and make sure it exists.
-	set, err := models.FetchSet(c.DB, id, false)
+	set, err := c.DB.FetchSet(id, false)
 	if err != nil {
 		c.Err(err)
 		errorMessage(c, 400, "Could not fetch set")
@@ -47,43 +53,101 @@ func Download(c *api.Context) {
 	}
 
 	// use novideo only when we are requested to get a beatmap having a video
-	// and novideo is in the request
-	// noVideo := set.HasVideo && existsQueryKey(c, "novideo")
+	// and novideo is in the request: sets without video have a single file.
+	noVideo := set.HasVideo && existsQueryKey(c, "novideo")
+
+	// when the beatmap without video is made from the full one, it is the
+	// download of the latter which may have failed.
+	strip := noVideo && c.House.StripVideo
+
+	// don't hammer the mirrors with sets which could not be downloaded
+	// recently.
+	variants := []bool{noVideo}
+	if strip {
+		variants = append(variants, false)
+	}
+	if backingOff(c, id, variants) {
+		return
+	}
+
+	// the beatmaps which are already there are still served when the disk is
+	// full, but no new one is downloaded.
+	if c.House.DiskFull() && !available(c.House.Beatmap(id, noVideo)) {
+		errorMessage(c, 507, "The disk of the mirror is full, try again later")
+		return
+	}
 
 	cbm, shouldDownload := c.House.AcquireBeatmap(&housekeeper.CachedBeatmap{
-		ID:          id,
-		NoVideo:     true,
-		LastUpdate:  set.LastUpdate,
-		DataFolders: c.House.DataFolders,
+		ID:           id,
+		NoVideo:      noVideo,
+		LastUpdate:   set.LastUpdate,
+		RankedStatus: set.RankedStatus,
+		DataFolders:  c.House.DataFolders,
 	})
 
+	// the download is aborted if all the clients waiting for it go away.
+	ctx := c.Request.Context()
+	stop := cbm.Watch(ctx)
+	defer stop()
+
+	// the download was cancelled, or it failed and it is time to try again.
+	if !shouldDownload && cbm.Stream() == nil && (!cbm.IsDownloaded() || cbm.FileSize() == 0) {
+		shouldDownload = c.House.Redownload(cbm)
+	}
+
 	if shouldDownload {
-		err := downloadBeatmap(c.DLClient, cbm, c.House)
+		if strip {
+			err = startStrip(c, set, cbm)
+		} else {
+			err = startDownload(c, cbm)
+		}
 		if err != nil {
-			c.Err(err)
-			errorMessage(c, 500, "Internal error")
+			downloadError(c, err, c.House.Failure(id, noVideo))
 			return
 		}
-	} else {
-		cbm.MustBeDownloaded()
 	}
 
-	if cbm.FileSize() == 0 {
-		if cbm.GetLastAttempt()+(10*60) < int(time.Now().Unix()) {
-			// try again, because some mirrors is down, but map exists ;d
-			err := downloadBeatmap(c.DLClient, cbm, c.House)
-			if err != nil {
-				c.Err(err)
-				errorMessage(c, 400, "The beatmap could not be downloaded right now")
-				return
-			}
-		} else {
-			errorMessage(c, 400, "The beatmap could not be downloaded right now")
+	cbm.SetLastRequested(time.Now())
+
+	// while the beatmap is being downloaded, send it as it arrives.
+	if s := cbm.Stream(); s != nil {
+		r, err := s.NewReader(ctx)
+		if err != nil {
+			downloadError(c, err, c.House.Failure(id, noVideo))
 			return
 		}
+		defer r.Close()
+		c.House.LogAccess(cbm, s.ExpectedSize())
+		serveBeatmap(c, set, noVideo, r, s.ExpectedSize())
+		return
 	}
 
-	cbm.SetLastRequested(time.Now())
+	if !cbm.IsDownloaded() || cbm.FileSize() == 0 {
+		// tell why the latest download failed
+		err := cbm.Wait(ctx)
+		if err == nil {
+			err = downloader.ErrNoRedirect
+		}
+		downloadError(c, err, c.House.Failure(id, noVideo))
+		return
+	}
+
+	// the SHA-256 of the file is its strong ETag: the clients which already
+	// have it don't download it again.
+	hash := cbm.Hash()
+	if hash != "" && etagMatches(c.Request.Header.Get("If-None-Match"), etag(hash)) {
+		c.WriteHeader("ETag", etag(hash))
+		c.Code(304)
+		return
+	}
+
+	// let the client download the beatmap from the storage directly.
+	if u := c.House.PresignedURL(cbm, fileName(set, noVideo)); u != "" {
+		c.House.LogAccess(cbm, int64(cbm.FileSize()))
+		c.WriteHeader("Location", u)
+		c.Code(302)
+		return
+	}
 
 	f, err := cbm.File()
 	if err != nil {
@@ -91,80 +155,469 @@ func Download(c *api.Context) {
 		errorMessage(c, 500, "Internal error")
 		return
 	}
-	stat, err := f.Stat()
-	if err == nil && stat.Size() < 100 {
-		cbm.NotDownloaded(c.House)
-	}
 	defer f.Close()
+	if hash != "" {
+		c.WriteHeader("ETag", etag(hash))
+		c.WriteHeader("Digest", digest(hash))
+	}
+	c.House.LogAccess(cbm, int64(cbm.FileSize()))
+	serveBeatmap(c, set, noVideo, f, int64(cbm.FileSize()))
+}
+
+// etag returns the ETag of the beatmap whose file has the given SHA-256.
+func etag(hash string) string {
+	return strconv.Quote(hash)
+}
+
+// etagMatches tells whether the If-None-Match header matches etag.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// digest returns the Digest header of the beatmap whose file has the given
+// SHA-256, with which the clients can check what they downloaded.
+func digest(hash string) string {
+	sum, _ := hex.DecodeString(hash)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// fileName returns the name of the file of the beatmap sent to the clients.
+func fileName(set *models.Set, noVideo bool) string {
+	name := fmt.Sprintf("%d %s - %s", set.ID, set.Artist, set.Title)
+	if noVideo {
+		name += " [no video]"
+	}
+	return name + ".osz"
+}
+
+// available tells whether b is downloaded, or being downloaded.
+func available(b *housekeeper.CachedBeatmap) bool {
+	if b == nil {
+		return false
+	}
+	return b.Stream() != nil || (b.IsDownloaded() && b.FileSize() > 0)
+}
 
+// serveBeatmap sends the beatmap read from r. size is -1 if it is not known.
+func serveBeatmap(c *api.Context, set *models.Set, noVideo bool, r io.Reader, size int64) {
 	c.WriteHeader("Content-Type", "application/octet-stream")
-	c.WriteHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%d %s - %s.osz", set.ID, set.Artist, set.Title)))
-	c.WriteHeader("Content-Length", strconv.FormatUint(uint64(cbm.FileSize()), 10))
+	c.WriteHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName(set, noVideo)))
+	if size >= 0 {
+		c.WriteHeader("Content-Length", strconv.FormatInt(size, 10))
+	}
 	c.Code(200)
 
-	_, err = io.Copy(c, f)
+	_, err := io.Copy(c, r)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		c.Err(err)
+		// the beatmap has been sent only in part: make sure the client
+		// doesn't take it as complete.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// backingOff answers with an error if the download of one of the given
+// variants of the set failed recently, and it is not time to try again yet.
+func backingOff(c *api.Context, id int, variants []bool) bool {
+	for _, noVideo := range variants {
+		if f := c.House.Failure(id, noVideo); f != nil && time.Now().Before(f.NextRetry) {
+			errorMessage(c, 503, "The beatmap could not be downloaded right now"+failureDetails(c, f))
+			return true
+		}
+	}
+	return false
+}
+
+// downloadError answers to a request with the status code describing why the
+// download failed. f is the failure record of the beatmap, if any.
+func downloadError(c *api.Context, err error, f *housekeeper.Failure) {
+	details := ""
+	if f != nil {
+		details = failureDetails(c, f)
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		// nobody is there to read the answer
+		log.Println("[⬇️][✋] Download aborted:", err)
+	case errors.Is(err, downloader.ErrTimeout):
+		errorMessage(c, 504, "The mirrors timed out while downloading the beatmap"+details)
+	case errors.Is(err, downloader.ErrTooLarge):
+		errorMessage(c, 502, "The beatmap is too large to be downloaded"+details)
+	case errors.Is(err, downloader.ErrNotZip):
+		errorMessage(c, 502, "The mirrors did not send a valid beatmap"+details)
+	case errors.Is(err, downloader.ErrNoRedirect):
+		errorMessage(c, 404, "The beatmap is not available from the mirrors"+details)
+	case errors.Is(err, downloader.ErrNoMirrors):
+		errorMessage(c, 503, "No mirror is available right now"+details)
+	case errors.Is(err, housekeeper.ErrDiskFull):
+		errorMessage(c, 507, "The disk of the mirror is full, try again later")
+	default:
+		c.Err(err)
+		errorMessage(c, 500, "Internal error"+details)
+	}
+}
+
+// failureDetails sets the Retry-After header from the failure record of a
+// beatmap, and describes it to be appended to the error message.
+func failureDetails(c *api.Context, f *housekeeper.Failure) string {
+	retryAfter := int(time.Until(f.NextRetry).Seconds()) + 1
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.WriteHeader("Retry-After", strconv.Itoa(retryAfter))
+	return fmt.Sprintf("\n\nReason: %s\nAttempts: %d\nNext retry: %s",
+		f.Reason, f.Attempts, f.NextRetry.UTC().Format(time.RFC3339))
+}
+
+// Failures lists the records of the failed downloads. It requires the admin
+// token.
+func Failures(c *api.Context) {
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	c.WriteJSON(200, c.House.Failures())
+}
+
+// ResetFailures removes the failure records of the set with the given id, or
+// of all the sets if no id is given, so that they are downloaded at the next
+// request. It requires the admin token.
+func ResetFailures(c *api.Context) {
+	query := c.Request.URL.Query()
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	id, _ := strconv.Atoi(query.Get("id"))
+	n, err := c.House.ResetFailures(id)
 	if err != nil {
 		c.Err(err)
+		c.WriteJSON(500, nil)
+		return
 	}
+	c.WriteJSON(200, struct {
+		Reset int `json:"reset"`
+	}{n})
 }
 
-func downloadBeatmap(c *downloader.Client, b *housekeeper.CachedBeatmap, house *housekeeper.House) error {
-	log.Println("[⬇️]", b.String())
+// Pins returns the IDs of the sets which are never removed from the cache. It
+// requires the admin token.
+func Pins(c *api.Context) {
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	c.WriteJSON(200, c.House.Pinned())
+}
 
-	var fileSize uint64
+// Pin protects the set with the given id from being removed from the cache,
+// or lets it be removed again if unpin is set. It requires the admin token.
+func Pin(c *api.Context) {
+	query := c.Request.URL.Query()
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	id, err := strconv.Atoi(query.Get("id"))
+	if err != nil || id <= 0 {
+		c.WriteJSON(400, nil)
+		return
+	}
+	if existsQueryKey(c, "unpin") {
+		err = c.House.Unpin(id)
+	} else {
+		err = c.House.Pin(id)
+	}
+	if err != nil {
+		c.Err(err)
+		c.WriteJSON(500, nil)
+		return
+	}
+	c.WriteJSON(200, c.House.Pinned())
+}
 
+// Rescan starts a rescan of the data folders in the background, to adopt the
+// beatmaps missing from the state and drop those whose file vanished. It
+// requires the admin token.
+func Rescan(c *api.Context) {
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	c.WriteJSON(202, struct {
+		Started bool `json:"started"`
+	}{c.House.StartRescan()})
+}
+
+// RescanStatus returns the report of the latest rescan, and whether one is
+// running. It requires the admin token.
+func RescanStatus(c *api.Context) {
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	rep, running := c.House.LastRescan()
+	c.WriteJSON(200, struct {
+		Running bool                      `json:"running"`
+		Last    *housekeeper.RescanReport `json:"last"`
+	}{running, rep})
+}
+
+// Scrub starts a verification of the beatmaps in the cache in the background.
+// With all, every beatmap is verified, rather than only those which have not
+// been verified recently. It requires the admin token.
+func Scrub(c *api.Context) {
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	c.WriteJSON(202, struct {
+		Started bool `json:"started"`
+	}{c.House.StartScrub(housekeeper.ScrubOptions{All: existsQueryKey(c, "all")})})
+}
+
+// ScrubStatus returns the report of the latest verification of the cache,
+// with the corrupted beatmaps found, and whether one is running. It requires
+// the admin token.
+func ScrubStatus(c *api.Context) {
+	if !c.CheckAdmin() {
+		c.WriteJSON(404, nil)
+		return
+	}
+	rep, running := c.House.LastScrub()
+	c.WriteJSON(200, struct {
+		Running bool                     `json:"running"`
+		Last    *housekeeper.ScrubReport `json:"last"`
+	}{running, rep})
+}
+
+// adoptFile completes the download of b with the file already in the cache, if
+// any.
+func adoptFile(b *housekeeper.CachedBeatmap) bool {
 	// so problem is that for some maps, we can put them in cache forcely (like map updating or smth)
 	fCbm, errF := b.File()
-	if errF == nil {
-		stat, err := fCbm.Stat()
-		if err != nil {
-			goto DOWNLOAD_MAP
-		}
-		defer func() {
-			// We need to wrap this inside a function because this way the arguments
-			// to DownloadCompleted are actually evaluated during the defer call.
-			b.DownloadCompleted(uint64(stat.Size()), house)
-		}()
-
-		// FILE EXISTS!
-		log.Println("[⬇️][👌] Map found in cache, no need to download!", b.String())
-		defer fCbm.Close()
+	if errF != nil {
+		return false
+	}
+	stat, err := fCbm.Stat()
+	fCbm.Close()
+	if err != nil || stat.Size() == 0 {
+		return false
+	}
+	// FILE EXISTS!
+	log.Println("[⬇️][👌] Map found in cache, no need to download!", b.String())
+	b.Stream().Adopt(stat.Size())
+	return true
+}
+
+// startDownload starts downloading b from the mirrors into its stream. It
+// returns once a mirror has started sending the beatmap, while the rest of the
+// download goes on in the background. The beatmap is validated against the
+// metadata of the set before being committed: if it is not valid, or the
+// mirror stops sending it, it is downloaded again from the next mirror.
+func startDownload(c *api.Context, b *housekeeper.CachedBeatmap) error {
+	log.Println("[⬇️]", b.String())
+	s := b.Stream()
+	if adoptFile(b) {
 		return nil
 	}
+	ctx := b.DownloadContext()
+	s.Expect(expectedMD5s(c, b.ID))
 
-DOWNLOAD_MAP:
 	// Start downloading.
-	r, err := c.Download(b.ID, b.NoVideo)
+	r, err := c.DLClient.Download(ctx, b.ID, b.NoVideo)
 	if err != nil {
-		if err == downloader.ErrNoRedirect {
-			return nil
-		}
+		s.Abort(err)
 		return err
 	}
-	defer func() {
-		// We need to wrap this inside a function because this way the arguments
-		// to DownloadCompleted are actually evaluated during the defer call.
-		b.DownloadCompleted(fileSize, house)
+	err = s.Start(r.Size)
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	go func() {
+		var failed []string
+		for {
+			err := copyBeatmap(s, r)
+			if err == nil {
+				break
+			}
+			switch {
+			case housekeeper.IsInvalid(err):
+				log.Println("[⬇️][❌] Invalid beatmap from", r.Mirror+":", b.String(), err)
+			case r.Failed() != nil:
+				log.Println("[⬇️][❌] Download failed from", r.Mirror+":", b.String(), err)
+			default:
+				log.Println("[⬇️][❌]", b.String(), err)
+				s.Abort(err)
+				return
+			}
+
+			// fall back to the next mirror
+			failed = append(failed, r.Mirror)
+			next, nextErr := c.DLClient.Download(ctx, b.ID, b.NoVideo, failed...)
+			if nextErr != nil {
+				s.Abort(err)
+				return
+			}
+			r = next
+			if s.Restart(r.Size) != nil {
+				r.Close()
+				return
+			}
+		}
+		err := s.Commit()
+		if err != nil {
+			log.Println("[⬇️][❌]", b.String(), err)
+		}
 	}()
-	defer r.Close()
+	return nil
+}
 
-	// open the file we will write the beatmap into
-	f, err := b.CreateFile()
+// copyBeatmap writes the beatmap read from r into s, validates it and closes
+// r. Invalid beatmaps are reported to the pool of mirrors.
+func copyBeatmap(s *housekeeper.Stream, r *downloader.Body) error {
+	_, err := io.Copy(s, r)
+	if err == nil {
+		err = s.Validate()
+		if housekeeper.IsInvalid(err) {
+			r.ReportInvalid(err)
+		}
+	}
+	r.Close()
+	return err
+}
+
+// expectedMD5s returns the MD5s of the .osu files of the set in the database.
+func expectedMD5s(c *api.Context, id int) []string {
+	md5s, err := setMD5s(c.DB, id)
+	if err != nil {
+		c.Err(err)
+	}
+	return md5s
+}
+
+// setMD5s returns the MD5s of the .osu files of the set in db, or nil if the
+// set is not there.
+func setMD5s(db models.Repository, id int) ([]string, error) {
+	set, err := db.FetchSet(id, true)
+	if err != nil || set == nil {
+		return nil, err
+	}
+	md5s := make([]string, 0, len(set.ChildrenBeatmaps))
+	for _, bm := range set.ChildrenBeatmaps {
+		if bm.FileMD5 != "" {
+			md5s = append(md5s, bm.FileMD5)
+		}
+	}
+	return md5s, nil
+}
+
+// MD5s returns a function returning the MD5s of the .osu files of a set in db,
+// to be used as the MD5s of the housekeeper.
+func MD5s(db models.Repository) func(id int) ([]string, error) {
+	return func(id int) ([]string, error) {
+		return setMD5s(db, id)
+	}
+}
+
+// Fetcher returns a function downloading a beatmap in the background, outside
+// of any request, to be used as the Fetch of the housekeeper.
+func Fetcher(db models.Repository, house *housekeeper.House, dlc *downloader.Client) func(b *housekeeper.CachedBeatmap) {
+	return func(b *housekeeper.CachedBeatmap) {
+		c := &api.Context{DB: db, House: house, DLClient: dlc}
+		err := startDownload(c, b)
+		if err != nil {
+			log.Println("[⬇️][❌]", b.String(), err)
+		}
+	}
+}
+
+// startStrip makes b, a beatmap without video, from the full beatmap of the
+// same set, which is downloaded first if it is not in the cache. The full
+// beatmap is downloaded as long as someone is waiting for b.
+func startStrip(c *api.Context, set *models.Set, b *housekeeper.CachedBeatmap) error {
+	log.Println("[⬇️][✂️]", b.String())
+	s := b.Stream()
+	if adoptFile(b) {
+		return nil
+	}
+
+	full, shouldDownload := c.House.AcquireBeatmap(&housekeeper.CachedBeatmap{
+		ID:          set.ID,
+		LastUpdate:  set.LastUpdate,
+		DataFolders: c.House.DataFolders,
+	})
+	stopFull := full.Watch(b.DownloadContext())
+	if !shouldDownload && full.Stream() == nil && (!full.IsDownloaded() || full.FileSize() == 0) {
+		shouldDownload = c.House.Redownload(full)
+	}
+	if shouldDownload {
+		err := startDownload(c, full)
+		if err != nil {
+			stopFull()
+			s.Abort(err)
+			return err
+		}
+	}
+	full.SetLastRequested(time.Now())
+
+	go func() {
+		defer stopFull()
+		err := stripVideo(b.DownloadContext(), full, s)
+		if err != nil {
+			log.Println("[⬇️][❌]", b.String(), err)
+			s.Abort(err)
+			return
+		}
+		err = s.Commit()
+		if err != nil {
+			log.Println("[⬇️][❌]", b.String(), err)
+		}
+	}()
+	return nil
+}
+
+// stripVideo waits for the full beatmap to be downloaded, and writes it
+// without its videos into s.
+func stripVideo(ctx context.Context, full *housekeeper.CachedBeatmap, s *housekeeper.Stream) error {
+	err := full.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if !full.IsDownloaded() || full.FileSize() == 0 {
+		return downloader.ErrNoRedirect
+	}
+	f, err := full.File()
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-
-	fSizeRaw, err := io.Copy(f, r)
-	fileSize = uint64(fSizeRaw)
+	err = s.Start(-1)
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = housekeeper.StripVideo(s, f, int64(full.FileSize()))
+	return err
 }
 
 func init() {
 	api.GET("/d/:id", Download)
+	api.GET("/api/failures", Failures)
+	api.POST("/api/failures/reset", ResetFailures)
+	api.GET("/api/pins", Pins)
+	api.POST("/api/pins/set", Pin)
+	api.POST("/api/rescan", Rescan)
+	api.GET("/api/rescan/status", RescanStatus)
+	api.POST("/api/scrub", Scrub)
+	api.GET("/api/scrub/status", ScrubStatus)
 
 	// Chimu compatibility
 	api.GET("/api/v1/download/:id", Download)
@@ -26,7 +26,7 @@ func Beatmap(c *api.Context) {
 		return
 	}
 
-	bms, err := models.FetchBeatmaps(c.DB, id)
+	bms, err := c.DB.FetchBeatmaps(id)
 	if err != nil {
 		c.Err(err)
 		c.WriteJSON(500, nil)
@@ -48,7 +48,7 @@ func BeatmapChimu(c *api.Context) {
 		return
 	}
 
-	bms, err := models.FetchBeatmapsChimu(c.DB, id)
+	bms, err := c.DB.FetchBeatmapsChimu(id)
 	if err != nil {
 		c.Err(err)
 		c.WriteJSON(500, nil)
@@ -70,7 +70,7 @@ func BeatmapMd5(c *api.Context) {
 		return
 	}
 
-	bms, err := models.FetchBeatmapsByMd5(c.DB, md5)
+	bms, err := c.DB.FetchBeatmapsByMd5(md5)
 	if err != nil {
 		c.Err(err)
 		c.WriteJSON(500, nil)
@@ -92,7 +92,7 @@ func Set(c *api.Context) {
 		return
 	}
 
-	set, err := models.FetchSet(c.DB, id, true)
+	set, err := c.DB.FetchSet(id, true)
 	if err != nil {
 		c.Err(err)
 		c.WriteJSON(500, nil)
@@ -114,7 +114,7 @@ func SetChimu(c *api.Context) {
 		return
 	}
 
-	set, err := models.FetchSetChimu(c.DB, id, true)
+	set, err := c.DB.FetchSetChimu(id, true)
 	if err != nil {
 		c.Err(err)
 		c.WriteJSON(500, nil)
@@ -143,7 +143,7 @@ func RefreshSet(c *api.Context) {
 		return
 	}
 
-	err := dbmirror.DiscoverOneSet(&c.OsuAPI, c.DB, id)
+	err := dbmirror.DiscoverOneSet(c.OsuAPI, c.DB, id)
 	if err != nil {
 		c.Write([]byte("fuck you leatherman, map not found"))
 		return
@@ -227,7 +227,7 @@ func sIntWithBounds(strs []string, min, max int) []int {
 // Search does a search on the sets available in the database.
 func Search(c *api.Context) {
 	query := c.Request.URL.Query()
-	sets, err := models.SearchSets(c.DB, c.SearchDB, models.SearchOptions{
+	sets, err := c.DB.SearchSets(models.SearchOptions{
 		Status: sIntWithBounds(query["status"], -2, 4),
 		Query:  query.Get("query"),
 		Mode:   sIntWithBounds(query["mode"], 0, 3),
@@ -247,7 +247,7 @@ func Search(c *api.Context) {
 // Search does a search on the sets available in the database.
 func SearchChimu(c *api.Context) {
 	query := c.Request.URL.Query()
-	sets, err := models.SearchSetsChimu(c.DB, c.SearchDB, models.SearchOptions{
+	sets, err := c.DB.SearchSetsChimu(models.SearchOptions{
 		Status: sIntWithBounds(query["status"], -2, 4),
 		Query:  query.Get("query"),
 		Mode:   sIntWithBounds(query["mode"], 0, 3),
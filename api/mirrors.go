@@ -0,0 +1,13 @@
+package api
+
+func mirrorsHandler(c *Context) {
+	if c.DLClient == nil || c.DLClient.Mirrors == nil {
+		c.WriteJSON(200, []struct{}{})
+		return
+	}
+	c.WriteJSON(200, c.DLClient.Mirrors.Stats())
+}
+
+func init() {
+	GET("/mirrors", mirrorsHandler)
+}
@@ -2,38 +2,34 @@ package api
 
 import (
 	"encoding/json"
-
-	"github.com/osukurikku/cheesegull/models"
 )
 
+// statusJSON is sent with the names of its fields as keys, which the clients
+// of /status rely on.
 type statusJSON struct {
-	MaxSize         uint64 `json:max_cache_size`
-	MaxSizeInGB     int    `json:max_cache_size_gb`
-	CacheMapsLength int    `json:cache_maps_length`
-	CacheMapsSize   uint64 `json:cache_maps_size`
-	CountMaps       int    `json:count_maps`
-	BiggestSetID    int    `json:biggest_set_id`
+	MaxSize         uint64
+	MaxSizeInGB     int
+	CacheMapsLength int
+	CacheMapsSize   uint64
+	CountMaps       int
+	BiggestSetID    int
 }
 
 func statusHandler(c *Context) {
 	c.WriteHeader("Content-Type", "application/json; charset=utf-8")
-	biggestSetID, err := models.BiggestSetID(c.DB)
+	biggestSetID, err := c.DB.BiggestSetID()
 	if err != nil {
 		biggestSetID = 0
 	}
 
-	var countMaps int
-	row, _ := c.DB.Query("SELECT COUNT(*) FROM sets")
-	for row.Next() {
-		_ = row.Scan(&countMaps)
-	}
+	countMaps, _ := c.DB.CountSets()
 
 	totalSize, _ := c.House.StateSizeAndRemovableMaps()
 
 	status := statusJSON{
 		MaxSize:         c.House.MaxSize,
 		MaxSizeInGB:     c.House.MaxSizeGB,
-		CacheMapsLength: len(c.House.State),
+		CacheMapsLength: c.House.Len(),
 		CacheMapsSize:   totalSize / 1024 / 1024 / 1024,
 		CountMaps:       countMaps,
 		BiggestSetID:    biggestSetID,
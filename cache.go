@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alecthomas/kingpin"
+
+	"github.com/osukurikku/cheesegull/api/download"
+	"github.com/osukurikku/cheesegull/housekeeper"
+)
+
+var (
+	cacheCmd = kingpin.Command("cache", "Manage the local cache of beatmaps.")
+
+	cacheLsCmd = cacheCmd.Command("ls", "List the beatmaps in the cache.")
+	cacheGCCmd = cacheCmd.Command("gc", "Remove the least recently requested beatmaps until the cache fits in --max-disk.")
+
+	cacheVerifyCmd    = cacheCmd.Command("verify", "Check that all the beatmaps in the cache are intact zip files, whose .osu files have the MD5s in the database.")
+	cacheVerifyRemove = cacheVerifyCmd.Flag("remove", "Move the corrupted beatmaps to the quarantine folder, and remove them from the cache.").Bool()
+	cacheVerifyMD5    = cacheVerifyCmd.Flag("md5", "Check the MD5s of the .osu files against the database.").Default("true").Bool()
+
+	cacheRescanCmd = cacheCmd.Command("rescan", "Make the state match the files in the data folders: adopt the files missing from the state, and drop the beatmaps whose file vanished.")
+
+	cacheSimulateCmd  = cacheCmd.Command("simulate", "Replay an access log written with --access-log against every eviction policy, and report their hit ratios.")
+	cacheSimulateLog  = cacheSimulateCmd.Arg("log", "Access log.").Required().ExistingFile()
+	cacheSimulateSize = cacheSimulateCmd.Flag("size", "Size of the simulated cache, in GB. Defaults to --max-disk.").Float64()
+
+	cacheImportCmd = cacheCmd.Command("import", "Copy the .osz files in a folder into the cache. Their sets must be in the database.")
+	cacheImportDir = cacheImportCmd.Arg("folder", "Folder containing files named <set id>.osz, or <set id>n.osz for sets without video").Required().ExistingDir()
+
+	cacheExportCmd = cacheCmd.Command("export", "Copy all the beatmaps in the cache into a folder.")
+	cacheExportDir = cacheExportCmd.Arg("folder", "Destination folder.").Required().ExistingDir()
+)
+
+func cacheLs() {
+	house := openHouse()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNOVIDEO\tSIZE\tLAST UPDATE\tLAST REQUESTED\tSHA-256")
+	for _, b := range house.Beatmaps() {
+		hash := b.Hash()
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Fprintf(w, "%d\t%t\t%d\t%s\t%s\t%s\n", b.ID, b.NoVideo, b.FileSize(),
+			b.LastUpdate.Format("2006-01-02 15:04:05"),
+			b.LastRequested().Format("2006-01-02 15:04:05"), hash)
+	}
+	w.Flush()
+}
+
+func cacheGC() {
+	house := openHouse()
+	house.CleanUp()
+}
+
+func cacheVerify() {
+	house := openHouse()
+	house.ScrubRate = 0
+	if *cacheVerifyMD5 {
+		house.MD5s = download.MD5s(openDB())
+	}
+
+	rep, err := house.Scrub(context.Background(), housekeeper.ScrubOptions{
+		All:    true,
+		DryRun: !*cacheVerifyRemove,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, e := range rep.Corrupted {
+		fmt.Printf("corrupted: %d (no video: %t): %s\n", e.ID, e.NoVideo, e.Reason)
+		if e.Quarantine != "" {
+			fmt.Println("  moved to", e.Quarantine)
+		}
+	}
+	fmt.Println(rep.Checked, "beatmaps verified,", len(rep.Corrupted), "corrupted,", rep.Errors, "errors")
+	if len(rep.Corrupted) > 0 && !*cacheVerifyRemove {
+		os.Exit(1)
+	}
+}
+
+func cacheRescan() {
+	house := openHouse()
+	house.RescanPause = 0
+
+	rep, err := house.Rescan(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, e := range rep.Adopted {
+		fmt.Printf("adopted: %d (no video: %t, %d bytes)\n", e.ID, e.NoVideo, e.Size)
+	}
+	for _, e := range rep.Vanished {
+		fmt.Printf("vanished: %d (no video: %t)\n", e.ID, e.NoVideo)
+	}
+	for _, e := range rep.Resized {
+		fmt.Printf("resized: %d (no video: %t, %d bytes)\n", e.ID, e.NoVideo, e.Size)
+	}
+	for _, name := range rep.Removed {
+		fmt.Println("removed:", name)
+	}
+	fmt.Println(rep.Files, "files,", len(rep.Adopted), "adopted,", len(rep.Vanished),
+		"vanished and", len(rep.Resized), "resized beatmaps,", len(rep.Removed), "removed files")
+}
+
+func cacheSimulate() {
+	f, err := os.Open(*cacheSimulateLog)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	log, err := housekeeper.ReadAccessLog(f)
+	f.Close()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	size := *maxDisk
+	if *cacheSimulateSize > 0 {
+		size = *cacheSimulateSize
+	}
+	capacity := uint64(float64(1024*1024*1024) * size)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tKEEP RANKED\tHIT RATIO\tBYTE HIT RATIO")
+	for _, name := range []string{"lru", "lfu", "gdsf"} {
+		for _, keepRanked := range []bool{false, true} {
+			res := housekeeper.Simulate(evictionPolicy(name, keepRanked), capacity, log)
+			fmt.Fprintf(w, "%s\t%t\t%.2f%%\t%.2f%%\n", name, keepRanked,
+				res.HitRatio()*100, res.ByteHitRatio()*100)
+		}
+	}
+	w.Flush()
+}
+
+func cacheImport() {
+	house := openHouse()
+	db := openDB()
+
+	files, err := ioutil.ReadDir(*cacheImportDir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	imported := 0
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".osz")
+		noVideo := strings.HasSuffix(name, "n")
+		id, err := strconv.Atoi(strings.TrimSuffix(name, "n"))
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".osz") || err != nil {
+			continue
+		}
+		set, err := db.FetchSet(id, false)
+		if err != nil {
+			fmt.Println(id, err)
+			continue
+		}
+		if set == nil {
+			fmt.Println(id, "set not found in the database, skipping")
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(*cacheImportDir, file.Name()))
+		if err != nil {
+			fmt.Println(id, err)
+			continue
+		}
+		err = house.Import(&housekeeper.CachedBeatmap{
+			ID:           id,
+			NoVideo:      noVideo && set.HasVideo,
+			LastUpdate:   set.LastUpdate,
+			RankedStatus: set.RankedStatus,
+		}, f)
+		f.Close()
+		if err != nil {
+			fmt.Println(id, err)
+			continue
+		}
+		imported++
+	}
+
+	err = house.SaveState()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(imported, "beatmaps imported")
+}
+
+func cacheExport() {
+	house := openHouse()
+
+	exported := 0
+	for _, b := range house.Beatmaps() {
+		if !b.IsDownloaded() || b.FileSize() == 0 {
+			continue
+		}
+		err := exportBeatmap(b, filepath.Join(*cacheExportDir, b.FileName()))
+		if err != nil {
+			fmt.Println(b.ID, err)
+			continue
+		}
+		exported++
+	}
+	fmt.Println(exported, "beatmaps exported")
+}
+
+func exportBeatmap(b *housekeeper.CachedBeatmap, dst string) error {
+	src, err := b.File()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	osuapi "github.com/thehowl/go-osuapi"
 
 	"github.com/osukurikku/cheesegull/api"
@@ -19,7 +20,7 @@ import (
 	"github.com/osukurikku/cheesegull/models"
 
 	// Components of the API we want to use
-	_ "github.com/osukurikku/cheesegull/api/download"
+	"github.com/osukurikku/cheesegull/api/download"
 	_ "github.com/osukurikku/cheesegull/api/metadata"
 )
 
@@ -27,41 +28,198 @@ const searchDSNDocs = `"DSN to use for fulltext searches. ` +
 	`This should be a SphinxQL server. Follow the format of the MySQL DSN. ` +
 	`This can be the same as MYSQL_DSN, and cheesegull will still run ` +
 	`successfully, however what happens when search is tried is undefined ` +
-	`behaviour and you should definetely bother to set it up (follow the README).`
+	`behaviour and you should definetely bother to set it up (follow the README). ` +
+	`Leave it empty to search directly in the database (see --search-backend). ` +
+	`With --search-backend=sphinx, it defaults to ` + defaultSearchDSN + `.`
+
+// defaultSearchDSN is the DSN of the SphinxQL server when the sphinx search
+// backend is chosen explicitly without a DSN.
+const defaultSearchDSN = "root@tcp(127.0.0.1:9306)/cheesegull"
 
 var (
-	osuAPIKey        = kingpin.Flag("api-key", "osu! API key").Short('k').Envar("OSU_API_KEY").String()
-	osuUsername      = kingpin.Flag("osu-username", "osu! username (for downloading and fetching whether a beatmap has a video)").Short('u').Envar("OSU_USERNAME").String()
-	osuPassword      = kingpin.Flag("osu-password", "osu! password (for downloading and fetching whether a beatmap has a video)").Short('p').Envar("OSU_PASSWORD").String()
-	mysqlDSN         = kingpin.Flag("mysql-dsn", "DSN of MySQL").Short('m').Default("root@/cheesegull").Envar("MYSQL_DSN").String()
-	searchDSN        = kingpin.Flag("search-dsn", searchDSNDocs).Default("root@tcp(127.0.0.1:9306)/cheesegull").Envar("SEARCH_DSN").String()
-	httpAddr         = kingpin.Flag("http-addr", "Address on which to take HTTP requests.").Short('a').Default("127.0.0.1:62011").String()
-	maxDisk          = kingpin.Flag("max-disk", "Maximum number of GB used by beatmap cache.").Default("10").Envar("MAXIMUM_DISK").Float64()
-	downloadHostname = kingpin.Flag("download-host-name", "Where i should download beatmaps").Default("osu.ppy.sh").Envar("DOWNLOAD_HOSTNAME").String()
-	secretCI         = kingpin.Flag("secret-ci", "CI key for map refreshing and etc").Default("MOM_IS_YOURS").Envar("SECRET_CI").String()
-	bmsOsuKey        = kingpin.Flag("bmsOsuKey", "CI key for bloodcat map archive").Default("MOM_IS_YOURS").Envar("BMS_OSU_KEY").String()
-	removeNonZip     = kingpin.Flag("remove-non-zip", "Remove non-zip files.").Default("false").Bool()
-	dataFolders      = kingpin.Flag("folders", "Paths to folders through ,").Default("/data/").String()
+	osuAPIKey         = kingpin.Flag("api-key", "Key of the legacy osu! API, used to fetch the metadata of the sets unless an OAuth application is configured.").Short('k').Envar("OSU_API_KEY").String()
+	osuUsername       = kingpin.Flag("osu-username", "osu! username (for downloading and fetching whether a beatmap has a video)").Short('u').Envar("OSU_USERNAME").String()
+	osuPassword       = kingpin.Flag("osu-password", "osu! password (for downloading and fetching whether a beatmap has a video)").Short('p').Envar("OSU_PASSWORD").String()
+	osuClientID       = kingpin.Flag("osu-client-id", "ID of the OAuth application to use the osu! API v2 with. When set, the API is used instead of the legacy website to download beatmaps, to know whether they have a video and to fetch the metadata of the sets.").Envar("OSU_CLIENT_ID").Int()
+	osuClientSecret   = kingpin.Flag("osu-client-secret", "Secret of the OAuth application to use the osu! API v2 with.").Envar("OSU_CLIENT_SECRET").String()
+	osuURL            = kingpin.Flag("osu-url", "URL of the osu! website, used with the osu! API v2.").Default("https://osu.ppy.sh").Envar("OSU_URL").String()
+	dbDriver          = kingpin.Flag("db-driver", "Database to store the beatmaps metadata in (mysql, sqlite3, postgres)").Default("mysql").Envar("DB_DRIVER").Enum("mysql", "sqlite3", "postgres")
+	dbDSN             = kingpin.Flag("db-dsn", "DSN of the database. For SQLite, this is the path to the database file. Defaults to --mysql-dsn when using MySQL.").Envar("DB_DSN").String()
+	mysqlDSN          = kingpin.Flag("mysql-dsn", "DSN of MySQL").Short('m').Default("root@/cheesegull").Envar("MYSQL_DSN").String()
+	searchBackend     = kingpin.Flag("search-backend", "How to do fulltext searches (sphinx, like, tsvector). Defaults to sphinx if --search-dsn is set and MySQL is used, tsvector on PostgreSQL and like otherwise.").Envar("SEARCH_BACKEND").Enum("sphinx", "like", "tsvector")
+	searchDSN         = kingpin.Flag("search-dsn", searchDSNDocs).Envar("SEARCH_DSN").String()
+	httpAddr          = kingpin.Flag("http-addr", "Address on which to take HTTP requests.").Short('a').Default("127.0.0.1:62011").String()
+	maxDisk           = kingpin.Flag("max-disk", "Maximum number of GB used by beatmap cache.").Default("10").Envar("MAXIMUM_DISK").Float64()
+	downloadHostname  = kingpin.Flag("download-host-name", "Where i should download beatmaps").Default("osu.ppy.sh").Envar("DOWNLOAD_HOSTNAME").String()
+	secretCI          = kingpin.Flag("secret-ci", "CI key for map refreshing and etc").Default("MOM_IS_YOURS").Envar("SECRET_CI").String()
+	bmsOsuKey         = kingpin.Flag("bmsOsuKey", "CI key for bloodcat map archive").Default("MOM_IS_YOURS").Envar("BMS_OSU_KEY").String()
+	connectTimeout    = kingpin.Flag("connect-timeout", "Maximum time to connect to a mirror.").Default("10s").Envar("CONNECT_TIMEOUT").Duration()
+	headerTimeout     = kingpin.Flag("header-timeout", "Maximum time to wait for a mirror to start answering.").Default("30s").Envar("HEADER_TIMEOUT").Duration()
+	idleTimeout       = kingpin.Flag("idle-timeout", "Maximum time to wait for data from a mirror while downloading a beatmap.").Default("30s").Envar("IDLE_TIMEOUT").Duration()
+	maxBeatmapSize    = kingpin.Flag("max-beatmap-size", "Maximum size of a downloaded beatmap, in MB. 0 means no limit.").Default("500").Envar("MAX_BEATMAP_SIZE").Int64()
+	mirrorsConfig     = kingpin.Flag("mirrors", "JSON file containing the configuration of the mirrors to download beatmaps from. Defaults to the download host, storage.ripple.moe and sayobot.").Envar("MIRRORS_CONFIG").ExistingFile()
+	failureBackoff    = kingpin.Flag("failure-backoff", "Time to wait before downloading again a beatmap which failed to download. It doubles at every failure.").Default("5m").Envar("FAILURE_BACKOFF").Duration()
+	maxFailureBackoff = kingpin.Flag("max-failure-backoff", "Maximum time to wait before downloading again a beatmap which failed to download.").Default("24h").Envar("MAX_FAILURE_BACKOFF").Duration()
+	failuresFile      = kingpin.Flag("failures-file", "File where the records of the failed downloads are saved.").Default("cgfailures.json").Envar("FAILURES_FILE").String()
+	stateFile         = kingpin.Flag("state-file", "File where the state of the beatmap cache is saved.").Default("cgbin.db").Envar("STATE_FILE").String()
+	stripVideo        = kingpin.Flag("strip-video", "Make the beatmaps without video from the full ones, rather than downloading them separately.").Default("true").Envar("STRIP_VIDEO").Bool()
+	rescan            = kingpin.Flag("rescan", "Scan the data folders in the background at startup, to adopt the beatmaps missing from the state and drop those whose file vanished.").Default("true").Envar("RESCAN").Bool()
+	eviction          = kingpin.Flag("eviction", "Which beatmaps to remove first when the cache is full: the least recently requested (lru), the least frequently requested (lfu), or those requested the least for their size (gdsf).").Default("lru").Envar("EVICTION").Enum("lru", "lfu", "gdsf")
+	keepRanked        = kingpin.Flag("keep-ranked", "Remove the beatmaps which are not ranked, approved, qualified or loved before the others when the cache is full.").Default("false").Envar("KEEP_RANKED").Bool()
+	lfuHalfLife       = kingpin.Flag("lfu-half-life", "Time after which the requests count half as much, with --eviction lfu.").Default("168h").Envar("LFU_HALF_LIFE").Duration()
+	pinsFile          = kingpin.Flag("pins-file", "File where the sets which are never removed from the cache are saved.").Default("cgpins.json").Envar("PINS_FILE").String()
+	accessLog         = kingpin.Flag("access-log", "File where every request of a beatmap is logged, to be replayed with cache simulate.").Envar("ACCESS_LOG").String()
+	dataFolders       = kingpin.Flag("folders", "Paths of the folders where beatmaps are stored, separated by commas. Each can be followed by =<quota in GB>, and by :hot or :cold for the tiered placement, e.g. /ssd/=50:hot,/hdd/=500:cold.").Default("/data/").String()
+	placement         = kingpin.Flag("placement", "How to choose the folder where a beatmap is stored (most-free, round-robin, tiered). With tiered, beatmaps are stored in the hot folders, and moved to the cold ones after --cold-after.").Default("most-free").Envar("PLACEMENT").Enum("most-free", "round-robin", "tiered")
+	coldAfter         = kingpin.Flag("cold-after", "Time after which a beatmap which has not been requested is moved to a cold folder, with the tiered placement.").Default("168h").Envar("COLD_AFTER").Duration()
+	rebalanceInterval = kingpin.Flag("rebalance-interval", "Time between two moves of beatmaps between the folders, to respect their quotas and the tiered placement. 0 only rebalances when a folder is over its quota.").Default("1h").Envar("REBALANCE_INTERVAL").Duration()
+	freeLow           = kingpin.Flag("free-low", "Free space in GB below which beatmaps are removed from the folders of a disk, until it is over --free-high. 0 disables it.").Default("0").Envar("FREE_LOW").Float64()
+	freeHigh          = kingpin.Flag("free-high", "Free space in GB to reach on a disk once it dropped below --free-low.").Default("0").Envar("FREE_HIGH").Float64()
+	freeCritical      = kingpin.Flag("free-critical", "Free space in GB below which no new beatmap is downloaded. 0 disables it.").Default("0").Envar("FREE_CRITICAL").Float64()
+	scrubRate         = kingpin.Flag("scrub-rate", "Rate in MB/s at which the scrubber reads the beatmaps in the cache to verify them. 0 disables the scrubber.").Default("5").Envar("SCRUB_RATE").Float64()
+	scrubAfter        = kingpin.Flag("scrub-after", "Time after which the scrubber verifies a beatmap again.").Default("720h").Envar("SCRUB_AFTER").Duration()
+	quarantineFolder  = kingpin.Flag("quarantine", "Folder where the corrupted beatmaps are moved.").Default("quarantine").Envar("QUARANTINE").String()
+	redownload        = kingpin.Flag("redownload-corrupted", "Download again the corrupted beatmaps found by the scrubber, rather than removing them from the cache.").Default("false").Envar("REDOWNLOAD_CORRUPTED").Bool()
+	refreshUpdated    = kingpin.Flag("refresh-updated", "Download again in the background the cached sets updated upstream as soon as the update is seen, rather than at their next request. The old version is served until then.").Default("false").Envar("REFRESH_UPDATED").Bool()
+	s3Endpoint        = kingpin.Flag("s3-endpoint", "URL of an S3-compatible object storage (Amazon S3, MinIO...) where the beatmaps are moved once downloaded, e.g. http://localhost:9000. Several instances can share it.").Envar("S3_ENDPOINT").String()
+	s3Region          = kingpin.Flag("s3-region", "Region of the object storage.").Default("us-east-1").Envar("S3_REGION").String()
+	s3Bucket          = kingpin.Flag("s3-bucket", "Bucket where the beatmaps are stored.").Envar("S3_BUCKET").String()
+	s3Prefix          = kingpin.Flag("s3-prefix", "Prefix of the keys of the beatmaps in the bucket, e.g. beatmaps/.").Envar("S3_PREFIX").String()
+	s3AccessKey       = kingpin.Flag("s3-access-key", "Access key of the object storage.").Envar("S3_ACCESS_KEY").String()
+	s3SecretKey       = kingpin.Flag("s3-secret-key", "Secret key of the object storage.").Envar("S3_SECRET_KEY").String()
+	s3Redirect        = kingpin.Flag("s3-redirect", "Redirect the clients to presigned URLs of the object storage, valid for this time, rather than sending them the beatmaps. 0 disables the redirects.").Default("0").Envar("S3_REDIRECT").Duration()
+	autoMigrate       = kingpin.Flag("auto-migrate", "Apply pending migrations when starting the server.").Default("true").Envar("AUTO_MIGRATE").Bool()
+	ignoreMigrations  = kingpin.Flag("ignore-migrations", "Start the server even if migrations are pending or failed.").Default("false").Envar("IGNORE_MIGRATIONS").Bool()
 )
 
-func addTimeParsing(dsn string) string {
-	sep := "?"
-	if strings.Contains(dsn, "?") {
-		sep = "&"
-	}
-	dsn += sep + "parseTime=true&multiStatements=true"
-	return dsn
-}
+var (
+	serveCmd = kingpin.Command("serve", "Run the CheeseGull server.").Default()
+)
 
 func main() {
-	kingpin.Parse()
+	cmd := kingpin.Parse()
 
 	fmt.Println("CheeseGull", Version)
-	api.Version = Version
 
-	// set up housekeeper
+	switch cmd {
+	case discoverCmd.FullCommand():
+		discover()
+	case refreshCmd.FullCommand():
+		refresh()
+	case cacheLsCmd.FullCommand():
+		cacheLs()
+	case cacheGCCmd.FullCommand():
+		cacheGC()
+	case cacheVerifyCmd.FullCommand():
+		cacheVerify()
+	case cacheRescanCmd.FullCommand():
+		cacheRescan()
+	case cacheSimulateCmd.FullCommand():
+		cacheSimulate()
+	case cacheImportCmd.FullCommand():
+		cacheImport()
+	case cacheExportCmd.FullCommand():
+		cacheExport()
+	case dbCheckCmd.FullCommand():
+		dbCheck()
+	case migrateUpCmd.FullCommand():
+		migrateUp()
+	case migrateDownCmd.FullCommand():
+		migrateDown()
+	case migrateStatusCmd.FullCommand():
+		migrateStatus()
+	default:
+		serve()
+	}
+}
+
+// openDB opens the database and sets up the search, as specified in the
+// flags, exiting if anything fails.
+func openDB() *models.Store {
+	dsn := *dbDSN
+	if dsn == "" {
+		if *dbDriver != models.MySQL.Name() {
+			fmt.Println("--db-dsn is required when not using MySQL")
+			os.Exit(1)
+		}
+		dsn = *mysqlDSN
+	}
+	db, err := models.Open(*dbDriver, dsn)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	db.Search = models.SearchBackend(*searchBackend)
+	if db.Search == "" {
+		switch {
+		case *searchDSN != "" && db.Dialect == models.MySQL:
+			db.Search = models.SearchSphinx
+		case db.Dialect == models.PostgreSQL:
+			db.Search = models.SearchTSVector
+		default:
+			db.Search = models.SearchLike
+		}
+	}
+	switch {
+	case db.Search == models.SearchSphinx && db.Dialect != models.MySQL:
+		fmt.Println("Sphinx search is only supported with MySQL")
+		os.Exit(1)
+	case db.Search == models.SearchTSVector && db.Dialect != models.PostgreSQL:
+		fmt.Println("tsvector search is only supported with PostgreSQL")
+		os.Exit(1)
+	case db.Search == models.SearchSphinx:
+		dsn := *searchDSN
+		if dsn == "" {
+			dsn = defaultSearchDSN
+		}
+		db.SearchDB, err = sql.Open("mysql", dsn)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	return db
+}
+
+// openHouse sets up the housekeeper and loads its state, exiting if it
+// fails.
+func openHouse() *housekeeper.House {
 	house := housekeeper.New()
-	house.UpdateFolders(*dataFolders)
+	if !house.UpdateFolders(*dataFolders) {
+		os.Exit(1)
+	}
+	house.Placement = housekeeper.Placements[*placement]
+	house.ColdAfter = *coldAfter
+	house.RebalanceInterval = *rebalanceInterval
+	house.StateFile = *stateFile
+	house.PinsFile = *pinsFile
+	house.FailuresFile = *failuresFile
+	house.StripVideo = *stripVideo
+	house.FailureBackoff = *failureBackoff
+	house.QuarantineFolder = *quarantineFolder
+	house.ScrubRate = uint64(float64(1024*1024) * (*scrubRate))
+	house.ScrubAfter = *scrubAfter
+	house.RedownloadCorrupted = *redownload
+	house.RefreshUpdated = *refreshUpdated
+	house.MaxFailureBackoff = *maxFailureBackoff
+	if *s3Endpoint != "" {
+		s3, err := housekeeper.NewS3(housekeeper.S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+			AccessKey: *s3AccessKey,
+			SecretKey: *s3SecretKey,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		house.Storage = s3
+		house.RedirectExpiry = *s3Redirect
+	}
 	err := house.LoadState()
 	if err != nil {
 		fmt.Println(err)
@@ -69,49 +227,146 @@ func main() {
 	}
 	house.MaxSize = uint64(float64(1024*1024*1024) * (*maxDisk))
 	house.MaxSizeGB = int(*maxDisk)
-	if *removeNonZip {
-		house.RemoveNonZip()
-		return
-	}
-	house.StartCleaner()
+	house.LowFree = uint64(float64(1024*1024*1024) * (*freeLow))
+	house.HighFree = uint64(float64(1024*1024*1024) * (*freeHigh))
+	house.CriticalFree = uint64(float64(1024*1024*1024) * (*freeCritical))
+	house.SetEviction(evictionPolicy(*eviction, *keepRanked))
+	return house
+}
 
-	// set up osuapi client
-	c := osuapi.NewClient(*osuAPIKey)
+// evictionPolicy returns the eviction policy with the given name, which keeps
+// the ranked sets if keepRanked is true.
+func evictionPolicy(name string, keepRanked bool) housekeeper.EvictionPolicy {
+	p, err := housekeeper.NewEvictionPolicy(name, *lfuHalfLife)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if keepRanked {
+		p = housekeeper.StatusAware{EvictionPolicy: p}
+	}
+	return p
+}
 
-	// set up downloader
+// logIn logs into osu! to create the downloader, which is also used by
+// dbmirror to know whether sets have a video, and sets up its mirrors. The osu!
+// API v2 is used if an OAuth application is configured, the legacy website
+// otherwise. It exits if it fails.
+func logIn() *downloader.Client {
 	downloader.SetHostName(*downloadHostname)
 	downloader.SetBmsOsuKey(*bmsOsuKey)
-	d, err := downloader.LogIn(*osuUsername, *osuPassword)
+	opts := downloader.Options{
+		ConnectTimeout: *connectTimeout,
+		HeaderTimeout:  *headerTimeout,
+		IdleTimeout:    *idleTimeout,
+		MaxSize:        *maxBeatmapSize * 1024 * 1024,
+	}
+	var (
+		d   *downloader.Client
+		err error
+	)
+	if *osuClientID != 0 {
+		d, err = downloader.NewAPIClient(downloader.OAuthConfig{
+			ClientID:     *osuClientID,
+			ClientSecret: *osuClientSecret,
+			Username:     *osuUsername,
+			Password:     *osuPassword,
+			BaseURL:      *osuURL,
+		}, opts)
+	} else {
+		d, err = downloader.LogIn(*osuUsername, *osuPassword, opts)
+	}
 	if err != nil {
 		fmt.Println("Can't log in into osu!:", err)
 		os.Exit(1)
 	}
+	if *mirrorsConfig != "" {
+		cfg, err := downloader.LoadPoolConfig(*mirrorsConfig)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		d.Mirrors = downloader.NewPool(cfg)
+	}
 	dbmirror.SetHasVideo(d.HasVideo)
+	return d
+}
 
-	// set up mysql
-	db, err := sql.Open("mysql", addTimeParsing(*mysqlDSN))
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// setSource returns where dbmirror fetches the sets from: the osu! API v2 if d
+// uses it, the legacy osu! API otherwise.
+func setSource(d *downloader.Client) dbmirror.Source {
+	if api, ok := d.Official.(*downloader.API); ok {
+		return dbmirror.APIv2{API: api}
 	}
+	return dbmirror.APIv1{Client: osuapi.NewClient(*osuAPIKey)}
+}
 
-	// set up search
-	db2, err := sql.Open("mysql", *searchDSN)
+func serve() {
+	api.Version = Version
+
+	// set up housekeeper
+	house := openHouse()
+	rec, err := house.Reconcile()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("Error recovering the cache:", err)
 		os.Exit(1)
 	}
+	if rec.TempFiles > 0 {
+		fmt.Println("Removed", rec.TempFiles, "partial downloads")
+	}
+	if *accessLog != "" {
+		f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		house.AccessLog = f
+	}
+	house.StartCleaner()
+	house.StartRebalancer()
+	if *rescan {
+		house.StartRescan()
+	}
+
+	// set up downloader
+	d := logIn()
+	src := setSource(d)
 
-	// run mysql migrations
-	err = models.RunMigrations(db)
+	// set up the database
+	db := openDB()
+	if *autoMigrate {
+		err = db.MigrateUp()
+		if err != nil {
+			fmt.Println("Error running migrations:", err)
+		}
+	}
+	err = db.CheckMigrations()
 	if err != nil {
-		fmt.Println("Error running migrations", err)
+		if !*ignoreMigrations {
+			fmt.Println(err)
+			fmt.Println("Fix the database or use --ignore-migrations to start anyway.")
+			os.Exit(1)
+		}
+		fmt.Println("Warning:", err)
 	}
 
+	// the scrubber checks the beatmaps against the database, and the
+	// corrupted and updated beatmaps are downloaded again in the background.
+	house.MD5s = download.MD5s(db)
+	house.Fetch = download.Fetcher(db, house, d)
+	if *scrubRate > 0 {
+		house.StartScrubber()
+	}
+
+	// the cached sets are downloaded again once updated upstream.
+	dbmirror.OnSetUpdated(func(set models.Set) {
+		house.SetUpdated(set.ID, set.LastUpdate)
+	})
+
 	// start running components of cheesegull
-	go dbmirror.StartSetUpdater(c, db)
-	go dbmirror.DiscoverEvery(c, db, time.Hour*6, time.Minute)
+	go dbmirror.StartSetUpdater(src, db)
+	go dbmirror.DiscoverEvery(src, db, time.Hour*6, time.Minute)
 
 	// create request handler
-	panic(http.ListenAndServe(*httpAddr, api.CreateHandler(db, db2, house, d, *c, *secretCI)))
+	panic(http.ListenAndServe(*httpAddr, api.CreateHandler(db, house, d, src, *secretCI)))
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	dbCmd      = kingpin.Command("db", "Manage the database.")
+	dbCheckCmd = dbCmd.Command("check", "Check that the database is reachable and up to date.")
+)
+
+func dbCheck() {
+	db := openDB()
+
+	err := db.DB.Ping()
+	if err != nil {
+		fmt.Println("database unreachable:", err)
+		os.Exit(1)
+	}
+	if db.SearchDB != nil {
+		err = db.SearchDB.Ping()
+		if err != nil {
+			fmt.Println("search database unreachable:", err)
+			os.Exit(1)
+		}
+	}
+	err = db.CheckMigrations()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	sets, err := db.CountSets()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	biggest, err := db.BiggestSetID()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Database is ok:", sets, "sets, biggest set ID", biggest)
+}
@@ -3,7 +3,6 @@
 package dbmirror
 
 import (
-	"database/sql"
 	"log"
 	"os"
 	"time"
@@ -36,6 +35,16 @@ func SetHasVideo(f func(int) (bool, error)) {
 	hasVideo = f
 }
 
+// onSetUpdated is called with the sets whose LastUpdate changed upstream,
+// once they are saved in the database.
+var onSetUpdated func(set models.Set)
+
+// OnSetUpdated sets the function called with the sets whose LastUpdate changed
+// upstream, for instance to refresh them in the cache.
+func OnSetUpdated(f func(set models.Set)) {
+	onSetUpdated = f
+}
+
 func createChildrenBeatmaps(bms []osuapi.Beatmap) []models.Beatmap {
 	cgBms := make([]models.Beatmap, len(bms))
 	for idx, bm := range bms {
@@ -79,18 +88,17 @@ func setFromOsuAPIBeatmap(b osuapi.Beatmap) models.Set {
 	}
 }
 
-func updateSet(c *osuapi.Client, db *sql.DB, set models.Set) error {
+func updateSet(src Source, db models.Repository, set models.Set) error {
 	var (
-		err error
-		bms []osuapi.Beatmap
+		err        error
+		fetched    *models.Set
+		videoKnown bool
 	)
 	if set.ID == 0 {
 		return nil
 	}
 	for i := 0; i < 5; i++ {
-		bms, err = c.GetBeatmaps(osuapi.GetBeatmapsOpts{
-			BeatmapSetID: set.ID,
-		})
+		fetched, videoKnown, err = src.Set(set.ID)
 		if err == nil {
 			break
 		}
@@ -98,29 +106,29 @@ func updateSet(c *osuapi.Client, db *sql.DB, set models.Set) error {
 			return err
 		}
 	}
-	if len(bms) == 0 {
+	if fetched == nil {
 		// set has been deleted from osu!, so we do the same thing
 		return nil
 	}
 
-	// create the new set based on the information we can obtain from the
-	// first beatmap's information
-	var x = bms[0]
-	updated := !time.Time(x.LastUpdate).Equal(set.LastUpdate)
-	oldHasVideo := set.HasVideo
-	set = setFromOsuAPIBeatmap(x)
-	set.HasVideo = oldHasVideo
-	set.ChildrenBeatmaps = createChildrenBeatmaps(bms)
-	if updated {
-		// if it has been updated, video might have been added or removed
-		// so we need to check for it
-		set.HasVideo, err = hasVideo(x.BeatmapSetID)
-		if err != nil {
-			return err
+	updated := !fetched.LastUpdate.Equal(set.LastUpdate)
+	if !videoKnown {
+		fetched.HasVideo = set.HasVideo
+		if updated {
+			// if it has been updated, video might have been added or
+			// removed so we need to check for it
+			fetched.HasVideo, err = hasVideo(set.ID)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	return models.CreateSet(db, set)
+	err = db.CreateSet(*fetched)
+	if err == nil && updated && onSetUpdated != nil {
+		onSetUpdated(*fetched)
+	}
+	return err
 }
 
 // By making the buffer the same size of the batch, we can be sure that all
@@ -131,9 +139,9 @@ var setQueue = make(chan models.Set, PerBatch)
 // setUpdater is a function to be run as a goroutine, that receives sets
 // from setQueue and brings the information in the database up-to-date for that
 // set.
-func setUpdater(c *osuapi.Client, db *sql.DB) {
+func setUpdater(src Source, db models.Repository) {
 	for set := range setQueue {
-		err := updateSet(c, db, set)
+		err := updateSet(src, db, set)
 		if err != nil {
 			logError(err)
 		}
@@ -141,14 +149,14 @@ func setUpdater(c *osuapi.Client, db *sql.DB) {
 }
 
 // StartSetUpdater does batch updates for the beatmaps in the database,
-// employing goroutines to fetch the data from the osu! API and then write it to
-// the database.
-func StartSetUpdater(c *osuapi.Client, db *sql.DB) {
+// employing goroutines to fetch the data from src and then write it to the
+// database.
+func StartSetUpdater(src Source, db models.Repository) {
 	for i := 0; i < SetUpdaterWorkers; i++ {
-		go setUpdater(c, db)
+		go setUpdater(src, db)
 	}
 	for {
-		sets, err := models.FetchSetsForBatchUpdate(db, PerBatch)
+		sets, err := db.FetchSetsForBatchUpdate(PerBatch)
 		if err != nil {
 			logError(err)
 			time.Sleep(NewBatchEvery)
@@ -1,108 +1,93 @@
 package dbmirror
 
 import (
-	"database/sql"
 	"errors"
 	"log"
 	"time"
 
 	"github.com/osukurikku/cheesegull/models"
-	osuapi "github.com/thehowl/go-osuapi"
 )
 
 // Discover discovers new beatmaps in the osu! database and adds them.
-func Discover(c *osuapi.Client, db *sql.DB) error {
-	id, err := models.BiggestSetID(db)
+func Discover(src Source, db models.Repository) error {
+	id, err := db.BiggestSetID()
 	if err != nil {
 		return err
 	}
-	log.Println("[D] Starting discovery with ID", id)
+	return DiscoverRange(src, db, id+1, 0)
+}
+
+// DiscoverRange discovers the beatmaps with ID between from and to (both
+// included), and adds them. If to is 0, discovery goes on until 4096
+// consecutive IDs are found not to exist.
+func DiscoverRange(src Source, db models.Repository, from, to int) error {
+	log.Println("[D] Starting discovery with ID", from)
 	// failedAttempts is the number of consecutive failed attempts at fetching a
 	// beatmap (by 'failed', in this case we mean exclusively when a request to
 	// get_beatmaps returns no beatmaps)
 	failedAttempts := 0
-	for failedAttempts < 4096 {
-		id++
+	for id := from; ; id++ {
+		if (to == 0 && failedAttempts >= 4096) || (to != 0 && id > to) {
+			break
+		}
 		if id%64 == 0 {
 			log.Println("[D]", id)
 		}
-		var (
-			err error
-			bms []osuapi.Beatmap
-		)
-		for i := 0; i < 5; i++ {
-			bms, err = c.GetBeatmaps(osuapi.GetBeatmapsOpts{
-				BeatmapSetID: id,
-			})
-			if err == nil {
-				break
-			}
-			if i >= 5 {
-				return err
-			}
-		}
+		found, err := discoverSet(src, db, id)
 		if err != nil {
 			return err
 		}
-		if len(bms) == 0 {
+		if !found {
 			failedAttempts++
 			continue
 		}
 		failedAttempts = 0
-
-		set := setFromOsuAPIBeatmap(bms[0])
-		set.ChildrenBeatmaps = createChildrenBeatmaps(bms)
-		set.HasVideo, err = hasVideo(bms[0].BeatmapSetID)
-		if err != nil {
-			return err
-		}
-
-		err = models.CreateSet(db, set)
-		if err != nil {
-			return err
-		}
 	}
 
 	return nil
 }
 
-// DiscoverOneSet impressive function)
-func DiscoverOneSet(c *osuapi.Client, db *sql.DB, setID int) error {
-	log.Println("[D] Starting check ID", setID, "requested by superuser")
+// discoverSet fetches the set with the given ID from src and adds it to the
+// database. found is false if the set does not exist.
+func discoverSet(src Source, db models.Repository, id int) (found bool, err error) {
 	var (
-		err error
-		bms []osuapi.Beatmap
+		set        *models.Set
+		videoKnown bool
 	)
 	for i := 0; i < 5; i++ {
-		bms, err = c.GetBeatmaps(osuapi.GetBeatmapsOpts{
-			BeatmapSetID: setID,
-		})
+		set, videoKnown, err = src.Set(id)
 		if err == nil {
 			break
 		}
-		if i >= 5 {
-			return err
-		}
 	}
 	if err != nil {
-		return err
+		return false, err
 	}
-	if len(bms) == 0 {
-		return errors.New("Set not found")
+	if set == nil {
+		return false, nil
 	}
 
-	set := setFromOsuAPIBeatmap(bms[0])
-	set.ChildrenBeatmaps = createChildrenBeatmaps(bms)
-	set.HasVideo, err = hasVideo(bms[0].BeatmapSetID)
-	if err != nil {
-		return err
+	if !videoKnown {
+		set.HasVideo, err = hasVideo(id)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	err = models.CreateSet(db, set)
+	return true, db.CreateSet(*set)
+}
+
+// DiscoverOneSet fetches the set with the given ID from src and adds it to the
+// database, or updates it if it already exists.
+func DiscoverOneSet(src Source, db models.Repository, setID int) error {
+	log.Println("[D] Starting check ID", setID, "requested by superuser")
+	found, err := discoverSet(src, db, setID)
 	if err != nil {
 		return err
 	}
-
+	if !found {
+		return errors.New("Set not found")
+	}
 	return nil
 }
 
@@ -110,9 +95,9 @@ func DiscoverOneSet(c *osuapi.Client, db *sql.DB, setID int) error {
 // an error, then it will wait errorWait before running Discover again. If
 // Discover doesn't return any error, then it will wait successWait before
 // running Discover again.
-func DiscoverEvery(c *osuapi.Client, db *sql.DB, successWait, errorWait time.Duration) {
+func DiscoverEvery(src Source, db models.Repository, successWait, errorWait time.Duration) {
 	for {
-		err := Discover(c, db)
+		err := Discover(src, db)
 		if err == nil {
 			time.Sleep(successWait)
 		} else {
@@ -0,0 +1,96 @@
+package dbmirror
+
+import (
+	"context"
+	"time"
+
+	"github.com/osukurikku/cheesegull/downloader"
+	"github.com/osukurikku/cheesegull/models"
+	osuapi "github.com/thehowl/go-osuapi"
+)
+
+// Source is where the metadata of the sets is fetched from.
+type Source interface {
+	// Set fetches the set with the given ID and its beatmaps. It returns nil
+	// if the set does not exist. videoKnown tells whether the HasVideo of
+	// the set is known: otherwise, the function passed to SetHasVideo is
+	// used when it has to be checked.
+	Set(id int) (set *models.Set, videoKnown bool, err error)
+}
+
+// APIv1 fetches the sets from the legacy osu! API.
+type APIv1 struct {
+	Client *osuapi.Client
+}
+
+// Set fetches the set with the given ID from the legacy osu! API, which does
+// not tell whether it has a video.
+func (a APIv1) Set(id int) (*models.Set, bool, error) {
+	bms, err := a.Client.GetBeatmaps(osuapi.GetBeatmapsOpts{
+		BeatmapSetID: id,
+	})
+	if err != nil || len(bms) == 0 {
+		return nil, false, err
+	}
+	// create the set based on the information we can obtain from the first
+	// beatmap's information
+	set := setFromOsuAPIBeatmap(bms[0])
+	set.ChildrenBeatmaps = createChildrenBeatmaps(bms)
+	return &set, false, nil
+}
+
+// APIv2 fetches the sets from the osu! API v2.
+type APIv2 struct {
+	API *downloader.API
+}
+
+// Set fetches the set with the given ID from the osu! API v2.
+func (a APIv2) Set(id int) (*models.Set, bool, error) {
+	s, err := a.API.BeatmapSet(context.Background(), id)
+	if err == downloader.ErrSetNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	set := models.Set{
+		ID:           s.ID,
+		RankedStatus: s.Ranked,
+		LastUpdate:   s.LastUpdated,
+		LastChecked:  time.Now(),
+		Artist:       s.Artist,
+		Title:        s.Title,
+		Creator:      s.Creator,
+		Source:       s.Source,
+		Tags:         s.Tags,
+		HasVideo:     s.Video,
+		Genre:        s.Genre.ID,
+		Language:     s.Language.ID,
+		Favourites:   s.FavouriteCount,
+	}
+	if s.RankedDate != nil {
+		set.ApprovedDate = *s.RankedDate
+	}
+	set.ChildrenBeatmaps = make([]models.Beatmap, len(s.Beatmaps))
+	for i, bm := range s.Beatmaps {
+		set.ChildrenBeatmaps[i] = models.Beatmap{
+			ID:               bm.ID,
+			ParentSetID:      s.ID,
+			DiffName:         bm.Version,
+			FileMD5:          bm.Checksum,
+			Mode:             bm.Mode,
+			BPM:              bm.BPM,
+			AR:               bm.AR,
+			OD:               bm.OD,
+			CS:               bm.CS,
+			HP:               bm.HP,
+			TotalLength:      bm.TotalLength,
+			HitLength:        bm.HitLength,
+			Playcount:        bm.Playcount,
+			Passcount:        bm.Passcount,
+			MaxCombo:         bm.MaxCombo,
+			DifficultyRating: bm.DifficultyRating,
+		}
+	}
+	return &set, true, nil
+}
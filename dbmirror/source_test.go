@@ -0,0 +1,46 @@
+package dbmirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/osukurikku/cheesegull/downloader"
+)
+
+func TestAPIv2Set(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"token_type":"Bearer","expires_in":86400,"access_token":"token"}`))
+	})
+	mux.HandleFunc("/api/v2/beatmapsets/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":1,"artist":"Kenji Ninuma","title":"DISCO PRINCE","creator":"peppy",
+			"ranked":1,"video":true,"last_updated":"2007-10-06T17:46:31Z","ranked_date":"2007-10-06T17:46:31Z",
+			"favourite_count":900,"genre":{"id":2,"name":"Video Game"},"language":{"id":3,"name":"English"},
+			"beatmaps":[{"id":75,"beatmapset_id":1,"version":"Normal","mode_int":0,"bpm":119.999,"ar":6,"accuracy":6,"cs":4,"drain":6}]}`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	src := APIv2{API: downloader.NewAPI(downloader.OAuthConfig{BaseURL: srv.URL}, downloader.Options{})}
+
+	set, videoKnown, err := src.Set(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2007, 10, 6, 17, 46, 31, 0, time.UTC)
+	if !videoKnown || !set.HasVideo || set.Title != "DISCO PRINCE" || set.RankedStatus != 1 ||
+		!set.ApprovedDate.Equal(date) || set.Genre != 2 || set.Language != 3 || set.Favourites != 900 {
+		t.Fatalf("unexpected set %+v", set)
+	}
+	if len(set.ChildrenBeatmaps) != 1 || set.ChildrenBeatmaps[0].ParentSetID != 1 ||
+		set.ChildrenBeatmaps[0].DiffName != "Normal" || set.ChildrenBeatmaps[0].AR != 6 {
+		t.Fatalf("unexpected beatmaps %+v", set.ChildrenBeatmaps)
+	}
+
+	// missing sets are not an error.
+	set, _, err = src.Set(2)
+	if set != nil || err != nil {
+		t.Fatalf("want no set got %v (%v)", set, err)
+	}
+}
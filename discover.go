@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+
+	"github.com/osukurikku/cheesegull/dbmirror"
+)
+
+var (
+	discoverCmd  = kingpin.Command("discover", "Discover new sets from the osu! API, and exit.")
+	discoverFrom = discoverCmd.Flag("from", "ID of the first set to discover. Defaults to the one after the biggest set ID in the database.").Int()
+	discoverTo   = discoverCmd.Flag("to", "ID of the last set to discover. If not given, discovery stops after 4096 consecutive sets are not found.").Int()
+
+	refreshCmd    = kingpin.Command("refresh", "Fetch the given sets from the osu! API, and update them in the database.")
+	refreshSetIDs = refreshCmd.Arg("set-id", "IDs of the sets to refresh.").Required().Ints()
+)
+
+func discover() {
+	src := setSource(logIn())
+	db := openDB()
+
+	from := *discoverFrom
+	if from == 0 {
+		biggest, err := db.BiggestSetID()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		from = biggest + 1
+	}
+
+	err := dbmirror.DiscoverRange(src, db, from, *discoverTo)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func refresh() {
+	src := setSource(logIn())
+	db := openDB()
+
+	failed := false
+	for _, id := range *refreshSetIDs {
+		err := dbmirror.DiscoverOneSet(src, db, id)
+		if err != nil {
+			fmt.Println(id, err)
+			failed = true
+			continue
+		}
+		fmt.Println(id, "ok")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
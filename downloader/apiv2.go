@@ -0,0 +1,350 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuthConfig is the configuration of an API client.
+type OAuthConfig struct {
+	// ClientID and ClientSecret identify the OAuth application, which can
+	// be registered in the settings of an osu! account.
+	ClientID     int
+	ClientSecret string
+	// Username and Password, if set, are used to log in with the password
+	// grant, which is needed to download beatmaps. Otherwise, the client
+	// credentials grant is used, and only the metadata can be fetched.
+	Username string
+	Password string
+	// BaseURL is the URL of the osu! website. Defaults to https://osu.ppy.sh.
+	BaseURL string
+}
+
+// ErrAuth is returned when the osu! API refuses the credentials of the client.
+var ErrAuth = errors.New("cheesegull/downloader: osu! API authentication failed")
+
+// ErrSetNotFound is returned by API.BeatmapSet when the set does not exist.
+var ErrSetNotFound = errors.New("cheesegull/downloader: beatmap set not found")
+
+// API is a client of the osu! API v2. It takes care of getting an access
+// token, and of refreshing it before it expires.
+type API struct {
+	cfg  OAuthConfig
+	http *http.Client
+	now  func() time.Time
+
+	mtx          sync.Mutex
+	accessToken  string
+	refreshToken string
+	expires      time.Time
+	// flight is the token being requested, if any.
+	flight *tokenFlight
+}
+
+// tokenFlight is a request for a token, which the other requests needing one
+// wait for instead of making their own.
+type tokenFlight struct {
+	done chan struct{}
+	// err is the error of the request, once done is closed.
+	err error
+}
+
+// NewAPI creates a client of the osu! API v2, using the timeouts in opts. No
+// request is made until the client is used.
+func NewAPI(cfg OAuthConfig, opts Options) *API {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "https://osu.ppy.sh"
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	opts.setDefaults()
+	return &API{
+		cfg:  cfg,
+		http: newHTTPClient(opts),
+		now:  time.Now,
+	}
+}
+
+// tokenResponse is the answer of the OAuth server to a token request.
+type tokenResponse struct {
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// token returns a valid access token, requesting a new one if the current one
+// is missing or about to expire. Only one token is requested at a time: the
+// other callers wait for it.
+func (a *API) token(ctx context.Context) (string, error) {
+	for {
+		a.mtx.Lock()
+		// leave a margin for the requests which are about to be made
+		if a.accessToken != "" && a.now().Add(time.Minute).Before(a.expires) {
+			token := a.accessToken
+			a.mtx.Unlock()
+			return token, nil
+		}
+		f := a.flight
+		if f == nil {
+			f = &tokenFlight{done: make(chan struct{})}
+			a.flight = f
+			refresh := a.refreshToken
+			a.mtx.Unlock()
+			return a.requestToken(ctx, f, refresh)
+		}
+		a.mtx.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if f.err != nil {
+			return "", f.err
+		}
+	}
+}
+
+// requestToken requests a new token for the flight f, with the given refresh
+// token if it is set, and records it. The request is made without a.mtx held.
+func (a *API) requestToken(ctx context.Context, f *tokenFlight, refresh string) (string, error) {
+	t, err := a.newToken(ctx, refresh)
+
+	a.mtx.Lock()
+	if err == nil {
+		a.accessToken = t.AccessToken
+		a.expires = a.now().Add(time.Duration(t.ExpiresIn) * time.Second)
+		a.refreshToken = t.RefreshToken
+	} else if ctx.Err() == nil {
+		// the others try again if the request was only canceled by the
+		// caller.
+		f.err = err
+	}
+	a.flight = nil
+	a.mtx.Unlock()
+	close(f.done)
+
+	if err != nil {
+		return "", err
+	}
+	return t.AccessToken, nil
+}
+
+// newToken gets a new token from the OAuth server, using the refresh token if
+// it is set, or logging in otherwise. The RefreshToken of the response is the
+// one to use next.
+func (a *API) newToken(ctx context.Context, refresh string) (*tokenResponse, error) {
+	if refresh != "" {
+		t, err := a.grant(ctx, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refresh},
+		})
+		if err == nil {
+			if t.RefreshToken == "" {
+				t.RefreshToken = refresh
+			}
+			return t, nil
+		}
+		// the refresh token may have been revoked: log in again.
+	}
+
+	vals := url.Values{
+		"grant_type": {"client_credentials"},
+		"scope":      {"public"},
+	}
+	if a.cfg.Username != "" {
+		vals = url.Values{
+			"grant_type": {"password"},
+			"username":   {a.cfg.Username},
+			"password":   {a.cfg.Password},
+			"scope":      {"*"},
+		}
+	}
+	return a.grant(ctx, vals)
+}
+
+// grant requests a token to the OAuth server.
+func (a *API) grant(ctx context.Context, vals url.Values) (*tokenResponse, error) {
+	vals.Set("client_id", strconv.Itoa(a.cfg.ClientID))
+	vals.Set("client_secret", a.cfg.ClientSecret)
+	req, err := http.NewRequest("POST", a.cfg.BaseURL+"/oauth/token", strings.NewReader(vals.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: status %d: %s", ErrAuth, resp.StatusCode, body)
+	}
+
+	var t tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, fmt.Errorf("%w: no access token", ErrAuth)
+	}
+	return &t, nil
+}
+
+// invalidate forgets the access token, if it is still the given one, so that
+// a new one is requested.
+func (a *API) invalidate(token string) {
+	a.mtx.Lock()
+	if a.accessToken == token {
+		a.accessToken = ""
+	}
+	a.mtx.Unlock()
+}
+
+// LogIn gets an access token, to check that the credentials are valid.
+func (a *API) LogIn(ctx context.Context) error {
+	_, err := a.token(ctx)
+	return err
+}
+
+// newRequest creates an authenticated request to the API, with the given
+// headers, and returns the token it uses.
+func (a *API) newRequest(ctx context.Context, path string, headers map[string]string) (*http.Request, string, error) {
+	token, err := a.token(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest("GET", a.cfg.BaseURL+"/api/v2"+path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, token, nil
+}
+
+// get requests path from the API, with the given headers. If the token is
+// refused, a new one is requested and the request is made again.
+func (a *API) get(ctx context.Context, path string, headers map[string]string) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		req, token, err := a.newRequest(ctx, path, headers)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := a.http.Do(req)
+		if err != nil {
+			return nil, timeoutError(err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || retry > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		a.invalidate(token)
+	}
+}
+
+// APIBeatmapSet is a beatmap set as returned by the osu! API v2.
+type APIBeatmapSet struct {
+	ID             int          `json:"id"`
+	Artist         string       `json:"artist"`
+	Title          string       `json:"title"`
+	Creator        string       `json:"creator"`
+	Source         string       `json:"source"`
+	Tags           string       `json:"tags"`
+	Status         string       `json:"status"`
+	Ranked         int          `json:"ranked"`
+	Video          bool         `json:"video"`
+	LastUpdated    time.Time    `json:"last_updated"`
+	RankedDate     *time.Time   `json:"ranked_date"`
+	FavouriteCount int          `json:"favourite_count"`
+	Genre          APIEnum      `json:"genre"`
+	Language       APIEnum      `json:"language"`
+	Beatmaps       []APIBeatmap `json:"beatmaps"`
+}
+
+// APIEnum is a value of an enumeration of the osu! API v2, such as a genre.
+type APIEnum struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// APIBeatmap is a beatmap as returned by the osu! API v2.
+type APIBeatmap struct {
+	ID               int     `json:"id"`
+	BeatmapSetID     int     `json:"beatmapset_id"`
+	Version          string  `json:"version"`
+	Mode             int     `json:"mode_int"`
+	Checksum         string  `json:"checksum"`
+	DifficultyRating float64 `json:"difficulty_rating"`
+	BPM              float64 `json:"bpm"`
+	AR               float32 `json:"ar"`
+	OD               float32 `json:"accuracy"`
+	CS               float32 `json:"cs"`
+	HP               float32 `json:"drain"`
+	TotalLength      int     `json:"total_length"`
+	HitLength        int     `json:"hit_length"`
+	Playcount        int     `json:"playcount"`
+	Passcount        int     `json:"passcount"`
+	MaxCombo         int     `json:"max_combo"`
+}
+
+// BeatmapSet fetches the metadata of the set with the given ID.
+func (a *API) BeatmapSet(ctx context.Context, setID int) (*APIBeatmapSet, error) {
+	resp, err := a.get(ctx, "/beatmapsets/"+strconv.Itoa(setID), map[string]string{"Accept": "application/json"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrSetNotFound
+	default:
+		return nil, fmt.Errorf("cheesegull/downloader: osu! API answered with status %d", resp.StatusCode)
+	}
+	var set APIBeatmapSet
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// HasVideo checks whether a beatmap set has a video. The sets which do not
+// exist have none, as with the Scraper.
+func (a *API) HasVideo(setID int) (bool, error) {
+	set, err := a.BeatmapSet(context.Background(), setID)
+	if err == ErrSetNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return set.Video, nil
+}
+
+// Download requests a set through the API. If the token is refused, a new one
+// is requested and the request is made again.
+func (a *API) Download(ctx context.Context, setID int, noVideo bool, headers map[string]string) (*http.Response, error) {
+	path := "/beatmapsets/" + strconv.Itoa(setID) + "/download"
+	if noVideo {
+		path += "?noVideo=1"
+	}
+	return a.get(ctx, path, headers)
+}
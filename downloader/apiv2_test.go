@@ -0,0 +1,374 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOsu is a fake osu! website, implementing the OAuth server and the parts
+// of the API v2 used by the downloader.
+type fakeOsu struct {
+	*httptest.Server
+	t *testing.T
+
+	mtx      sync.Mutex
+	grants   []string
+	tokens   map[string]bool
+	refresh  map[string]bool
+	issued   int
+	lifetime int
+	// videos are the sets which exist, and whether they have a video.
+	videos map[int]bool
+	// downloads are the URLs of the downloads requested.
+	downloads []string
+	// hold, if set, makes the token requests wait for it to be closed.
+	hold chan struct{}
+}
+
+func newFakeOsu(t *testing.T) *fakeOsu {
+	f := &fakeOsu{
+		t:        t,
+		tokens:   make(map[string]bool),
+		refresh:  make(map[string]bool),
+		lifetime: 86400,
+		videos:   map[int]bool{1: false, 2: true},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", f.token)
+	mux.HandleFunc("/api/v2/beatmapsets/", f.api)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOsu) token(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	hold := f.hold
+	f.mtx.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	r.ParseForm()
+	grant := r.Form.Get("grant_type")
+	f.grants = append(f.grants, grant)
+	if r.Form.Get("client_id") != "42" || r.Form.Get("client_secret") != "secret" {
+		w.WriteHeader(401)
+		return
+	}
+	switch grant {
+	case "client_credentials":
+	case "password":
+		if r.Form.Get("username") != "peppy" || r.Form.Get("password") != "hunter2" {
+			w.WriteHeader(400)
+			return
+		}
+	case "refresh_token":
+		if !f.refresh[r.Form.Get("refresh_token")] {
+			w.WriteHeader(400)
+			return
+		}
+		delete(f.refresh, r.Form.Get("refresh_token"))
+	default:
+		w.WriteHeader(400)
+		return
+	}
+
+	f.issued++
+	resp := tokenResponse{
+		TokenType:   "Bearer",
+		ExpiresIn:   f.lifetime,
+		AccessToken: fmt.Sprintf("access%d", f.issued),
+	}
+	f.tokens[resp.AccessToken] = true
+	if grant != "client_credentials" {
+		resp.RefreshToken = fmt.Sprintf("refresh%d", f.issued)
+		f.refresh[resp.RefreshToken] = true
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeOsu) api(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if !f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		w.WriteHeader(401)
+		return
+	}
+	var id int
+	var action string
+	fmt.Sscanf(strings.Replace(r.URL.Path, "/", " ", -1), " api v2 beatmapsets %d %s", &id, &action)
+	video, ok := f.videos[id]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	switch action {
+	case "":
+		json.NewEncoder(w).Encode(APIBeatmapSet{
+			ID:    id,
+			Title: "test",
+			Video: video,
+			Beatmaps: []APIBeatmap{
+				{ID: id * 10, BeatmapSetID: id, Version: "Insane", Checksum: "d41d8cd98f00b204e9800998ecf8427e"},
+			},
+		})
+	case "download":
+		f.downloads = append(f.downloads, r.URL.String())
+		w.Header().Set("Content-Type", "application/x-osu-beatmap-archive")
+		w.Write([]byte(testZip))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// revoke invalidates all the access tokens.
+func (f *fakeOsu) revoke() {
+	f.mtx.Lock()
+	f.tokens = make(map[string]bool)
+	f.mtx.Unlock()
+}
+
+func (f *fakeOsu) grantsMade() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string(nil), f.grants...)
+}
+
+func testAPIConfig(f *fakeOsu) OAuthConfig {
+	return OAuthConfig{
+		ClientID:     42,
+		ClientSecret: "secret",
+		BaseURL:      f.URL,
+	}
+}
+
+func TestAPIClientCredentials(t *testing.T) {
+	f := newFakeOsu(t)
+	a := NewAPI(testAPIConfig(f), Options{})
+
+	set, err := a.BeatmapSet(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.ID != 1 || set.Title != "test" || len(set.Beatmaps) != 1 || set.Beatmaps[0].Version != "Insane" {
+		t.Fatalf("unexpected set %+v", set)
+	}
+	for id, want := range map[int]bool{1: false, 2: true} {
+		got, err := a.HasVideo(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("set %d: want video %v got %v", id, want, got)
+		}
+	}
+	if _, err := a.BeatmapSet(context.Background(), 3); err != ErrSetNotFound {
+		t.Fatalf("want ErrSetNotFound got %v", err)
+	}
+	if video, err := a.HasVideo(3); video || err != nil {
+		t.Fatalf("want no video for a missing set got %v (%v)", video, err)
+	}
+
+	// the token is reused
+	if grants := f.grantsMade(); len(grants) != 1 || grants[0] != "client_credentials" {
+		t.Fatalf("unexpected grants %v", grants)
+	}
+}
+
+func TestAPIWrongCredentials(t *testing.T) {
+	f := newFakeOsu(t)
+	cfg := testAPIConfig(f)
+	cfg.ClientSecret = "wrong"
+	_, err := NewAPIClient(cfg, Options{})
+	if err == nil || !strings.Contains(err.Error(), ErrAuth.Error()) {
+		t.Fatalf("want ErrAuth got %v", err)
+	}
+
+	cfg = testAPIConfig(f)
+	cfg.Username, cfg.Password = "peppy", "wrong"
+	_, err = NewAPIClient(cfg, Options{})
+	if err == nil {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+func TestAPIRefresh(t *testing.T) {
+	f := newFakeOsu(t)
+	cfg := testAPIConfig(f)
+	cfg.Username, cfg.Password = "peppy", "hunter2"
+	a := NewAPI(cfg, Options{})
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	if err := a.LogIn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the token expires: the refresh token is used.
+	now = now.Add(25 * time.Hour)
+	if _, err := a.HasVideo(1); err != nil {
+		t.Fatal(err)
+	}
+	// the refresh token is refused: log in again.
+	now = now.Add(25 * time.Hour)
+	f.mtx.Lock()
+	f.refresh = make(map[string]bool)
+	f.mtx.Unlock()
+	if _, err := a.HasVideo(1); err != nil {
+		t.Fatal(err)
+	}
+	// the token is revoked: a new one is requested and the request retried.
+	f.revoke()
+	if _, err := a.HasVideo(1); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"password", "refresh_token", "refresh_token", "password", "refresh_token"}
+	if grants := f.grantsMade(); strings.Join(grants, ",") != strings.Join(want, ",") {
+		t.Fatalf("want grants %v got %v", want, grants)
+	}
+}
+
+func TestAPIConcurrentRefresh(t *testing.T) {
+	f := newFakeOsu(t)
+	cfg := testAPIConfig(f)
+	cfg.Username, cfg.Password = "peppy", "hunter2"
+	a := NewAPI(cfg, Options{})
+	if err := a.LogIn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the token expires: only one request refreshes it.
+	a.mtx.Lock()
+	a.expires = time.Now()
+	a.mtx.Unlock()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.HasVideo(1)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"password", "refresh_token"}
+	if grants := f.grantsMade(); strings.Join(grants, ",") != strings.Join(want, ",") {
+		t.Fatalf("want grants %v got %v", want, grants)
+	}
+
+	// the request refreshing the token is canceled: the others make their
+	// own.
+	a.mtx.Lock()
+	a.expires = time.Now()
+	a.mtx.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.LogIn(ctx); err == nil {
+		t.Fatal("want an error refreshing with a canceled context")
+	}
+	if err := a.LogIn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the others can give up while the token is being requested.
+	a.mtx.Lock()
+	a.expires = time.Now()
+	a.mtx.Unlock()
+	hold := make(chan struct{})
+	f.mtx.Lock()
+	f.hold = hold
+	f.mtx.Unlock()
+	done := make(chan error)
+	go func() { done <- a.LogIn(context.Background()) }()
+	for flying := false; !flying; {
+		time.Sleep(time.Millisecond)
+		a.mtx.Lock()
+		flying = a.flight != nil
+		a.mtx.Unlock()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.LogIn(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want context.DeadlineExceeded got %v", err)
+	}
+	close(hold)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIDownload(t *testing.T) {
+	f := newFakeOsu(t)
+	cfg := testAPIConfig(f)
+	cfg.Username, cfg.Password = "peppy", "hunter2"
+	c, err := NewAPIClient(cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only use the API
+	c.Mirrors = NewPool(PoolConfig{Mirrors: []Mirror{{Name: "osu", Official: true}}})
+
+	for _, noVideo := range []bool{false, true} {
+		// the token is revoked: a new one is requested and the download
+		// retried.
+		f.revoke()
+		r, err := c.Download(context.Background(), 2, noVideo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != testZip {
+			t.Fatalf("unexpected download %q (%v)", data, err)
+		}
+	}
+	if _, err := c.Download(context.Background(), 3, false); err != ErrNoRedirect {
+		t.Fatalf("want ErrNoRedirect for a missing set got %v", err)
+	}
+
+	f.mtx.Lock()
+	downloads := f.downloads
+	f.mtx.Unlock()
+	want := []string{"/api/v2/beatmapsets/2/download", "/api/v2/beatmapsets/2/download?noVideo=1"}
+	if strings.Join(downloads, ",") != strings.Join(want, ",") {
+		t.Fatalf("want downloads %v got %v", want, downloads)
+	}
+}
+
+func TestScraperHasVideo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/s/1":
+			w.Write([]byte(`<a href="/d/1">Download</a>`))
+		case "/s/2":
+			w.Write([]byte(`<a href="/d/2">Download</a><a href="/d/2n">no video</a>`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	s := &Scraper{http: http.DefaultClient, BaseURL: srv.URL}
+	for id, want := range map[int]bool{1: false, 2: true} {
+		got, err := s.HasVideo(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("set %d: want video %v got %v", id, want, got)
+		}
+	}
+}
@@ -1,19 +1,21 @@
-// Package downloader implements downloading from the osu! website, through,
-// well, mostly scraping and dirty hacks.
+// Package downloader implements downloading from the osu! website, either
+// through the osu! API v2 or, well, mostly scraping and dirty hacks.
 package downloader
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
 var downloadHostName string
@@ -29,15 +31,115 @@ func SetBmsOsuKey(key string) {
 	bmsOsuKey = key
 }
 
-// LogIn logs in into an osu! account and returns a Client.
-func LogIn(username, password string) (*Client, error) {
+// Options are the limits applied to the requests made by a Client.
+type Options struct {
+	// ConnectTimeout is the maximum time to establish a connection, including
+	// the TLS handshake. Defaults to 10 seconds.
+	ConnectTimeout time.Duration
+	// HeaderTimeout is the maximum time to wait for the headers of a response
+	// once the request has been sent. Defaults to 30 seconds.
+	HeaderTimeout time.Duration
+	// IdleTimeout is the maximum time to wait for data while reading the
+	// body of a download. Defaults to 30 seconds.
+	IdleTimeout time.Duration
+	// MaxSize is the maximum size of a beatmap, in bytes. 0 means no limit.
+	MaxSize int64
+}
+
+func (o *Options) setDefaults() {
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = 10 * time.Second
+	}
+	if o.HeaderTimeout <= 0 {
+		o.HeaderTimeout = 30 * time.Second
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 30 * time.Second
+	}
+}
+
+// newHTTPClient creates an http.Client applying the timeouts in opts.
+func newHTTPClient(opts Options) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   opts.ConnectTimeout,
+			ResponseHeaderTimeout: opts.HeaderTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+		},
+	}
+}
+
+// Official is the osu! website, as seen by a Client: it tells whether sets
+// have a video, and how to download them from the website itself.
+type Official interface {
+	// HasVideo checks whether a beatmap set has a video.
+	HasVideo(setID int) (bool, error)
+	// Download requests a set from the osu! website, with the given
+	// headers.
+	Download(ctx context.Context, setID int, noVideo bool, headers map[string]string) (*http.Response, error)
+}
+
+// Scraper accesses the legacy osu! website, using the session of an account.
+type Scraper struct {
+	http *http.Client
+	// BaseURL is the URL of the legacy website. Defaults to
+	// https://old.ppy.sh.
+	BaseURL string
+}
+
+func (s *Scraper) baseURL() string {
+	if s.BaseURL == "" {
+		return "https://old.ppy.sh"
+	}
+	return s.BaseURL
+}
+
+// HasVideo checks whether a beatmap set has a video, looking for the link to
+// download it without video in its page.
+func (s *Scraper) HasVideo(setID int) (bool, error) {
+	page, err := s.http.Get(fmt.Sprintf("%s/s/%d", s.baseURL(), setID))
+	if err != nil {
+		return false, err
+	}
+	defer page.Body.Close()
+	body, err := ioutil.ReadAll(page.Body)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Contains(body, []byte(fmt.Sprintf(`href="/d/%dn"`, setID))), nil
+}
+
+// Download requests a set from the legacy website.
+func (s *Scraper) Download(ctx context.Context, setID int, noVideo bool, headers map[string]string) (*http.Response, error) {
+	u := fmt.Sprintf("%s/d/%d", s.baseURL(), setID)
+	if noVideo {
+		u += "n"
+	}
+	return get(ctx, s.http, u, headers)
+}
+
+// LogIn logs in into an osu! account on the legacy website and returns a
+// Client which uses a Scraper to access it.
+func LogIn(username, password string, opts Options) (*Client, error) {
 	j, err := cookiejar.New(&cookiejar.Options{})
 	if err != nil {
 		return nil, err
 	}
-	c := &http.Client{
-		Jar: j,
+	opts.setDefaults()
+	c := &Client{
+		http:    newHTTPClient(opts),
+		opts:    opts,
+		Mirrors: NewPool(PoolConfig{}),
 	}
+	c.http.Jar = j
+	c.Official = &Scraper{http: c.http}
 	vals := url.Values{}
 	vals.Add("redirect", "/")
 	vals.Add("sid", "")
@@ -45,106 +147,391 @@ func LogIn(username, password string) (*Client, error) {
 	vals.Add("password", password)
 	vals.Add("autologin", "on")
 	vals.Add("login", "login")
-	_, err = c.PostForm("https://old.ppy.sh/forum/ucp.php?mode=login", vals)
+	resp, err := c.http.PostForm("https://old.ppy.sh/forum/ucp.php?mode=login", vals)
 	if err != nil {
 		return nil, err
 	}
+	resp.Body.Close()
 
-	return (*Client)(c), nil
+	return c, nil
+}
+
+// NewAPIClient logs in into the osu! API v2 and returns a Client which uses it
+// to access the osu! website. Unless other mirrors are configured, beatmaps
+// are downloaded from the API first, and then from the DefaultMirrors.
+func NewAPIClient(cfg OAuthConfig, opts Options) (*Client, error) {
+	opts.setDefaults()
+	api := NewAPI(cfg, opts)
+	err := api.LogIn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	mirrors := []Mirror{{Name: "osu", Official: true}}
+	for _, m := range DefaultMirrors() {
+		m.Priority++
+		mirrors = append(mirrors, m)
+	}
+	return &Client{
+		http:     newHTTPClient(opts),
+		opts:     opts,
+		Mirrors:  NewPool(PoolConfig{Mirrors: mirrors}),
+		Official: api,
+	}, nil
 }
 
 // Client is a wrapper around an http.Client which can fetch beatmaps from the
-// osu! website.
-type Client http.Client
+// osu! website and from the mirrors in its pool.
+type Client struct {
+	http *http.Client
+	opts Options
+	// Mirrors are the mirrors beatmaps are downloaded from. LogIn sets it to
+	// a pool of the DefaultMirrors.
+	Mirrors *Pool
+	// Official is used to access the osu! website: either a Scraper or an
+	// API.
+	Official Official
+}
 
 // HasVideo checks whether a beatmap has a video.
 func (c *Client) HasVideo(setID int) (bool, error) {
-	h := (*http.Client)(c)
+	return c.Official.HasVideo(setID)
+}
 
-	page, err := h.Get(fmt.Sprintf("https://old.ppy.sh/s/%d", setID))
-	if err != nil {
-		return false, err
-	}
-	defer page.Body.Close()
-	body, err := ioutil.ReadAll(page.Body)
-	if err != nil {
-		return false, err
+// Download downloads a beatmap from the osu! website. noVideo specifies whether
+// we should request the beatmap to not have the video: in that case, only the
+// mirrors which have a NoVideoURL are used.
+//
+// Cancelling ctx aborts the download, including while reading the returned
+// body. The body returns ErrTimeout if a mirror stops sending data for longer
+// than the IdleTimeout, and ErrTooLarge if the beatmap is bigger than the
+// MaxSize.
+//
+// except are the names of the mirrors not to download from, for instance
+// because they have just sent an invalid beatmap.
+func (c *Client) Download(ctx context.Context, setID int, noVideo bool, except ...string) (*Body, error) {
+	return c.getReader(ctx, setID, noVideo, except)
+}
+
+// Body is the body of a beatmap being downloaded. The outcome of the download
+// is recorded in the statistics of the mirror once the body has been read
+// entirely and closed, or as soon as the mirror fails to send it.
+type Body struct {
+	io.ReadCloser
+	// Size is the size of the beatmap, or -1 if the mirror did not tell it.
+	Size int64
+	// Mirror is the name of the mirror the beatmap is downloaded from.
+	Mirror string
+
+	attempt *attempt
+	reader  *bodyReader
+}
+
+// ReportInvalid records that the beatmap sent by the mirror was not valid, for
+// instance because it was outdated: this counts as a failure of the mirror. It
+// must be called before Close.
+func (b *Body) ReportInvalid(err error) {
+	b.attempt.end(func(a *attempt) { a.pool.recordInvalid(a.m, a.took, err) })
+}
+
+// Failed returns the error with which the mirror stopped sending the beatmap,
+// if it did: the beatmap can then be downloaded from another mirror.
+func (b *Body) Failed() error {
+	return b.attempt.failure()
+}
+
+// Close closes the body. If it has been read entirely, the download counts as
+// a success of the mirror.
+func (b *Body) Close() error {
+	err := b.ReadCloser.Close()
+	if b.reader.complete() {
+		b.attempt.end(func(a *attempt) { a.pool.record(a.m, a.took, nil) })
+	} else {
+		b.attempt.end(func(a *attempt) { a.pool.release(a.m) })
 	}
-	return bytes.Contains(body, []byte(fmt.Sprintf(`href="/d/%dn"`, setID))), nil
+	return err
 }
 
-// Download downloads a beatmap from the osu! website. noVideo specifies whether
-// we should request the beatmap to not have the video.
-func (c *Client) Download(setID int, noVideo bool) (io.ReadCloser, error) {
-	// suffix := ""
-	// if noVideo {
-	// 	suffix = "n"
-	// }
-	return c.getReader(strconv.Itoa(setID))
+// attempt is a request made to a mirror of the pool, whose outcome is recorded
+// once.
+type attempt struct {
+	pool *Pool
+	m    *mirrorState
+	// ctx is the context of the download: once it is cancelled, failures
+	// are not the fault of the mirror.
+	ctx   context.Context
+	start time.Time
+	// took is the time the mirror took to start sending the beatmap.
+	took time.Duration
+
+	once   sync.Once
+	mtx    sync.Mutex
+	failed error
+}
+
+// end records the outcome of the attempt with record, unless it has already
+// been recorded.
+func (a *attempt) end(record func(a *attempt)) {
+	a.once.Do(func() { record(a) })
+}
+
+// fail records that the attempt failed because of err. The mirror is not
+// blamed if the download has been cancelled, and it still works if it does
+// not have the beatmap or the beatmap is too large.
+func (a *attempt) fail(err error) {
+	a.end(func(a *attempt) {
+		switch {
+		case a.ctx.Err() != nil:
+			a.pool.release(a.m)
+		case err == ErrNoRedirect, err == ErrTooLarge:
+			a.pool.record(a.m, a.took, nil)
+		default:
+			a.mtx.Lock()
+			a.failed = err
+			a.mtx.Unlock()
+			a.pool.record(a.m, a.took, err)
+		}
+	})
+}
+
+// failure returns the error the attempt failed with because of the mirror, if
+// any.
+func (a *attempt) failure() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.failed
 }
 
 // ErrNoRedirect is returned from Download when we were not redirect, thus
 // indicating that the beatmap is unavailable.
 var ErrNoRedirect = errors.New("cheesegull/downloader: no redirect happened, beatmap could not be downloaded")
 
-var errNoZip = errors.New("cheesegull/downloader: file is not a zip archive")
+// Errors returned by Download, either directly or when reading the body.
+var (
+	// ErrNotZip is returned when the file sent by the mirror is not a zip
+	// archive.
+	ErrNotZip = errors.New("cheesegull/downloader: file is not a zip archive")
+	// ErrTimeout is returned when a mirror does not answer, or stops sending
+	// data, for longer than the timeouts of the client.
+	ErrTimeout = errors.New("cheesegull/downloader: mirror timed out")
+	// ErrTooLarge is returned when the beatmap is bigger than the maximum
+	// size of the client.
+	ErrTooLarge = errors.New("cheesegull/downloader: beatmap is too large")
+	// ErrNoMirrors is returned when all the mirrors have their circuit open.
+	ErrNoMirrors = errors.New("cheesegull/downloader: no mirror is available")
+)
 
 const zipMagic = "PK\x03\x04"
 
-func (c *Client) getReader(str string) (io.ReadCloser, error) {
-	h := (*http.Client)(c)
-
-	var globalerr error
-	/*
-		Just some information about hosts:
-		Hosts are needed for downloading maps directly from N mirrors.
-		We store our maps already in cache folder, so engine will just send that files, BUT
-		if we lost something, or our additional crawler not working well, that thing exists...
-	*/
-	hosts := []string{
-		fmt.Sprintf("https://%s/d/", downloadHostName) + "%s?novideo=1",
-		"https://storage.ripple.moe/d/%s?novideo=1",
-		"https://txy1.sayobot.cn/beatmaps/download/full/%sn?server=null",
-	}
-
-	for _, host := range hosts {
-		log.Println("[I] Trying download", str, "from", host)
-		resp, err := h.Get(fmt.Sprintf(host, str))
-		if err != nil {
-			log.Println("[I] Download failed", str, "from", host)
-			globalerr = err
-			continue // skip to next host
+func (c *Client) getReader(ctx context.Context, setID int, noVideo bool, except []string) (*Body, error) {
+	var globalerr error = ErrNoMirrors
+	for _, m := range c.Mirrors.candidates() {
+		if !m.serves(noVideo) || contains(except, m.Name) || !c.Mirrors.acquire(m) {
+			continue
 		}
-		if resp.Request.URL.Host == "old.ppy.sh" {
-			resp.Body.Close()
-			globalerr = ErrNoRedirect
-			continue // skip to next host
-		}
-
-		// check that it is a zip file
-		first4 := make([]byte, 4)
-		_, err = resp.Body.Read(first4)
+		log.Println("[I] Trying download", setID, "from", m.Name)
+		a := &attempt{pool: c.Mirrors, m: m, ctx: ctx, start: time.Now()}
+		r, err := c.tryMirror(ctx, a, setID, noVideo)
 		if err != nil {
-			log.Println("[I] Download failed (can't read 4 bytes)", str, "from", host)
+			a.took = time.Since(a.start)
+			a.fail(err)
+		}
+		switch {
+		case ctx.Err() != nil:
+			// nobody wants the beatmap anymore: that's not the fault of the
+			// mirror.
+			if r != nil {
+				r.Close()
+			}
+			return nil, ctx.Err()
+		case err == ErrTooLarge:
+			return nil, err
+		case err != nil:
+			log.Println("[I] Download failed", setID, "from", m.Name+":", err)
 			globalerr = err
-			continue // skip to next host
+			continue // skip to next mirror
 		}
-		if string(first4) != zipMagic {
-			log.Println("[I] Downloaded file doesn't contain zipMagic", str, "from", host)
-			globalerr = errNoZip
-			continue // skip to next host
+
+		log.Println("[I] Download started", setID, "from", m.Name)
+		r.Mirror = m.Name
+		return r, nil
+	}
+
+	// By my logic, it should be called when all is shit
+	return nil, globalerr
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
 		}
+	}
+	return false
+}
+
+// tryMirror requests the set from the mirror of a, and checks that the
+// response is a zip file.
+func (c *Client) tryMirror(ctx context.Context, a *attempt, setID int, noVideo bool) (*Body, error) {
+	m := a.m.Mirror
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := c.request(ctx, m, setID, noVideo)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := newBodyReader(resp.Body, cancel, a, c.opts)
+	if resp.Request.URL.Host == "old.ppy.sh" || (m.Official && resp.StatusCode == http.StatusNotFound) {
+		body.Close()
+		return nil, ErrNoRedirect
+	}
+	err = m.validate(resp)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if c.opts.MaxSize > 0 && resp.ContentLength > c.opts.MaxSize {
+		body.Close()
+		return nil, ErrTooLarge
+	}
+
+	// check that it is a zip file
+	first4 := make([]byte, 4)
+	_, err = io.ReadFull(body, first4)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if string(first4) != zipMagic {
+		body.Close()
+		return nil, ErrNotZip
+	}
+	a.took = time.Since(a.start)
 
-		log.Println("[I] Download complete", str, "from", host)
-		return struct {
+	return &Body{
+		ReadCloser: struct {
 			io.Reader
 			io.Closer
 		}{
-			io.MultiReader(strings.NewReader(zipMagic), resp.Body),
-			resp.Body,
-		}, nil
+			io.MultiReader(bytes.NewReader(first4), body),
+			body,
+		},
+		Size:    resp.ContentLength,
+		attempt: a,
+		reader:  body,
+	}, nil
+}
+
+// request requests the set from m. Requests to the official website are made
+// by c.Official.
+func (c *Client) request(ctx context.Context, m Mirror, setID int, noVideo bool) (*http.Response, error) {
+	if m.Official {
+		if c.Official == nil {
+			return nil, errors.New("cheesegull/downloader: no access to the osu! website")
+		}
+		return c.Official.Download(ctx, setID, noVideo, m.Headers)
 	}
+	return get(ctx, c.http, m.DownloadURL(setID, noVideo), m.Headers)
+}
 
-	// By my logic, it should be called when all is shit
-	return nil, globalerr
+// get requests u with client, adding the given headers.
+func get(ctx context.Context, client *http.Client, u string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	return resp, nil
+}
+
+// timeoutError converts the errors caused by timeouts to ErrTimeout.
+func timeoutError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
+// bodyReader reads the body of a response, cancelling the request when no data
+// arrives for longer than the idle timeout or when more than the maximum size
+// has been read. If reading fails, the attempt fails.
+type bodyReader struct {
+	body     io.ReadCloser
+	cancel   context.CancelFunc
+	attempt  *attempt
+	timer    *time.Timer
+	idle     time.Duration
+	maxSize  int64
+	size     int64
+	mtx      sync.Mutex
+	timedOut bool
+	eof      bool
+}
+
+func newBodyReader(body io.ReadCloser, cancel context.CancelFunc, a *attempt, opts Options) *bodyReader {
+	b := &bodyReader{
+		body:    body,
+		cancel:  cancel,
+		attempt: a,
+		idle:    opts.IdleTimeout,
+		maxSize: opts.MaxSize,
+	}
+	b.timer = time.AfterFunc(b.idle, func() {
+		b.mtx.Lock()
+		b.timedOut = true
+		b.mtx.Unlock()
+		cancel()
+	})
+	return b
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.read(p)
+	switch {
+	case err == io.EOF:
+		b.mtx.Lock()
+		b.eof = true
+		b.mtx.Unlock()
+	case err != nil:
+		b.attempt.fail(err)
+	}
+	return n, err
+}
+
+func (b *bodyReader) read(p []byte) (int, error) {
+	b.timer.Reset(b.idle)
+	n, err := b.body.Read(p)
+	b.size += int64(n)
+	if b.maxSize > 0 && b.size > b.maxSize {
+		return n, ErrTooLarge
+	}
+	if err != nil && err != io.EOF {
+		b.mtx.Lock()
+		timedOut := b.timedOut
+		b.mtx.Unlock()
+		if timedOut {
+			return n, ErrTimeout
+		}
+		return n, timeoutError(err)
+	}
+	return n, err
+}
+
+// complete tells whether the body has been read entirely.
+func (b *bodyReader) complete() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.eof
+}
+
+func (b *bodyReader) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
 }
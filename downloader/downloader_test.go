@@ -1,6 +1,7 @@
 package downloader
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
@@ -18,14 +19,14 @@ var (
 
 func TestLogIn(t *testing.T) {
 	var err error
-	c, err = LogIn(username, password)
+	c, err = LogIn(username, password, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestLogInWrongDetails(t *testing.T) {
-	_, err := LogIn("a", "i")
+	_, err := LogIn("a", "i", Options{})
 	if err == nil {
 		t.Fatal("Unexpected non-error when trying to log in with user 'a' and password 'i'")
 	}
@@ -36,21 +37,21 @@ func TestDownload(t *testing.T) {
 		t.Skip("c is nil")
 	}
 	{
-		vid, err := c.Download(1, false)
+		vid, err := c.Download(context.Background(), 1, false)
 		if err != nil {
 			t.Fatal(err)
 		}
 		md5Test(t, vid, "f40fae62893087e72672b3e6d1468a70")
 	}
 	{
-		vid, err := c.Download(100517, false)
+		vid, err := c.Download(context.Background(), 100517, false)
 		if err != nil {
 			t.Fatal(err)
 		}
 		md5Test(t, vid, "500b361f47ff99551dbb9931cdf39ace")
 	}
 	{
-		novid, err := c.Download(100517, true)
+		novid, err := c.Download(context.Background(), 100517, true)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -0,0 +1,374 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mirror is a host from which beatmaps can be downloaded.
+type Mirror struct {
+	// Name identifies the mirror in the logs and in the stats.
+	Name string `json:"name"`
+	// URL is the template of the URL to download a set from. {id} is
+	// replaced with the ID of the set.
+	URL string `json:"url"`
+	// NoVideoURL is the template of the URL to download a set without its
+	// video from. If it is empty, the mirror is not used to download sets
+	// without video.
+	NoVideoURL string `json:"novideo_url,omitempty"`
+	// Priority decides the order in which mirrors with the same health are
+	// tried. Lower comes first.
+	Priority int `json:"priority"`
+	// Headers are added to every request made to the mirror, for instance
+	// to authenticate.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Official means that the mirror is the osu! website itself: the
+	// request is made through the Official of the client, and URL is
+	// ignored.
+	Official bool `json:"official,omitempty"`
+
+	// ExpectStatus is the status code the mirror answers with when the
+	// download is successful. Defaults to 200.
+	ExpectStatus int `json:"expect_status,omitempty"`
+	// ExpectContentType, if set, is the prefix the Content-Type of a
+	// successful response must have.
+	ExpectContentType string `json:"expect_content_type,omitempty"`
+	// MinSize, if set, is the minimum Content-Length of a successful
+	// response. Responses without a Content-Length are not checked.
+	MinSize int64 `json:"min_size,omitempty"`
+}
+
+// DownloadURL returns the URL to download the set with the given ID from the
+// mirror, with or without its video.
+func (m Mirror) DownloadURL(setID int, noVideo bool) string {
+	u := m.URL
+	if noVideo {
+		u = m.NoVideoURL
+	}
+	return strings.Replace(u, "{id}", strconv.Itoa(setID), -1)
+}
+
+// serves tells whether the mirror can be asked for the given variant of a set.
+func (m Mirror) serves(noVideo bool) bool {
+	return m.Official || !noVideo || m.NoVideoURL != ""
+}
+
+// errInvalidResponse is returned when the response of a mirror does not match
+// what is expected from it.
+var errInvalidResponse = errors.New("cheesegull/downloader: unexpected response from mirror")
+
+// validate checks that resp is what m answers when a download is successful.
+func (m Mirror) validate(resp *http.Response) error {
+	expect := m.ExpectStatus
+	if expect == 0 {
+		expect = http.StatusOK
+	}
+	if resp.StatusCode != expect {
+		return fmt.Errorf("%w: status %d", errInvalidResponse, resp.StatusCode)
+	}
+	if m.ExpectContentType != "" && !strings.HasPrefix(resp.Header.Get("Content-Type"), m.ExpectContentType) {
+		return fmt.Errorf("%w: content type %q", errInvalidResponse, resp.Header.Get("Content-Type"))
+	}
+	if m.MinSize > 0 && resp.ContentLength >= 0 && resp.ContentLength < m.MinSize {
+		return fmt.Errorf("%w: size %d", errInvalidResponse, resp.ContentLength)
+	}
+	return nil
+}
+
+// DefaultMirrors returns the mirrors used when none are configured: the
+// download host, storage.ripple.moe and sayobot, in this order.
+func DefaultMirrors() []Mirror {
+	return []Mirror{
+		{
+			Name:       downloadHostName,
+			URL:        "https://" + downloadHostName + "/d/{id}",
+			NoVideoURL: "https://" + downloadHostName + "/d/{id}?novideo=1",
+			Priority:   0,
+		},
+		{
+			Name:       "ripple",
+			URL:        "https://storage.ripple.moe/d/{id}",
+			NoVideoURL: "https://storage.ripple.moe/d/{id}?novideo=1",
+			Priority:   1,
+		},
+		{
+			Name:       "sayobot",
+			URL:        "https://txy1.sayobot.cn/beatmaps/download/full/{id}?server=null",
+			NoVideoURL: "https://txy1.sayobot.cn/beatmaps/download/novideo/{id}?server=null",
+			Priority:   2,
+		},
+	}
+}
+
+// PoolConfig is the configuration of a Pool, as read by LoadPoolConfig.
+type PoolConfig struct {
+	// FailureThreshold is the number of consecutive failures after which the
+	// circuit of a mirror is opened, and the mirror is not used anymore
+	// until Cooldown has passed. Defaults to 5.
+	FailureThreshold int `json:"failure_threshold"`
+	// Cooldown is the number of seconds after which a mirror with an open
+	// circuit is tried again with a single request. Defaults to 60.
+	Cooldown int `json:"cooldown"`
+	// Mirrors defaults to DefaultMirrors.
+	Mirrors []Mirror `json:"mirrors"`
+}
+
+// LoadPoolConfig reads the configuration of a Pool from the JSON file at the
+// given path.
+func LoadPoolConfig(path string) (PoolConfig, error) {
+	var cfg PoolConfig
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, m := range cfg.Mirrors {
+		if m.Name == "" || (!m.Official && !strings.Contains(m.URL, "{id}")) {
+			return cfg, fmt.Errorf("%s: mirrors must have a name and, unless official, an URL containing {id}", path)
+		}
+		if m.NoVideoURL != "" && !strings.Contains(m.NoVideoURL, "{id}") {
+			return cfg, fmt.Errorf("%s: mirror %s: novideo_url must contain {id}", path, m.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// Circuit states of a mirror.
+const (
+	// CircuitClosed means the mirror is working and used normally.
+	CircuitClosed = "closed"
+	// CircuitOpen means the mirror has failed too many times in a row, and it
+	// is not used until the cooldown has passed.
+	CircuitOpen = "open"
+	// CircuitHalfOpen means the cooldown has passed and a single request is
+	// being made to the mirror to know whether it is working again.
+	CircuitHalfOpen = "half-open"
+)
+
+// latencyWeight is the weight of the latest request in the moving average of
+// the latency of a mirror.
+const latencyWeight = 0.3
+
+type mirrorState struct {
+	Mirror
+
+	mtx                 sync.Mutex
+	requests            int
+	successes           int
+	failures            int
+	invalid             int
+	consecutiveFailures int
+	latency             time.Duration
+	lastError           string
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	circuit             string
+	openedAt            time.Time
+}
+
+// score is the health of the mirror, from 0 to 1. It is the success rate,
+// starting from 1/2 for mirrors which have never been used, penalised by the
+// average latency.
+func (m *mirrorState) score() float64 {
+	rate := float64(m.successes+1) / float64(m.successes+m.failures+2)
+	return rate / (1 + m.latency.Seconds()/10)
+}
+
+// MirrorStats are the statistics about a mirror of a Pool.
+type MirrorStats struct {
+	Name                string    `json:"name"`
+	Priority            int       `json:"priority"`
+	Circuit             string    `json:"circuit"`
+	Score               float64   `json:"score"`
+	Requests            int       `json:"requests"`
+	Successes           int       `json:"successes"`
+	Failures            int       `json:"failures"`
+	Invalid             int       `json:"invalid"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	SuccessRate         float64   `json:"success_rate"`
+	LatencyMS           int64     `json:"latency_ms"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	RetryAt             time.Time `json:"retry_at"`
+}
+
+// Pool is a set of mirrors, which keeps track of their health so that
+// downloads are attempted from the healthiest mirrors first, and mirrors which
+// keep failing are left alone for a while.
+type Pool struct {
+	failureThreshold int
+	cooldown         time.Duration
+	mirrors          []*mirrorState
+	now              func() time.Time
+}
+
+// NewPool creates a new Pool from its configuration.
+func NewPool(cfg PoolConfig) *Pool {
+	p := &Pool{
+		failureThreshold: cfg.FailureThreshold,
+		cooldown:         time.Duration(cfg.Cooldown) * time.Second,
+		now:              time.Now,
+	}
+	if p.failureThreshold <= 0 {
+		p.failureThreshold = 5
+	}
+	if p.cooldown <= 0 {
+		p.cooldown = time.Minute
+	}
+	mirrors := cfg.Mirrors
+	if len(mirrors) == 0 {
+		mirrors = DefaultMirrors()
+	}
+	for _, m := range mirrors {
+		p.mirrors = append(p.mirrors, &mirrorState{Mirror: m, circuit: CircuitClosed})
+	}
+	return p
+}
+
+// candidates returns the mirrors that can currently be used, healthiest first.
+// Mirrors with an open circuit are returned only when their cooldown has
+// passed and nobody else is probing them.
+func (p *Pool) candidates() []*mirrorState {
+	type candidate struct {
+		m     *mirrorState
+		score float64
+	}
+	now := p.now()
+	cs := make([]candidate, 0, len(p.mirrors))
+	for _, m := range p.mirrors {
+		m.mtx.Lock()
+		if m.circuit == CircuitClosed || (m.circuit == CircuitOpen && now.Sub(m.openedAt) >= p.cooldown) {
+			cs = append(cs, candidate{m, m.score()})
+		}
+		m.mtx.Unlock()
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		if cs[i].score != cs[j].score {
+			return cs[i].score > cs[j].score
+		}
+		return cs[i].m.Priority < cs[j].m.Priority
+	})
+	ms := make([]*mirrorState, len(cs))
+	for i, c := range cs {
+		ms[i] = c.m
+	}
+	return ms
+}
+
+// acquire reports whether a request can be made to m. If m's circuit is open
+// and the cooldown has passed, the circuit becomes half-open and this request
+// is the only one allowed until it completes.
+func (p *Pool) acquire(m *mirrorState) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	switch m.circuit {
+	case CircuitClosed:
+		return true
+	case CircuitOpen:
+		if p.now().Sub(m.openedAt) < p.cooldown {
+			return false
+		}
+		m.circuit = CircuitHalfOpen
+		return true
+	default:
+		return false
+	}
+}
+
+// record saves the outcome of a request made to m, which took the given time.
+// A nil err means that the mirror worked, even though it may not have had the
+// beatmap.
+func (p *Pool) record(m *mirrorState, took time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := p.now()
+	m.requests++
+	if err == nil {
+		if m.latency == 0 {
+			m.latency = took
+		} else {
+			m.latency = time.Duration(latencyWeight*float64(took) + (1-latencyWeight)*float64(m.latency))
+		}
+		m.successes++
+		m.consecutiveFailures = 0
+		m.lastSuccess = now
+		m.circuit = CircuitClosed
+		return
+	}
+
+	m.failures++
+	m.consecutiveFailures++
+	m.lastFailure = now
+	m.lastError = err.Error()
+	if m.circuit == CircuitHalfOpen || m.consecutiveFailures >= p.failureThreshold {
+		m.circuit = CircuitOpen
+		m.openedAt = now
+	}
+}
+
+// recordInvalid records that m sent an invalid beatmap, as a failure.
+func (p *Pool) recordInvalid(m *mirrorState, took time.Duration, err error) {
+	m.mtx.Lock()
+	m.invalid++
+	m.mtx.Unlock()
+	p.record(m, took, err)
+}
+
+// release gives up a request made to m without recording its outcome, for
+// instance because nobody wants the beatmap anymore. If the request was
+// probing m, another one can probe it right away.
+func (p *Pool) release(m *mirrorState) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.circuit == CircuitHalfOpen {
+		m.circuit = CircuitOpen
+	}
+}
+
+// Stats returns the statistics of all the mirrors in the pool, in the order
+// they were configured.
+func (p *Pool) Stats() []MirrorStats {
+	stats := make([]MirrorStats, len(p.mirrors))
+	for i, m := range p.mirrors {
+		m.mtx.Lock()
+		s := MirrorStats{
+			Name:                m.Name,
+			Priority:            m.Priority,
+			Circuit:             m.circuit,
+			Score:               m.score(),
+			Requests:            m.requests,
+			Successes:           m.successes,
+			Failures:            m.failures,
+			Invalid:             m.invalid,
+			ConsecutiveFailures: m.consecutiveFailures,
+			LatencyMS:           int64(m.latency / time.Millisecond),
+			LastError:           m.lastError,
+			LastSuccess:         m.lastSuccess,
+			LastFailure:         m.lastFailure,
+		}
+		if m.requests > 0 {
+			s.SuccessRate = float64(m.successes) / float64(m.requests)
+		}
+		if m.circuit == CircuitOpen {
+			s.RetryAt = m.openedAt.Add(p.cooldown)
+		}
+		m.mtx.Unlock()
+		stats[i] = s
+	}
+	return stats
+}
@@ -0,0 +1,393 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testZip = zipMagic + "the rest of the beatmap"
+
+// testMirror starts a server answering with the given status and body, and
+// counting the requests it receives in hits.
+func testMirror(t *testing.T, status int, body string, hits *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testClient(cfg PoolConfig) *Client {
+	var opts Options
+	opts.setDefaults()
+	return &Client{
+		http:    newHTTPClient(opts),
+		opts:    opts,
+		Mirrors: NewPool(cfg),
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	var badHits, goodHits int32
+	bad := testMirror(t, 500, "", &badHits)
+	good := testMirror(t, 200, testZip, &goodHits)
+	c := testClient(PoolConfig{Mirrors: []Mirror{
+		{Name: "bad", URL: bad.URL + "/d/{id}", Priority: 0},
+		{Name: "good", URL: good.URL + "/d/{id}", Priority: 1},
+	}})
+
+	r, err := c.Download(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testZip {
+		t.Fatalf("want %q got %q", testZip, data)
+	}
+
+	stats := c.Mirrors.Stats()
+	if stats[0].Failures != 1 || stats[1].Successes != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the good mirror is now the healthiest, so it is tried first
+	_, err = c.Download(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if badHits != 1 || goodHits != 2 {
+		t.Fatalf("want 1 request to bad and 2 to good, got %d and %d", badHits, goodHits)
+	}
+}
+
+func TestPoolCircuitBreaking(t *testing.T) {
+	var hits int32
+	status := int32(500)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(testZip))
+	}))
+	defer srv.Close()
+
+	c := testClient(PoolConfig{
+		FailureThreshold: 2,
+		Cooldown:         60,
+		Mirrors:          []Mirror{{Name: "flaky", URL: srv.URL + "/d/{id}"}},
+	})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Mirrors.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Download(context.Background(), 1, false)
+		if err == nil {
+			t.Fatal("want error from failing mirror")
+		}
+	}
+	if hits != 2 {
+		t.Fatalf("want 2 requests before the circuit opens, got %d", hits)
+	}
+	if s := c.Mirrors.Stats()[0]; s.Circuit != CircuitOpen || !s.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// after the cooldown a probe is made, and it fails again
+	now = now.Add(time.Minute)
+	c.Download(context.Background(), 1, false)
+	if hits != 3 || c.Mirrors.Stats()[0].Circuit != CircuitOpen {
+		t.Fatalf("want failed probe to open the circuit again, got %d hits and %+v", hits, c.Mirrors.Stats()[0])
+	}
+
+	// the mirror is fixed: the probe closes the circuit
+	atomic.StoreInt32(&status, 200)
+	now = now.Add(time.Minute)
+	r, err := c.Download(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+	if s := c.Mirrors.Stats()[0]; s.Circuit != CircuitClosed || s.ConsecutiveFailures != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestPoolHalfOpenSingleProbe(t *testing.T) {
+	p := NewPool(PoolConfig{
+		FailureThreshold: 1,
+		Mirrors:          []Mirror{{Name: "a", URL: "{id}"}},
+	})
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	m := p.mirrors[0]
+
+	p.record(m, 0, ErrNotZip)
+	if p.acquire(m) {
+		t.Fatal("mirror with open circuit acquired")
+	}
+	now = now.Add(p.cooldown)
+	if len(p.candidates()) != 1 || !p.acquire(m) {
+		t.Fatal("mirror can't be probed after cooldown")
+	}
+	if len(p.candidates()) != 0 || p.acquire(m) {
+		t.Fatal("mirror acquired twice while half-open")
+	}
+}
+
+func TestMirrorValidate(t *testing.T) {
+	var hits int32
+	srv := testMirror(t, 200, testZip, &hits)
+	tt := []struct {
+		m  Mirror
+		ok bool
+	}{
+		{Mirror{}, true},
+		{Mirror{ExpectStatus: 302}, false},
+		{Mirror{ExpectContentType: "application/octet-stream"}, true},
+		{Mirror{ExpectContentType: "text/html"}, false},
+		{Mirror{MinSize: 10}, true},
+		{Mirror{MinSize: 10000}, false},
+	}
+	for _, tc := range tt {
+		tc.m.Name = "test"
+		tc.m.URL = srv.URL + "/d/{id}"
+		c := testClient(PoolConfig{Mirrors: []Mirror{tc.m}})
+		r, err := c.Download(context.Background(), 1, false)
+		if (err == nil) != tc.ok {
+			t.Errorf("%+v: want ok %v got error %v", tc.m, tc.ok, err)
+		}
+		if r != nil {
+			r.Close()
+		}
+	}
+}
+
+func TestDownloadIdleTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testZip))
+		w.(http.Flusher).Flush()
+		// stall until the client gives up
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := testClient(PoolConfig{Mirrors: []Mirror{{Name: "stalled", URL: srv.URL + "/d/{id}"}}})
+	c.opts.IdleTimeout = 50 * time.Millisecond
+	r, err := c.Download(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("want ErrTimeout got %v", err)
+	}
+	// the mirror stalling counts as a failure, and another mirror may
+	// still send the beatmap.
+	if s := c.Mirrors.Stats()[0]; s.Failures != 1 || s.Successes != 0 || !errors.Is(r.Failed(), ErrTimeout) {
+		t.Fatalf("stalled download not counted as failure: %+v", s)
+	}
+}
+
+func TestDownloadTooLarge(t *testing.T) {
+	var hits int32
+	srv := testMirror(t, 200, testZip, &hits)
+	c := testClient(PoolConfig{Mirrors: []Mirror{{Name: "test", URL: srv.URL + "/d/{id}"}}})
+	c.opts.MaxSize = 10
+
+	_, err := c.Download(context.Background(), 1, false)
+	if err != ErrTooLarge {
+		t.Fatalf("want ErrTooLarge got %v", err)
+	}
+	if s := c.Mirrors.Stats()[0]; s.Failures != 0 {
+		t.Fatalf("too large beatmap counted as failure of the mirror: %+v", s)
+	}
+
+	// without a Content-Length, the limit is applied while reading
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(zipMagic))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("the rest of the beatmap"))
+	}))
+	defer chunked.Close()
+	c = testClient(PoolConfig{Mirrors: []Mirror{{Name: "chunked", URL: chunked.URL + "/d/{id}"}}})
+	c.opts.MaxSize = 10
+	r, err := c.Download(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	if err != ErrTooLarge {
+		t.Fatalf("want ErrTooLarge got %v", err)
+	}
+}
+
+func TestDownloadCanceled(t *testing.T) {
+	var hits int32
+	srv := testMirror(t, 200, testZip, &hits)
+	c := testClient(PoolConfig{Mirrors: []Mirror{{Name: "test", URL: srv.URL + "/d/{id}"}}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Download(ctx, 1, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled got %v", err)
+	}
+	if s := c.Mirrors.Stats()[0]; s.Failures != 0 {
+		t.Fatalf("canceled download counted as failure of the mirror: %+v", s)
+	}
+}
+
+func TestDownloadVariant(t *testing.T) {
+	var paths []string
+	var mtx sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		paths = append(paths, r.URL.String())
+		mtx.Unlock()
+		w.Write([]byte(testZip))
+	}))
+	defer srv.Close()
+	c := testClient(PoolConfig{Mirrors: []Mirror{
+		{Name: "full only", URL: srv.URL + "/full/{id}", Priority: 0},
+		{Name: "both", URL: srv.URL + "/d/{id}", NoVideoURL: srv.URL + "/d/{id}?novideo=1", Priority: 1},
+	}})
+
+	for _, noVideo := range []bool{false, true} {
+		r, err := c.Download(context.Background(), 1, noVideo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(r)
+		r.Close()
+	}
+	// the set without video is not requested from the mirror which can't
+	// serve it.
+	want := []string{"/full/1", "/d/1?novideo=1"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("want requests %v got %v", want, paths)
+	}
+
+	c = testClient(PoolConfig{Mirrors: []Mirror{{Name: "full only", URL: srv.URL + "/full/{id}"}}})
+	if _, err := c.Download(context.Background(), 1, true); err != ErrNoMirrors {
+		t.Fatalf("want ErrNoMirrors got %v", err)
+	}
+}
+
+func TestDownloadExceptInvalid(t *testing.T) {
+	var firstHits, secondHits int32
+	first := testMirror(t, 200, testZip, &firstHits)
+	second := testMirror(t, 200, testZip, &secondHits)
+	c := testClient(PoolConfig{Mirrors: []Mirror{
+		{Name: "first", URL: first.URL + "/d/{id}", Priority: 0},
+		{Name: "second", URL: second.URL + "/d/{id}", Priority: 1},
+	}})
+
+	r, err := c.Download(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(r)
+	if r.Mirror != "first" {
+		t.Fatalf("want download from first got %s", r.Mirror)
+	}
+	r.ReportInvalid(errors.New("outdated beatmap"))
+	r.Close()
+
+	r, err = c.Download(context.Background(), 1, false, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if r.Mirror != "second" || firstHits != 1 {
+		t.Fatalf("want download from second got %s (%d requests to first)", r.Mirror, firstHits)
+	}
+
+	stats := c.Mirrors.Stats()
+	if stats[0].Invalid != 1 || stats[0].Failures != 1 || stats[0].Successes != 0 || stats[0].LastError != "outdated beatmap" {
+		t.Fatalf("invalid beatmap not recorded: %+v", stats[0])
+	}
+}
+
+func TestPoolInvalidBeatmaps(t *testing.T) {
+	var hits int32
+	srv := testMirror(t, 200, testZip, &hits)
+	c := testClient(PoolConfig{
+		FailureThreshold: 3,
+		Mirrors:          []Mirror{{Name: "corrupt", URL: srv.URL + "/d/{id}"}},
+	})
+
+	for i := 0; i < 3; i++ {
+		r, err := c.Download(context.Background(), 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(r)
+		r.ReportInvalid(errors.New("corrupt zip"))
+		r.Close()
+	}
+	s := c.Mirrors.Stats()[0]
+	if s.Circuit != CircuitOpen || s.ConsecutiveFailures != 3 || s.Invalid != 3 || s.Successes != 0 {
+		t.Fatalf("want the circuit opened by invalid beatmaps, got %+v", s)
+	}
+	if _, err := c.Download(context.Background(), 1, false); err != ErrNoMirrors {
+		t.Fatalf("want ErrNoMirrors got %v", err)
+	}
+}
+
+func TestPoolCanceledProbe(t *testing.T) {
+	var hits int32
+	srv := testMirror(t, 200, testZip, &hits)
+	c := testClient(PoolConfig{
+		FailureThreshold: 1,
+		Mirrors:          []Mirror{{Name: "test", URL: srv.URL + "/d/{id}"}},
+	})
+	now := time.Now()
+	c.Mirrors.now = func() time.Time { return now }
+	m := c.Mirrors.mirrors[0]
+	c.Mirrors.record(m, 0, ErrNotZip)
+	now = now.Add(c.Mirrors.cooldown)
+
+	// the probe is abandoned: it neither closes the circuit nor prevents
+	// another probe.
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := c.Download(ctx, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	r.Close()
+	if s := c.Mirrors.Stats()[0]; s.Circuit != CircuitOpen || s.Requests != 1 {
+		t.Fatalf("canceled probe recorded: %+v", s)
+	}
+	r, err = c.Download(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+	if s := c.Mirrors.Stats()[0]; s.Circuit != CircuitClosed {
+		t.Fatalf("want the circuit closed by the probe, got %+v", s)
+	}
+}
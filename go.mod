@@ -10,5 +10,7 @@ require (
 	github.com/getsentry/raven-go v0.0.0-20170918144728-1452f6376ddb
 	github.com/go-sql-driver/mysql v1.3.0
 	github.com/julienschmidt/httprouter v1.1.0
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/thehowl/go-osuapi v0.0.0-20171004075559-b918f5da7258
 )
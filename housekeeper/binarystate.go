@@ -1,12 +1,59 @@
 package housekeeper
 
 import (
+	"bufio"
 	"encoding"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 )
 
-const cachedBeatmapBinSize = 8 + 1 + 15 + 15 + 8
+// The state is saved in the CGBIN002 format:
+//
+//	"CGBIN002"
+//	records, each made of:
+//		uint32 length of the payload (big endian)
+//		payload
+//		uint32 CRC-32 (IEEE) of the payload (big endian)
+//	an empty record (length 0), marking the end of the file
+//
+// The payload of a record is a sequence of fields, each made of a tag byte,
+// the length of the value as an uvarint, and the value. Readers skip the
+// fields they don't know, so new fields can be added without changing the
+// version.
+//
+// CGBIN001 files, made of fixed size records without checksums, are still
+// read, and written again as CGBIN002 at the next save.
+const (
+	stateMagicV1 = "CGBIN001"
+	stateMagicV2 = "CGBIN002"
+)
+
+// Tags of the fields of a CGBIN002 record.
+const (
+	fieldID            = 1  // uvarint
+	fieldNoVideo       = 2  // 1 byte
+	fieldLastUpdate    = 3  // time.Time binary
+	fieldLastRequested = 4  // time.Time binary
+	fieldFileSize      = 5  // uvarint
+	fieldDataFolder    = 6  // string, once per data folder
+	fieldFolder        = 7  // string, the data folder holding the file
+	fieldRankedStatus  = 8  // varint
+	fieldRequests      = 9  // float64 bits, big endian
+	fieldVerified      = 10 // time.Time binary
+	fieldHash          = 11 // 32 bytes, the SHA-256 naming the file
+)
+
+// maxRecordSize is the size above which a record is taken as corrupted.
+const maxRecordSize = 1 << 20
+
+// errCorruptState is returned, wrapped, by readBeatmaps when some records
+// could not be read. The records which could be read are returned as well.
+var errCorruptState = errors.New("cheesegull/housekeeper: corrupt state file")
 
 func b2i(b bool) byte {
 	if b {
@@ -15,99 +62,242 @@ func b2i(b bool) byte {
 	return 0
 }
 
-func marshalBinaryCopy(dst []byte, t encoding.BinaryMarshaler) {
-	b, _ := t.MarshalBinary()
-	copy(dst, b)
+// recordWriter encodes the fields of a record.
+type recordWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *recordWriter) bytes(tag byte, v []byte) {
+	w.buf = append(w.buf, tag)
+	n := binary.PutUvarint(w.tmp[:], uint64(len(v)))
+	w.buf = append(w.buf, w.tmp[:n]...)
+	w.buf = append(w.buf, v...)
 }
 
-// copied from binary.BigEndian
-func putUint64(b []byte, v uint64) {
-	_ = b[7] // boundary check
-	b[0] = byte(v >> 56)
-	b[1] = byte(v >> 48)
-	b[2] = byte(v >> 40)
-	b[3] = byte(v >> 32)
-	b[4] = byte(v >> 24)
-	b[5] = byte(v >> 16)
-	b[6] = byte(v >> 8)
-	b[7] = byte(v)
+func (w *recordWriter) uvarint(tag byte, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.bytes(tag, b[:n])
+}
+
+func (w *recordWriter) varint(tag byte, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	w.bytes(tag, b[:n])
+}
+
+func (w *recordWriter) binary(tag byte, v encoding.BinaryMarshaler) {
+	b, _ := v.MarshalBinary()
+	w.bytes(tag, b)
+}
+
+// encodeBeatmap encodes the payload of the record of b.
+func encodeBeatmap(b *CachedBeatmap) []byte {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	w := &recordWriter{}
+	w.uvarint(fieldID, uint64(b.ID))
+	w.bytes(fieldNoVideo, []byte{b2i(b.NoVideo)})
+	w.binary(fieldLastUpdate, b.LastUpdate)
+	w.binary(fieldLastRequested, b.lastRequested)
+	w.uvarint(fieldFileSize, b.fileSize)
+	for _, f := range b.DataFolders {
+		w.bytes(fieldDataFolder, []byte(f))
+	}
+	if b.folder != "" {
+		w.bytes(fieldFolder, []byte(b.folder))
+	}
+	w.varint(fieldRankedStatus, int64(b.RankedStatus))
+	var requests [8]byte
+	binary.BigEndian.PutUint64(requests[:], math.Float64bits(b.requests))
+	w.bytes(fieldRequests, requests[:])
+	if !b.verified.IsZero() {
+		w.binary(fieldVerified, b.verified)
+	}
+	if sum, err := hex.DecodeString(b.hash); err == nil && len(sum) == 32 {
+		w.bytes(fieldHash, sum)
+	}
+	return w.buf
 }
 
 func writeBeatmaps(w io.Writer, c []*CachedBeatmap) error {
-	_, err := w.Write(append([]byte("CGBIN001"), cachedBeatmapBinSize))
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString(stateMagicV2)
 	if err != nil {
 		return err
 	}
+	var header [4]byte
 	for _, b := range c {
-		if b == nil || !b.isDownloaded {
+		if b == nil || !b.IsDownloaded() {
 			continue
 		}
-		enc := make([]byte, cachedBeatmapBinSize)
-		putUint64(enc[:8], uint64(b.ID))
-		enc[8] = b2i(b.NoVideo)
-		marshalBinaryCopy(enc[9:24], b.LastUpdate)
-		marshalBinaryCopy(enc[24:39], b.lastRequested)
-		putUint64(enc[39:47], b.fileSize)
-		_, err := w.Write(enc)
+		payload := encodeBeatmap(b)
+		binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+		bw.Write(header[:])
+		bw.Write(payload)
+		binary.BigEndian.PutUint32(header[:], crc32.ChecksumIEEE(payload))
+		_, err = bw.Write(header[:])
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	// end of the file
+	binary.BigEndian.PutUint32(header[:], 0)
+	bw.Write(header[:])
+	return bw.Flush()
 }
 
-// copied from binary.BigEndian
-func readUint64(b []byte) uint64 {
-	_ = b[7] // bounds check hint to compiler; see golang.org/issue/14808
-	return uint64(b[7]) | uint64(b[6])<<8 | uint64(b[5])<<16 | uint64(b[4])<<24 |
-		uint64(b[3])<<32 | uint64(b[2])<<40 | uint64(b[1])<<48 | uint64(b[0])<<56
-
-}
+// decodeBeatmap decodes the payload of a record.
+func decodeBeatmap(payload []byte) (*CachedBeatmap, error) {
+	m := &CachedBeatmap{isDownloaded: true}
+	for len(payload) > 0 {
+		tag := payload[0]
+		length, n := binary.Uvarint(payload[1:])
+		if n <= 0 || uint64(len(payload)-1-n) < length {
+			return nil, errors.New("malformed field")
+		}
+		v := payload[1+n : 1+n+int(length)]
+		payload = payload[1+n+int(length):]
 
-func readCachedBeatmap(b []byte) *CachedBeatmap {
-	m := &CachedBeatmap{}
-	m.ID = int(readUint64(b[:8]))
-	m.NoVideo = b[8] == 1
-	(&m.LastUpdate).UnmarshalBinary(b[9:24])
-	(&m.lastRequested).UnmarshalBinary(b[24:39])
-	m.fileSize = readUint64(b[39:47])
-	m.isDownloaded = true
-	return m
+		var err error
+		switch tag {
+		case fieldID:
+			id, _ := binary.Uvarint(v)
+			m.ID = int(id)
+		case fieldNoVideo:
+			m.NoVideo = len(v) == 1 && v[0] == 1
+		case fieldLastUpdate:
+			err = m.LastUpdate.UnmarshalBinary(v)
+		case fieldLastRequested:
+			err = m.lastRequested.UnmarshalBinary(v)
+		case fieldFileSize:
+			m.fileSize, _ = binary.Uvarint(v)
+		case fieldDataFolder:
+			m.DataFolders = append(m.DataFolders, string(v))
+		case fieldFolder:
+			m.folder = string(v)
+		case fieldRankedStatus:
+			status, _ := binary.Varint(v)
+			m.RankedStatus = int(status)
+		case fieldRequests:
+			if len(v) == 8 {
+				m.requests = math.Float64frombits(binary.BigEndian.Uint64(v))
+			}
+		case fieldVerified:
+			err = m.verified.UnmarshalBinary(v)
+		case fieldHash:
+			if len(v) == 32 {
+				m.hash = hex.EncodeToString(v)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
+// readBeatmaps reads a state file. The records which are corrupted are
+// skipped, and reported with an errCorruptState, along with the beatmaps which
+// could be read.
 func readBeatmaps(r io.Reader) ([]*CachedBeatmap, error) {
-	b := make([]byte, 8)
-	_, err := r.Read(b)
+	br := bufio.NewReader(r)
+	magic := make([]byte, 8)
+	_, err := io.ReadFull(br, magic)
 	if err != nil {
 		return nil, err
 	}
-	if string(b) != "CGBIN001" {
+	switch string(magic) {
+	case stateMagicV1:
+		return readBeatmapsV1(br)
+	case stateMagicV2:
+	default:
 		return nil, errors.New("cheesegull/housekeeper: unknown cgbin version")
 	}
 
-	b = make([]byte, 1)
-	_, err = r.Read(b)
+	beatmaps := make([]*CachedBeatmap, 0, 50)
+	corrupt := 0
+	var header [4]byte
+	for {
+		_, err = io.ReadFull(br, header[:])
+		if err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length == 0 {
+			// end of the file
+			break
+		}
+		if length > maxRecordSize {
+			err = errors.New("record too large")
+			break
+		}
+		payload := make([]byte, length+4)
+		_, err = io.ReadFull(br, payload)
+		if err != nil {
+			break
+		}
+		payload, sum := payload[:length], binary.BigEndian.Uint32(payload[length:])
+		if crc32.ChecksumIEEE(payload) != sum {
+			corrupt++
+			continue
+		}
+		b, decodeErr := decodeBeatmap(payload)
+		if decodeErr != nil {
+			corrupt++
+			continue
+		}
+		beatmaps = append(beatmaps, b)
+	}
+
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return beatmaps, fmt.Errorf("%w: truncated after %d beatmaps", errCorruptState, len(beatmaps))
+	case err != nil:
+		return beatmaps, fmt.Errorf("%w: %v", errCorruptState, err)
+	case corrupt > 0:
+		return beatmaps, fmt.Errorf("%w: %d corrupted beatmaps skipped", errCorruptState, corrupt)
+	}
+	return beatmaps, nil
+}
+
+// readBeatmapsV1 reads the records of a CGBIN001 file, after the magic.
+func readBeatmapsV1(r io.Reader) ([]*CachedBeatmap, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
 	if err != nil {
 		return nil, err
 	}
 
-	bmLength := b[0]
-	if bmLength == 0 {
+	bmLength := int(b[0])
+	if bmLength < 47 {
 		return nil, nil
 	}
 	b = make([]byte, bmLength)
 	beatmaps := make([]*CachedBeatmap, 0, 50)
 
 	for {
-		read, err := r.Read(b)
+		_, err := io.ReadFull(r, b)
 		switch {
 		case err == io.EOF:
 			return beatmaps, nil
+		case err == io.ErrUnexpectedEOF:
+			return beatmaps, fmt.Errorf("%w: truncated after %d beatmaps", errCorruptState, len(beatmaps))
 		case err != nil:
 			return nil, err
-		case byte(read) != bmLength:
-			return beatmaps, nil
 		}
-		beatmaps = append(beatmaps, readCachedBeatmap(b))
+		beatmaps = append(beatmaps, readCachedBeatmapV1(b))
 	}
 }
+
+func readCachedBeatmapV1(b []byte) *CachedBeatmap {
+	m := &CachedBeatmap{}
+	m.ID = int(binary.BigEndian.Uint64(b[:8]))
+	m.NoVideo = b[8] == 1
+	(&m.LastUpdate).UnmarshalBinary(b[9:24])
+	(&m.lastRequested).UnmarshalBinary(b[24:39])
+	m.fileSize = binary.BigEndian.Uint64(b[39:47])
+	m.isDownloaded = true
+	return m
+}
@@ -2,7 +2,12 @@ package housekeeper
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -55,6 +60,123 @@ func TestEncodeDecode(t *testing.T) {
 	}
 }
 
+// sameBeatmaps tells whether a and b hold the same beatmaps, regardless of
+// their order and of their place in a state.
+func sameBeatmaps(a, b []*CachedBeatmap) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int, len(a))
+	for i := range a {
+		count[string(encodeBeatmap(a[i]))]++
+		count[string(encodeBeatmap(b[i]))]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeBeatmapsV1 writes the beatmaps in the CGBIN001 format.
+func writeBeatmapsV1(c []*CachedBeatmap) []byte {
+	const size = 8 + 1 + 15 + 15 + 8
+	buf := append([]byte(stateMagicV1), size)
+	for _, b := range c {
+		enc := make([]byte, size)
+		binary.BigEndian.PutUint64(enc[:8], uint64(b.ID))
+		enc[8] = b2i(b.NoVideo)
+		lu, _ := b.LastUpdate.MarshalBinary()
+		copy(enc[9:24], lu)
+		lr, _ := b.lastRequested.MarshalBinary()
+		copy(enc[24:39], lr)
+		binary.BigEndian.PutUint64(enc[39:47], b.fileSize)
+		buf = append(buf, enc...)
+	}
+	return buf
+}
+
+func TestMigrateV1(t *testing.T) {
+	h := testHouse(t)
+	if err := ioutil.WriteFile(h.StateFile, writeBeatmapsV1(testBeatmaps), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.DataFolders = []string{"/data/"}
+	if err := h.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if !sameBeatmaps(h.Beatmaps(), testBeatmaps) {
+		t.Fatalf("original %v read %v", testBeatmaps, h.Beatmaps())
+	}
+
+	// the state is saved in the new format
+	if err := h.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(h.StateFile)
+	if err != nil || string(data[:8]) != stateMagicV2 {
+		t.Fatalf("state not saved as %s: %q (%v)", stateMagicV2, data[:8], err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(h.StateFile))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			t.Fatalf("temporary file %s left behind", f.Name())
+		}
+	}
+	h.setState(nil)
+	if err := h.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if !sameBeatmaps(h.Beatmaps(), testBeatmaps) {
+		t.Fatalf("original %v read %v", testBeatmaps, h.Beatmaps())
+	}
+}
+
+func TestCorruptState(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeBeatmaps(buf, testBeatmaps); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// damage the second record: the others are still read
+	corrupted := append([]byte(nil), data...)
+	first := binary.BigEndian.Uint32(corrupted[8:])
+	corrupted[8+4+first+4+4+2] ^= 0xff
+	read, err := readBeatmaps(bytes.NewReader(corrupted))
+	if !errors.Is(err, errCorruptState) {
+		t.Fatalf("want errCorruptState got %v", err)
+	}
+	want := []*CachedBeatmap{testBeatmaps[0], testBeatmaps[2], testBeatmaps[3]}
+	if !reflect.DeepEqual(read, want) {
+		t.Fatalf("want %v got %v", want, read)
+	}
+
+	// a truncated file is detected
+	read, err = readBeatmaps(bytes.NewReader(data[:len(data)-10]))
+	if !errors.Is(err, errCorruptState) {
+		t.Fatalf("want errCorruptState got %v", err)
+	}
+	if !reflect.DeepEqual(read, testBeatmaps[:3]) {
+		t.Fatalf("want %v got %v", testBeatmaps[:3], read)
+	}
+}
+
+func TestUnknownFieldsSkipped(t *testing.T) {
+	w := &recordWriter{}
+	w.uvarint(fieldID, 42)
+	w.bytes(200, []byte("field of a newer version"))
+	w.uvarint(fieldFileSize, 1000)
+	b, err := decodeBeatmap(w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != 42 || b.fileSize != 1000 {
+		t.Fatalf("unexpected beatmap %v", b)
+	}
+}
+
 func BenchmarkWriteBinaryState(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		writeBeatmaps(fakeWriter{}, testBeatmaps)
@@ -0,0 +1,254 @@
+package housekeeper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// The files of the beatmaps are named after the SHA-256 of their content, so
+// that identical files, such as a set uploaded again without changes, or the
+// beatmap without video of a set whose video was removed, are stored once per
+// folder. The beatmaps whose files have the same content reference the same
+// file, whose size the index counts once, and which is only removed with the
+// last of them. The files written by older versions keep their <id>.osz name
+// until Scrub hashes them. Rescan finds the beatmap of the files which are not
+// in the state from their content.
+
+// contents protects the files named after their content while beatmaps start
+// referencing them, so that they are not removed meanwhile by release.
+type contents struct {
+	mtx sync.Mutex
+	// holds are the number of holds on every file, by path.
+	holds map[string]int
+}
+
+// Hash returns the SHA-256 of the file of the beatmap, in hexadecimal, or ""
+// if it is not known.
+func (c *CachedBeatmap) Hash() string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.hash
+}
+
+// name returns the name of the file of the beatmap in its folder: the name of
+// its content if it is known, FileName otherwise. It must be called with c.mtx
+// held.
+func (c *CachedBeatmap) name() string {
+	if c.hash != "" {
+		return contentName(c.hash)
+	}
+	return c.FileName()
+}
+
+// storedName is like name, but locks c.mtx.
+func (c *CachedBeatmap) storedName() string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.name()
+}
+
+// setContent records that the file of the beatmap is in folder, and has the
+// given hash. It returns the previous folder and name of the file.
+func (c *CachedBeatmap) setContent(folder, hash string) (oldFolder, oldName string) {
+	c.mtx.Lock()
+	oldFolder, oldName = c.folder, c.name()
+	c.folder = folder
+	c.hash = hash
+	h := c.house
+	c.mtx.Unlock()
+	if h != nil {
+		h.index.update(c)
+	}
+	return oldFolder, oldName
+}
+
+// freedBy returns the size of the file of b, which has been removed from the
+// state, or 0 if other beatmaps still reference the file.
+func (h *House) freedBy(b *CachedBeatmap) uint64 {
+	b.mtx.RLock()
+	path, size := b.folder+b.name(), b.fileSize
+	b.mtx.RUnlock()
+	if h.index.references(path) > 0 {
+		return 0
+	}
+	return size
+}
+
+// contentName returns the name of the file holding the content with the given
+// hash.
+func contentName(hash string) string {
+	return hash + ".osz"
+}
+
+// newHash returns the hash used to name the files.
+func newHash() hash.Hash {
+	return sha256.New()
+}
+
+// hashSum returns the hash written to hw, in hexadecimal.
+func hashSum(hw hash.Hash) string {
+	return hex.EncodeToString(hw.Sum(nil))
+}
+
+// hashFile computes the hash of the content read from r.
+func hashFile(r io.Reader) (string, error) {
+	hw := newHash()
+	_, err := io.Copy(hw, r)
+	if err != nil {
+		return "", err
+	}
+	return hashSum(hw), nil
+}
+
+// usedLocked tells whether the file with the given path is referenced by a
+// beatmap in the state, or held. It must be called with h.contents.mtx held.
+func (h *House) usedLocked(path string) bool {
+	return h.contents.holds[path] > 0 || h.index.references(path) > 0
+}
+
+// holdLocked marks the file with the given path as about to be referenced by
+// a beatmap. It must be called with h.contents.mtx held.
+func (h *House) holdLocked(path string) {
+	if h.contents.holds == nil {
+		h.contents.holds = make(map[string]int)
+	}
+	h.contents.holds[path]++
+}
+
+// hold is like holdLocked, for the file with the given name in folder, and
+// tells whether the file was already used.
+func (h *House) hold(folder, name string) (shared bool) {
+	h.contents.mtx.Lock()
+	defer h.contents.mtx.Unlock()
+	shared = h.usedLocked(folder + name)
+	h.holdLocked(folder + name)
+	return shared
+}
+
+// unhold removes a hold on the file with the given name in folder, which is
+// removed if nothing references it anymore, for instance because the beatmap
+// was evicted meanwhile.
+func (h *House) unhold(folder, name string) {
+	h.contents.mtx.Lock()
+	defer h.contents.mtx.Unlock()
+	if !h.dropHoldLocked(folder + name) {
+		return
+	}
+	if err := h.removeUnreferenced(folder, name); err != nil {
+		logError(err)
+	}
+}
+
+// dropHoldLocked removes a hold on the file with the given path, and tells
+// whether it was the last one. It must be called with h.contents.mtx held.
+func (h *House) dropHoldLocked(path string) bool {
+	h.contents.holds[path]--
+	if h.contents.holds[path] > 0 {
+		return false
+	}
+	delete(h.contents.holds, path)
+	return true
+}
+
+// release removes the file with the given name from folder, unless a beatmap
+// in the state still references it, or it is held. h can be nil, for beatmaps
+// which are not in a house.
+func (h *House) release(folder, name string) error {
+	if h == nil {
+		return ignoreNotExist(Local(folder).Remove(name))
+	}
+	h.contents.mtx.Lock()
+	defer h.contents.mtx.Unlock()
+	if h.contents.holds[folder+name] > 0 {
+		return nil
+	}
+	return h.removeUnreferenced(folder, name)
+}
+
+// removeUnreferenced removes the file with the given name from folder if no
+// beatmap references it. It must be called with h.contents.mtx held.
+func (h *House) removeUnreferenced(folder, name string) error {
+	if h.index.references(folder+name) > 0 {
+		return nil
+	}
+	return ignoreNotExist(h.storage(folder).Remove(name))
+}
+
+func ignoreNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// storeContent moves the temporary file f, whose content has the given hash,
+// to folder. If a data folder already holds a file with the same content, f is
+// removed and that file is used instead. It returns the folder of the file,
+// which is held: unhold must be called once the beatmap references it.
+func (h *House) storeContent(f *os.File, folder, hash string) (string, error) {
+	name := contentName(hash)
+	h.contents.mtx.Lock()
+	defer h.contents.mtx.Unlock()
+	for _, dst := range append([]string{folder}, h.DataFolders...) {
+		if h.usedLocked(dst + name) {
+			f.Close()
+			os.Remove(f.Name())
+			h.holdLocked(dst + name)
+			log.Println("[C] Content", hash, "already in", dst)
+			return dst, nil
+		}
+	}
+	err := commitFile(f, folder+name)
+	if err != nil {
+		return "", err
+	}
+	h.holdLocked(folder + name)
+	return folder, nil
+}
+
+// hashLegacyFile names the file of b, in the data folder folder and written by
+// an older version, after its content, which has the given hash. If a data
+// folder already holds a file with the same content, b references it and its
+// own file is removed. It is a no-op if b changed meanwhile.
+func (h *House) hashLegacyFile(b *CachedBeatmap, folder, hash string) error {
+	if _, local := h.storage(folder).(Local); !local {
+		// the objects of remote storages can't be renamed.
+		return nil
+	}
+	name := contentName(hash)
+	h.contents.mtx.Lock()
+	dst := folder
+	for _, f := range h.DataFolders {
+		if h.usedLocked(f + name) {
+			dst = f
+			break
+		}
+	}
+	b.mtx.Lock()
+	legacy := b.FileName()
+	ok := b.folder == folder && b.hash == "" && b.stream == nil && b.isDownloaded
+	var err error
+	if ok && dst == folder {
+		err = os.Rename(folder+legacy, folder+name)
+		ok = err == nil
+	}
+	if ok {
+		b.folder = dst
+		b.hash = hash
+	}
+	b.mtx.Unlock()
+	if ok {
+		h.index.update(b)
+	}
+	h.contents.mtx.Unlock()
+
+	if !ok || dst == folder {
+		return err
+	}
+	return h.release(folder, legacy)
+}
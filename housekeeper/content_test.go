@@ -0,0 +1,182 @@
+package housekeeper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// downloadTestFile downloads a beatmap with the given content through its
+// stream.
+func downloadTestFile(t *testing.T, h *House, id int, noVideo bool, content []byte) *CachedBeatmap {
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: id, NoVideo: noVideo})
+	s := b.Stream()
+	if err := s.Start(int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	s.Write(content)
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestContentShared(t *testing.T) {
+	h := testHouse(t)
+	content := testZip(t, "no video anyway")
+	full := downloadTestFile(t, h, 1, false, content)
+	noVideo := downloadTestFile(t, h, 1, true, content)
+	other := downloadTestFile(t, h, 2, false, testZip(t, "another set"))
+
+	hash := sha256Hex(content)
+	if full.Hash() != hash || noVideo.Hash() != hash || full.Folder() != noVideo.Folder() {
+		t.Fatalf("beatmaps not sharing the file: %s %s", full.Hash(), noVideo.Hash())
+	}
+	files, _ := ioutil.ReadDir(h.DataFolders[0])
+	if len(files) != 2 || !exists(h.DataFolders[0]+contentName(hash)) {
+		t.Fatalf("unexpected files in the cache: %v", files)
+	}
+	size := uint64(len(content)) + other.FileSize()
+	if total, _ := h.index.size(); total != size {
+		t.Fatalf("want total size %d got %d", size, total)
+	}
+
+	// the file is only removed with the last beatmap referencing it.
+	h.index.remove(full)
+	if err := full.removeFile(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(h.DataFolders[0] + contentName(hash)) {
+		t.Fatal("shared file removed")
+	}
+	if f, err := noVideo.File(); err != nil {
+		t.Fatal(err)
+	} else {
+		f.Close()
+	}
+
+	// evicting a beatmap sharing its file frees nothing.
+	h.index.put(full)
+	full.SetLastRequested(time.Now().Add(-time.Hour))
+	noVideo.SetLastRequested(time.Now().Add(-time.Hour))
+	other.SetLastRequested(time.Now())
+	h.MaxSize = size - 1
+	h.CleanUp()
+	if h.Beatmap(1, false) != nil || h.Beatmap(1, true) != nil || h.Beatmap(2, false) == nil {
+		t.Fatal("want both beatmaps sharing the file evicted")
+	}
+	if exists(h.DataFolders[0] + contentName(hash)) {
+		t.Fatal("evicted file not removed")
+	}
+	if total, _ := h.index.size(); total != other.FileSize() {
+		t.Fatalf("want total size %d got %d", other.FileSize(), total)
+	}
+}
+
+func TestRefreshSameContent(t *testing.T) {
+	h := testHouse(t)
+	content := testZip(t, "uploaded again")
+	b := downloadTestFile(t, h, 1, false, content)
+	done := make(chan error)
+	h.Fetch = func(n *CachedBeatmap) {
+		s := n.Stream()
+		err := s.Start(int64(len(content)))
+		if err == nil {
+			s.Write(content)
+			err = s.Commit()
+		}
+		done <- err
+	}
+	h.RefreshUpdated = true
+	h.SetUpdated(1, time.Now())
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if b.Stale() || b.Hash() != sha256Hex(content) {
+		t.Fatal("beatmap not refreshed")
+	}
+	files, _ := ioutil.ReadDir(h.DataFolders[0])
+	if len(files) != 1 || !bytes.Equal(readTestFile(t, b), content) {
+		t.Fatalf("unexpected files in the cache: %v", files)
+	}
+}
+
+func TestScrubHashesLegacyFiles(t *testing.T) {
+	h := testHouse(t)
+	h.ScrubRate = 0
+	content := testZip(t, "written by an older version")
+	a := storeTestFile(t, h, 1, content)
+	b := storeTestFile(t, h, 2, content)
+
+	rep, err := h.Scrub(context.Background(), ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256Hex(content)
+	if rep.Checked != 2 || a.Hash() != hash || b.Hash() != hash {
+		t.Fatalf("files not hashed: %+v", rep)
+	}
+	files, _ := ioutil.ReadDir(h.DataFolders[0])
+	if len(files) != 1 || files[0].Name() != contentName(hash) {
+		t.Fatalf("unexpected files in the cache: %v", files)
+	}
+
+	// the content must match the hash naming it.
+	path := h.DataFolders[0] + contentName(hash)
+	if err := ioutil.WriteFile(path, testZip(t, "changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rep, err = h.Scrub(context.Background(), ScrubOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Corrupted) != 2 || h.Len() != 0 {
+		t.Fatalf("changed content not detected: %+v", rep)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("corrupted file left in the data folder")
+	}
+}
+
+func TestOffloadSharedContent(t *testing.T) {
+	h := testHouse(t)
+	s, fake := newFakeS3(t, "")
+	h.Storage = s
+	content := testZip(t, "stored once")
+	full := downloadTestFile(t, h, 1, false, content)
+	noVideo := downloadTestFile(t, h, 1, true, content)
+	for i := 0; full.Folder() != s.Location() || noVideo.Folder() != s.Location(); i++ {
+		if i > 100 {
+			t.Fatal("beatmaps not moved to the storage")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fake.mtx.Lock()
+	objects := len(fake.objects)
+	fake.mtx.Unlock()
+	if objects != 1 || exists(h.DataFolders[0]+full.storedName()) {
+		t.Fatalf("want 1 object and no local file, got %d objects", objects)
+	}
+}
+
+func TestEncodeHash(t *testing.T) {
+	b := &CachedBeatmap{ID: 1, isDownloaded: true, hash: sha256Hex([]byte("content"))}
+	buf := &bytes.Buffer{}
+	if err := writeBeatmaps(buf, []*CachedBeatmap{b}); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readBeatmaps(buf)
+	if err != nil || len(read) != 1 || read[0].hash != b.hash {
+		t.Fatalf("hash not read back: %v %v", read, err)
+	}
+}
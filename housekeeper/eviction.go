@@ -0,0 +1,131 @@
+package housekeeper
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Access is what eviction policies know about a beatmap.
+type Access struct {
+	LastRequested time.Time
+	// Requests is the frequency of the requests of the beatmap, as computed
+	// by the policy at the last request.
+	Requests     float64
+	Size         uint64
+	RankedStatus int
+}
+
+// EvictionPolicy decides which beatmaps are evicted first when the cache is
+// full.
+type EvictionPolicy interface {
+	// Frequency returns the frequency of the requests of a beatmap requested
+	// at t, whose access before the request is a.
+	Frequency(a Access, t time.Time) float64
+	// Priority returns the priority of a beatmap: the beatmaps in the lowest
+	// tier are evicted first, and among them those with the lowest value.
+	Priority(a Access) (tier int, value float64)
+	// Evicted is called with the value of the priority of every evicted
+	// beatmap.
+	Evicted(value float64)
+}
+
+// LRU evicts the least recently requested beatmaps first.
+type LRU struct{}
+
+// Frequency counts the requests.
+func (LRU) Frequency(a Access, t time.Time) float64 { return a.Requests + 1 }
+
+// Priority is the time of the last request.
+func (LRU) Priority(a Access) (int, float64) { return 0, seconds(a.LastRequested) }
+
+// Evicted does nothing.
+func (LRU) Evicted(float64) {}
+
+// LFU evicts the least frequently requested beatmaps first. The requests
+// count half as much every HalfLife, so that beatmaps which were popular long
+// ago are evicted eventually.
+type LFU struct {
+	HalfLife time.Duration
+}
+
+// Frequency decays the frequency since the last request, and counts the new
+// one.
+func (p LFU) Frequency(a Access, t time.Time) float64 {
+	if a.Requests == 0 {
+		return 1
+	}
+	elapsed := t.Sub(a.LastRequested).Seconds()
+	return a.Requests*math.Exp2(-elapsed/p.HalfLife.Seconds()) + 1
+}
+
+// Priority is the logarithm of the frequency decayed to a common point in
+// time, so that the beatmaps requested at different times can be compared
+// without updating them all as time goes by.
+func (p LFU) Priority(a Access) (int, float64) {
+	requests := a.Requests
+	if requests < 1 {
+		requests = 1
+	}
+	return 0, math.Log2(requests) + seconds(a.LastRequested)/p.HalfLife.Seconds()
+}
+
+// Evicted does nothing.
+func (LFU) Evicted(float64) {}
+
+// GDSF is the Greedy Dual-Size Frequency policy, which evicts first the
+// beatmaps which are requested the least for their size, so that many small
+// beatmaps are kept rather than a few large ones. The beatmaps which are
+// not requested anymore age as others are evicted.
+type GDSF struct {
+	mtx sync.Mutex
+	// inflation is the priority of the latest evicted beatmap.
+	inflation float64
+}
+
+// Frequency counts the requests.
+func (*GDSF) Frequency(a Access, t time.Time) float64 { return a.Requests + 1 }
+
+// Priority is the inflation at the last request plus the frequency of the
+// requests divided by the size in MB.
+func (p *GDSF) Priority(a Access) (int, float64) {
+	p.mtx.Lock()
+	l := p.inflation
+	p.mtx.Unlock()
+	size := float64(a.Size) / (1024 * 1024)
+	if size < 1 {
+		size = 1
+	}
+	return 0, l + math.Max(a.Requests, 1)/size
+}
+
+// Evicted raises the inflation to the priority of the evicted beatmap.
+func (p *GDSF) Evicted(value float64) {
+	p.mtx.Lock()
+	if value > p.inflation {
+		p.inflation = value
+	}
+	p.mtx.Unlock()
+}
+
+// StatusAware keeps the ranked, approved, qualified and loved beatmaps over
+// the others, which are evicted first. Among the beatmaps with the same kind
+// of status, the order is that of the wrapped policy.
+type StatusAware struct {
+	EvictionPolicy
+}
+
+// Priority puts the beatmaps which are ranked, approved, qualified or loved in
+// a higher tier.
+func (p StatusAware) Priority(a Access) (int, float64) {
+	tier, value := p.EvictionPolicy.Priority(a)
+	if a.RankedStatus >= 1 {
+		tier++
+	}
+	return tier, value
+}
+
+// seconds returns t as the number of seconds since the Unix epoch.
+func seconds(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/1e9
+}
@@ -0,0 +1,178 @@
+package housekeeper
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// evictionOrder returns the IDs of the beatmaps of h in the order in which
+// they are evicted.
+func evictionOrder(h *House) []int {
+	var ids []int
+	for _, b := range h.index.removable() {
+		ids = append(ids, b.ID)
+	}
+	return ids
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// requestTestBeatmaps adds beatmaps of the given sizes to the state of h, and
+// requests them: requests[i] are the times at which beatmap i+1 is requested.
+func requestTestBeatmaps(h *House, sizes []uint64, statuses []int, requests [][]time.Time) {
+	for i, size := range sizes {
+		b := &CachedBeatmap{
+			ID:           i + 1,
+			RankedStatus: statuses[i],
+			fileSize:     size,
+			isDownloaded: true,
+			house:        h,
+		}
+		h.index.put(b)
+		for _, t := range requests[i] {
+			b.SetLastRequested(t)
+		}
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours ...int) []time.Time {
+		var ts []time.Time
+		for _, h := range hours {
+			ts = append(ts, base.Add(time.Duration(h)*time.Hour))
+		}
+		return ts
+	}
+	sizes := []uint64{10 << 20, 1 << 20, 50 << 20}
+	statuses := []int{1, -2, 4}
+	requests := [][]time.Time{
+		// requested often, a while ago
+		at(0, 1, 2, 3, 4, 5),
+		// requested once, recently
+		at(10),
+		// requested twice
+		at(6, 9),
+	}
+
+	tests := []struct {
+		name   string
+		policy EvictionPolicy
+		want   []int
+	}{
+		{"lru", LRU{}, []int{1, 3, 2}},
+		{"lfu", LFU{HalfLife: 24 * time.Hour}, []int{2, 3, 1}},
+		// the requests of 1 are forgotten quickly
+		{"lfu short half-life", LFU{HalfLife: time.Hour}, []int{1, 3, 2}},
+		{"gdsf", &GDSF{}, []int{3, 1, 2}},
+		{"status-aware lru", StatusAware{LRU{}}, []int{2, 1, 3}},
+	}
+	for _, test := range tests {
+		h := New()
+		h.SetEviction(test.policy)
+		requestTestBeatmaps(h, sizes, statuses, requests)
+		if got := evictionOrder(h); !sameIDs(got, test.want) {
+			t.Errorf("%s: want %v got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestGDSFInflation(t *testing.T) {
+	p := &GDSF{}
+	_, before := p.Priority(Access{Requests: 1, Size: 1 << 20})
+	p.Evicted(5)
+	_, after := p.Priority(Access{Requests: 1, Size: 1 << 20})
+	if after != before+5 {
+		t.Fatalf("want priority %v got %v", before+5, after)
+	}
+	p.Evicted(2)
+	if _, again := p.Priority(Access{Requests: 1, Size: 1 << 20}); again != after {
+		t.Fatalf("inflation decreased: %v", again)
+	}
+}
+
+func TestPin(t *testing.T) {
+	h := testHouse(t)
+	base := time.Now().Add(-time.Hour)
+	h.setState([]*CachedBeatmap{
+		{ID: 1, lastRequested: base, fileSize: 10, isDownloaded: true},
+		{ID: 1, NoVideo: true, lastRequested: base, fileSize: 10, isDownloaded: true},
+		{ID: 2, lastRequested: base.Add(time.Minute), fileSize: 10, isDownloaded: true},
+	})
+	if err := h.Pin(1); err != nil {
+		t.Fatal(err)
+	}
+	// pinning sets which are not in the cache works as well
+	if err := h.Pin(3); err != nil {
+		t.Fatal(err)
+	}
+
+	h.MaxSize = 5
+	h.dryRun = make([]*CachedBeatmap, 0)
+	h.CleanUp()
+	if len(h.dryRun) != 1 || h.dryRun[0].ID != 2 {
+		t.Fatalf("want beatmap 2 removed got %v", h.dryRun)
+	}
+	if total, _ := h.StateSizeAndRemovableMaps(); total != 20 {
+		t.Fatalf("pinned beatmaps not counted: %d bytes", total)
+	}
+
+	h2 := testHouse(t)
+	h2.PinsFile = h.PinsFile
+	if err := h2.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if got := h2.Pinned(); !sameIDs(got, []int{1, 3}) {
+		t.Fatalf("want pins [1 3] got %v", got)
+	}
+
+	if err := h.Unpin(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := evictionOrder(h); !sameIDs(got, []int{1, 1}) {
+		t.Fatalf("unpinned beatmaps not evictable: %v", got)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	h := New()
+	buf := &bytes.Buffer{}
+	h.AccessLog = buf
+	for _, id := range []int{1, 2, 1, 3, 1, 2} {
+		size := int64(10)
+		if id == 3 {
+			// not known while downloading
+			size = -1
+		}
+		h.LogAccess(&CachedBeatmap{ID: id}, size)
+	}
+	// the size of 3 is known at its next request
+	h.LogAccess(&CachedBeatmap{ID: 3}, 10)
+
+	log, err := ReadAccessLog(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 7 {
+		t.Fatalf("want 7 requests got %d", len(log))
+	}
+	// only two beatmaps fit: 1 2 [1] 3 [1] 2 3
+	res := Simulate(LRU{}, 20, log)
+	if res.Requests != 7 || res.Hits != 2 || res.Bytes != 70 || res.ByteHits != 20 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if _, err := ReadAccessLog(bytes.NewBufferString("1 2 3\n")); err == nil {
+		t.Fatal("want error for malformed line")
+	}
+}
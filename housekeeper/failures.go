@@ -0,0 +1,185 @@
+package housekeeper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Failure is the record of the failed downloads of a beatmap. While NextRetry
+// has not passed, the beatmap is not downloaded again.
+type Failure struct {
+	ID          int       `json:"set_id"`
+	NoVideo     bool      `json:"no_video"`
+	Reason      string    `json:"reason"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	NextRetry   time.Time `json:"next_retry"`
+}
+
+type failureKey struct {
+	id      int
+	noVideo bool
+}
+
+// backoff returns the time to wait before attempting again a download which
+// failed the given number of times: it doubles at every attempt, up to
+// h.MaxFailureBackoff, and a random jitter of up to half of it is removed so
+// that sets which failed together are not retried together.
+func (h *House) backoff(attempts int) time.Duration {
+	d := h.FailureBackoff
+	for i := 1; i < attempts && d < h.MaxFailureBackoff; i++ {
+		d *= 2
+	}
+	if d > h.MaxFailureBackoff {
+		d = h.MaxFailureBackoff
+	}
+	if d < 2 {
+		return d
+	}
+	return d - time.Duration(h.rand.Int63n(int64(d/2)))
+}
+
+// recordFailure records that the download of b failed because of err.
+func (h *House) recordFailure(b *CachedBeatmap, err error) {
+	now := time.Now()
+	key := failureKey{b.ID, b.NoVideo}
+
+	h.failuresMtx.Lock()
+	f := h.failures[key]
+	if f == nil {
+		f = &Failure{ID: b.ID, NoVideo: b.NoVideo}
+		h.failures[key] = f
+	}
+	f.Reason = err.Error()
+	f.Attempts++
+	f.LastAttempt = now
+	f.NextRetry = now.Add(h.backoff(f.Attempts))
+	h.failuresMtx.Unlock()
+
+	logError(h.saveFailures())
+}
+
+// clearFailure removes the failure record of b, once it has been downloaded.
+func (h *House) clearFailure(b *CachedBeatmap) {
+	key := failureKey{b.ID, b.NoVideo}
+	h.failuresMtx.Lock()
+	_, ok := h.failures[key]
+	delete(h.failures, key)
+	h.failuresMtx.Unlock()
+
+	if ok {
+		logError(h.saveFailures())
+	}
+}
+
+// Failure returns the record of the failed downloads of the beatmap, or nil if
+// its latest download did not fail.
+func (h *House) Failure(id int, noVideo bool) *Failure {
+	h.failuresMtx.RLock()
+	defer h.failuresMtx.RUnlock()
+	f := h.failures[failureKey{id, noVideo}]
+	if f == nil {
+		return nil
+	}
+	c := *f
+	return &c
+}
+
+// Failures returns all the failure records, sorted by set ID.
+func (h *House) Failures() []Failure {
+	h.failuresMtx.RLock()
+	fs := make([]Failure, 0, len(h.failures))
+	for _, f := range h.failures {
+		fs = append(fs, *f)
+	}
+	h.failuresMtx.RUnlock()
+	sort.Slice(fs, func(i, j int) bool {
+		if fs[i].ID != fs[j].ID {
+			return fs[i].ID < fs[j].ID
+		}
+		return !fs[i].NoVideo && fs[j].NoVideo
+	})
+	return fs
+}
+
+// ResetFailures removes the failure records of the set with the given ID, so
+// that it is downloaded again at the next request. If id is 0, all the records
+// are removed. It returns the number of records removed.
+func (h *House) ResetFailures(id int) (int, error) {
+	h.failuresMtx.Lock()
+	n := 0
+	for k := range h.failures {
+		if id == 0 || k.id == id {
+			delete(h.failures, k)
+			n++
+		}
+	}
+	h.failuresMtx.Unlock()
+
+	if n == 0 {
+		return 0, nil
+	}
+	return n, h.saveFailures()
+}
+
+// loadFailures reads the failure records from h.FailuresFile.
+func (h *House) loadFailures() error {
+	data, err := ioutil.ReadFile(h.FailuresFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var fs []Failure
+	err = json.Unmarshal(data, &fs)
+	if err != nil {
+		return err
+	}
+
+	h.failuresMtx.Lock()
+	for i := range fs {
+		h.failures[failureKey{fs[i].ID, fs[i].NoVideo}] = &fs[i]
+	}
+	h.failuresMtx.Unlock()
+	return nil
+}
+
+// saveFailures writes the failure records to h.FailuresFile. They are read
+// with the file locked, so that concurrent saves can't write older records
+// last.
+func (h *House) saveFailures() error {
+	h.failuresFileMtx.Lock()
+	defer h.failuresFileMtx.Unlock()
+	data, err := json.Marshal(h.Failures())
+	if err != nil {
+		return err
+	}
+	return writeFile(h.FailuresFile, data)
+}
+
+// writeFile replaces the file at path with one containing data, atomically.
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = commitFile(f, path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
@@ -0,0 +1,101 @@
+package housekeeper
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	h := New()
+	h.FailureBackoff = time.Minute
+	h.MaxFailureBackoff = 10 * time.Minute
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := h.backoff(tt.attempts)
+			if d > tt.max || d <= tt.max/2 {
+				t.Fatalf("attempt %d: backoff %v not in (%v, %v]", tt.attempts, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestFailuresPersisted(t *testing.T) {
+	h := testHouse(t)
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	b.Stream().Abort(errors.New("mirror exploded"))
+	h.Redownload(b)
+	b.Stream().Abort(errors.New("mirror exploded again"))
+	c, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 2, NoVideo: true})
+	c.Stream().Abort(errors.New("no mirror"))
+
+	h2 := New()
+	h2.FailuresFile = h.FailuresFile
+	if err := h2.loadFailures(); err != nil {
+		t.Fatal(err)
+	}
+	fs := h2.Failures()
+	if len(fs) != 2 {
+		t.Fatalf("want 2 failures got %+v", fs)
+	}
+	if fs[0].ID != 1 || fs[0].Attempts != 2 || fs[0].Reason != "mirror exploded again" {
+		t.Fatalf("unexpected failure %+v", fs[0])
+	}
+	if fs[1].ID != 2 || !fs[1].NoVideo || fs[1].Attempts != 1 {
+		t.Fatalf("unexpected failure %+v", fs[1])
+	}
+	if !fs[0].NextRetry.After(fs[0].LastAttempt) {
+		t.Fatal("next retry must follow the last attempt")
+	}
+}
+
+func TestResetFailures(t *testing.T) {
+	h := testHouse(t)
+	for _, id := range []int{1, 2, 3} {
+		b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: id})
+		b.Stream().Abort(errors.New("mirror exploded"))
+	}
+
+	n, err := h.ResetFailures(2)
+	if err != nil || n != 1 {
+		t.Fatalf("want 1 reset got %d (%v)", n, err)
+	}
+	if h.Failure(2, false) != nil || h.Failure(1, false) == nil {
+		t.Fatal("wrong failures reset")
+	}
+	n, err = h.ResetFailures(0)
+	if err != nil || n != 2 {
+		t.Fatalf("want 2 reset got %d (%v)", n, err)
+	}
+	if len(h.Failures()) != 0 {
+		t.Fatal("failures left after reset")
+	}
+}
+
+func TestSuccessClearsFailure(t *testing.T) {
+	h := testHouse(t)
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	b.Stream().Abort(errors.New("mirror exploded"))
+	h.Redownload(b)
+	s := b.Stream()
+	data := testZip(t, "osu file format v14")
+	s.Start(int64(len(data)))
+	s.Write(data)
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if f := h.Failure(1, false); f != nil {
+		t.Fatalf("failure not cleared: %+v", f)
+	}
+}
@@ -0,0 +1,51 @@
+package housekeeper
+
+import (
+	"context"
+	"sync"
+)
+
+// Flight is an operation whose outcome is shared by everyone waiting for it:
+// it is done once, by a single goroutine, and its error is delivered to all the
+// waiters.
+type Flight struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// NewFlight creates a new Flight, which is in progress until Finish is called.
+func NewFlight() *Flight {
+	return &Flight{done: make(chan struct{})}
+}
+
+// Finish records the outcome of the operation and wakes up all the waiters.
+// Only the first call has any effect.
+func (f *Flight) Finish(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Done returns a channel which is closed once the operation is finished.
+func (f *Flight) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the operation to finish and returns its error. If ctx is done
+// first, for instance because its deadline has passed, Wait returns ctx's
+// error instead; the operation goes on for the other waiters.
+func (f *Flight) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+	}
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+package housekeeper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightDeliversError(t *testing.T) {
+	f := NewFlight()
+	failure := errors.New("download failed")
+
+	const waiters = 50
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			errs <- f.Wait(context.Background())
+		}()
+	}
+	f.Finish(failure)
+	// only the first outcome counts
+	f.Finish(nil)
+
+	for i := 0; i < waiters; i++ {
+		if err := <-errs; err != failure {
+			t.Fatalf("want %v got %v", failure, err)
+		}
+	}
+	// waiters coming after the end get the outcome straight away
+	if err := f.Wait(context.Background()); err != failure {
+		t.Fatalf("want %v got %v", failure, err)
+	}
+}
+
+func TestFlightWaiterDeadline(t *testing.T) {
+	f := NewFlight()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := f.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want context.DeadlineExceeded got %v", err)
+	}
+
+	// the flight is not affected by the waiter which gave up
+	done := make(chan error)
+	go func() {
+		done <- f.Wait(context.Background())
+	}()
+	f.Finish(nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentAcquireSingleDownload(t *testing.T) {
+	h := testHouse(t)
+	failure := errors.New("mirrors are down")
+
+	const requests = 50
+	var (
+		downloads int32
+		wg        sync.WaitGroup
+		start     = make(chan struct{})
+		errs      = make([]error, requests)
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			b, shouldDownload := h.AcquireBeatmap(&CachedBeatmap{ID: 1, NoVideo: true})
+			if shouldDownload {
+				atomic.AddInt32(&downloads, 1)
+				// give the others time to start waiting
+				time.Sleep(10 * time.Millisecond)
+				b.Stream().Abort(failure)
+			}
+			errs[i] = b.Wait(context.Background())
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if downloads != 1 {
+		t.Fatalf("want 1 download got %d", downloads)
+	}
+	for i, err := range errs {
+		if err != failure {
+			t.Fatalf("request %d: want %v got %v", i, failure, err)
+		}
+	}
+	if h.Len() != 1 {
+		t.Fatalf("want 1 beatmap in the state got %d", h.Len())
+	}
+}
@@ -0,0 +1,185 @@
+package housekeeper
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Folder is a data folder, where the beatmaps are stored.
+type Folder struct {
+	// Path is the path of the folder, ending with a slash.
+	Path string
+	// Quota is the maximum size of the beatmaps in the folder, in bytes. 0
+	// means no quota.
+	Quota uint64
+	// Cold folders only get the beatmaps which have not been requested for a
+	// while, when using the tiered placement.
+	Cold bool
+}
+
+// ParseFolders parses a comma separated list of folders. Each folder can be
+// followed by =<quota in GB>, and by :hot or :cold, for instance
+// "/ssd/=50:hot,/hdd/=500:cold".
+func ParseFolders(s string) ([]Folder, error) {
+	var folders []Folder
+	for _, part := range strings.Split(s, ",") {
+		var f Folder
+		switch {
+		case strings.HasSuffix(part, ":cold"):
+			f.Cold = true
+			part = strings.TrimSuffix(part, ":cold")
+		case strings.HasSuffix(part, ":hot"):
+			part = strings.TrimSuffix(part, ":hot")
+		}
+		if i := strings.LastIndex(part, "="); i >= 0 {
+			gb, err := strconv.ParseFloat(part[i+1:], 64)
+			if err != nil || gb < 0 {
+				return nil, errors.New("cheesegull/housekeeper: invalid quota of folder " + part[:i])
+			}
+			f.Quota = uint64(gb * 1024 * 1024 * 1024)
+			part = part[:i]
+		}
+		if part == "" {
+			return nil, errors.New("cheesegull/housekeeper: empty folder path")
+		}
+		if !strings.HasSuffix(part, "/") {
+			part += "/"
+		}
+		f.Path = part
+		folders = append(folders, f)
+	}
+	return folders, nil
+}
+
+// Placement is a policy choosing the folder where a new beatmap is stored.
+type Placement int
+
+// The placement policies.
+const (
+	// PlaceMostFree stores beatmaps in the folder with the most free space.
+	PlaceMostFree Placement = iota
+	// PlaceRoundRobin stores beatmaps in every folder in turn.
+	PlaceRoundRobin
+	// PlaceTiered stores beatmaps in the hot folders, and the rebalancer
+	// moves them to the cold folders once they are not requested anymore.
+	PlaceTiered
+)
+
+// Placements are the names of the placement policies.
+var Placements = map[string]Placement{
+	"most-free":   PlaceMostFree,
+	"round-robin": PlaceRoundRobin,
+	"tiered":      PlaceTiered,
+}
+
+// folders returns the data folders. Houses which only have DataFolders get
+// folders without quotas.
+func (h *House) folders() []Folder {
+	if len(h.Folders) > 0 {
+		return h.Folders
+	}
+	folders := make([]Folder, len(h.DataFolders))
+	for i, path := range h.DataFolders {
+		folders[i] = Folder{Path: path}
+	}
+	return folders
+}
+
+// free returns the space left in f, considering both its quota and the space
+// left on its disk.
+func (h *House) free(f Folder) uint64 {
+	free := uint64(math.MaxUint64)
+	if f.Quota > 0 {
+		used := h.index.folderUsage(f.Path)
+		free = 0
+		if used < f.Quota {
+			free = f.Quota - used
+		}
+	}
+	if disk, err := diskFree(f.Path); err == nil && disk < free {
+		free = disk
+	}
+	return free
+}
+
+// mostFree returns the folder with the most free space among those for which
+// ok returns true and which have room for size bytes, or "" if there is none.
+func (h *House) mostFree(size uint64, ok func(Folder) bool) string {
+	best, bestFree := "", uint64(0)
+	for _, f := range h.folders() {
+		if !ok(f) {
+			continue
+		}
+		free := h.free(f)
+		if hasRoom(free, size) && free > bestFree {
+			best, bestFree = f.Path, free
+		}
+	}
+	return best
+}
+
+func anyFolder(Folder) bool { return true }
+
+// hasRoom tells whether a folder with the given free space has room for a
+// beatmap of the given size.
+func hasRoom(free, size uint64) bool {
+	return free > 0 && free >= size
+}
+
+// placeFile returns the folder where a new beatmap of the given size, or -1
+// if it is not known, is stored, according to the placement policy. When no
+// folder has room for it, the one with the most free space is used, and the
+// cleanup makes room.
+func (h *House) placeFile(size int64) string {
+	folders := h.folders()
+	if len(folders) == 0 {
+		return ""
+	}
+	need := uint64(0)
+	if size > 0 {
+		need = uint64(size)
+	}
+
+	var folder string
+	switch h.Placement {
+	case PlaceRoundRobin:
+		start := int(atomic.AddUint32(&h.nextFolder, 1) - 1)
+		for i := range folders {
+			f := folders[(start+i)%len(folders)]
+			if hasRoom(h.free(f), need) {
+				folder = f.Path
+				break
+			}
+		}
+	case PlaceTiered:
+		folder = h.mostFree(need, func(f Folder) bool { return !f.Cold })
+		if folder == "" {
+			folder = h.mostFree(need, func(f Folder) bool { return f.Cold })
+		}
+	default:
+		folder = h.mostFree(need, anyFolder)
+	}
+	if folder == "" {
+		folder = h.mostFree(0, anyFolder)
+	}
+	if folder == "" {
+		// every folder is full
+		folder = folders[0].Path
+	}
+	return folder
+}
+
+// overQuota returns how much the beatmaps in f exceed its quota.
+func (h *House) overQuota(f Folder) uint64 {
+	if f.Quota == 0 {
+		return 0
+	}
+	used := h.index.folderUsage(f.Path)
+	if used <= f.Quota {
+		return 0
+	}
+	return used - f.Quota
+}
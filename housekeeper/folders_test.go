@@ -0,0 +1,164 @@
+package housekeeper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseFolders(t *testing.T) {
+	folders, err := ParseFolders("/ssd/=50:hot,/hdd=0.5:cold,/data/,/old:cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Folder{
+		{Path: "/ssd/", Quota: 50 << 30},
+		{Path: "/hdd/", Quota: 1 << 29, Cold: true},
+		{Path: "/data/"},
+		{Path: "/old/", Cold: true},
+	}
+	if !reflect.DeepEqual(folders, want) {
+		t.Fatalf("want %v got %v", want, folders)
+	}
+	for _, s := range []string{"/data/=big", "/data/=-1", "=5", "/a/,"} {
+		if _, err := ParseFolders(s); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
+
+// testFolders creates a house storing beatmaps in the given folders, whose
+// paths are set to temporary folders.
+func testFolders(t *testing.T, folders ...Folder) *House {
+	h := testHouse(t)
+	base := h.DataFolders[0]
+	h.DataFolders = nil
+	for i, f := range folders {
+		f.Path = base + strconv.Itoa(i) + "/"
+		if err := os.Mkdir(f.Path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		h.Folders = append(h.Folders, f)
+		h.DataFolders = append(h.DataFolders, f.Path)
+	}
+	return h
+}
+
+// storeTestBeatmap stores a beatmap of the given size in folder, requested at
+// the given time.
+func storeTestBeatmap(t *testing.T, h *House, id int, folder string, size int, requested time.Time) *CachedBeatmap {
+	b := &CachedBeatmap{
+		ID:            id,
+		DataFolders:   h.DataFolders,
+		folder:        folder,
+		lastRequested: requested,
+		fileSize:      uint64(size),
+		isDownloaded:  true,
+		house:         h,
+	}
+	if err := ioutil.WriteFile(folder+b.FileName(), make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.index.put(b)
+	return b
+}
+
+func TestPlacement(t *testing.T) {
+	h := testFolders(t, Folder{Quota: 100}, Folder{Quota: 200}, Folder{Quota: 100, Cold: true})
+	hot1, hot2, cold := h.DataFolders[0], h.DataFolders[1], h.DataFolders[2]
+	storeTestBeatmap(t, h, 1, hot2, 150, time.Now())
+
+	// hot2 has 50 bytes left
+	if folder := h.placeFile(10); folder != hot1 && folder != cold {
+		t.Errorf("most free: want %s or %s got %s", hot1, cold, folder)
+	}
+
+	h.Placement = PlaceRoundRobin
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, h.placeFile(60))
+	}
+	// hot2 does not have room for the beatmap
+	want := []string{hot1, cold, cold, hot1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round robin: want %v got %v", want, got)
+	}
+
+	h.Placement = PlaceTiered
+	if folder := h.placeFile(40); folder != hot1 {
+		t.Errorf("tiered: want %s got %s", hot1, folder)
+	}
+	storeTestBeatmap(t, h, 2, hot1, 80, time.Now())
+	if folder := h.placeFile(60); folder != cold {
+		t.Errorf("tiered with full hot folders: want %s got %s", cold, folder)
+	}
+}
+
+func TestRebalanceTiered(t *testing.T) {
+	h := testFolders(t, Folder{}, Folder{Cold: true})
+	h.Placement = PlaceTiered
+	h.ColdAfter = time.Hour
+	hot, cold := h.DataFolders[0], h.DataFolders[1]
+	old := storeTestBeatmap(t, h, 1, hot, 10, time.Now().Add(-2*time.Hour))
+	recent := storeTestBeatmap(t, h, 2, hot, 10, time.Now())
+
+	moved, err := h.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || old.Folder() != cold || recent.Folder() != hot {
+		t.Fatalf("unexpected rebalance: %d moved, folders %s and %s", moved, old.Folder(), recent.Folder())
+	}
+	if exists(hot+old.FileName()) || !exists(cold+old.FileName()) {
+		t.Fatal("file not moved")
+	}
+	if h.index.folderUsage(hot) != 10 || h.index.folderUsage(cold) != 10 {
+		t.Fatalf("unexpected usage %d and %d", h.index.folderUsage(hot), h.index.folderUsage(cold))
+	}
+
+	// the folder is saved in the state
+	h.setState(nil)
+	if err := h.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if b := h.Beatmap(1, false); b == nil || b.Folder() != cold {
+		t.Fatalf("folder not saved: %v", b)
+	}
+}
+
+func TestFolderQuota(t *testing.T) {
+	h := testFolders(t, Folder{Quota: 25}, Folder{Quota: 20})
+	first, second := h.DataFolders[0], h.DataFolders[1]
+	base := time.Now().Add(-time.Hour)
+	for id := 1; id <= 4; id++ {
+		storeTestBeatmap(t, h, id, first, 10, base.Add(time.Duration(id)*time.Minute))
+	}
+	storeTestBeatmap(t, h, 5, second, 10, base)
+	h.dryRun = make([]*CachedBeatmap, 0)
+
+	// first is 15 bytes over its quota, and second only has room for 10
+	h.CleanUp()
+	if len(h.dryRun) != 1 || h.dryRun[0].ID != 1 {
+		t.Fatalf("want beatmap 1 removed got %v", h.dryRun)
+	}
+	select {
+	case <-h.rebalanceChan:
+	default:
+		t.Fatal("rebalance not scheduled")
+	}
+
+	moved, err := h.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || h.Beatmap(2, false).Folder() != second {
+		t.Fatalf("want beatmap 2 moved got %d moved", moved)
+	}
+	if h.overQuota(h.Folders[0]) != 0 || h.overQuota(h.Folders[1]) != 0 {
+		t.Fatal("folders still over quota")
+	}
+}
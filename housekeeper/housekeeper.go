@@ -3,11 +3,15 @@
 package housekeeper
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
-	"sort"
-	"strings"
+	"path/filepath"
 	"sync"
+	"time"
 
 	raven "github.com/getsentry/raven-go"
 )
@@ -17,9 +21,106 @@ type House struct {
 	MaxSize     uint64
 	MaxSizeGB   int
 	DataFolders []string
-	State       []*CachedBeatmap
-	StateMutex  sync.RWMutex
+	index       *index
+	contents    contents
 	requestChan chan struct{}
+
+	// Folders are the data folders, with their quotas. DataFolders are their
+	// paths.
+	Folders []Folder
+	// Placement chooses the folder where new beatmaps are stored.
+	Placement  Placement
+	nextFolder uint32
+	// ColdAfter is the time after which a beatmap which has not been
+	// requested is moved to a cold folder, with the tiered placement.
+	ColdAfter time.Duration
+	// RebalanceInterval is the time between two runs of the rebalancer,
+	// which moves beatmaps between the folders.
+	RebalanceInterval time.Duration
+	rebalanceChan     chan struct{}
+
+	// LowFree is the free space, in bytes, below which beatmaps are evicted
+	// from the folders of a disk until its free space is over HighFree. 0
+	// disables the watermarks.
+	LowFree  uint64
+	HighFree uint64
+	// CriticalFree is the free space, in bytes, below which new beatmaps are
+	// not downloaded anymore.
+	CriticalFree uint64
+	// FreeSpaceInterval is the time between two checks of the free space,
+	// besides those after every download.
+	FreeSpaceInterval time.Duration
+
+	// Storage, if set, is where the beatmaps are moved once downloaded in
+	// the data folders. Several instances can share it, but the beatmaps
+	// evicted by one are removed for all of them.
+	Storage Storage
+	// RedirectExpiry is the time the clients are given to download a
+	// beatmap from Storage, when it can presign URLs, rather than through
+	// CheeseGull. 0 disables the redirects.
+	RedirectExpiry time.Duration
+
+	// StateFile is where the state is saved.
+	StateFile    string
+	stateFileMtx sync.Mutex
+
+	// StripVideo makes the beatmaps without video from the full ones, rather
+	// than downloading them separately.
+	StripVideo bool
+
+	// FailuresFile is where the records of the failed downloads are saved.
+	FailuresFile string
+	// FailureBackoff is the time to wait before downloading again a beatmap
+	// which failed to download once. It doubles at every failure, up to
+	// MaxFailureBackoff.
+	FailureBackoff    time.Duration
+	MaxFailureBackoff time.Duration
+	failures          map[failureKey]*Failure
+	failuresMtx       sync.RWMutex
+	failuresFileMtx   sync.Mutex
+	rand              *rand.Rand
+
+	// PinsFile is where the IDs of the pinned sets are saved.
+	PinsFile    string
+	pinsFileMtx sync.Mutex
+
+	// AccessLog, if not nil, receives a line for every request of a
+	// beatmap, written by LogAccess.
+	AccessLog    io.Writer
+	accessLogMtx sync.Mutex
+
+	// RescanPause is the time Rescan sleeps between two batches of files.
+	RescanPause time.Duration
+	rescanMtx   sync.Mutex
+	rescanning  bool
+	lastRescan  *RescanReport
+
+	// RefreshUpdated makes SetUpdated download the new version of the
+	// updated beatmaps right away, rather than at their next request.
+	RefreshUpdated bool
+
+	// QuarantineFolder is where Scrub moves the corrupted files.
+	QuarantineFolder string
+	// ScrubRate is the number of bytes per second Scrub reads at most, 0
+	// meaning no limit.
+	ScrubRate uint64
+	// ScrubInterval is the time between two runs of the scrubber, and
+	// ScrubAfter the time after which a beatmap is verified again.
+	ScrubInterval time.Duration
+	ScrubAfter    time.Duration
+	// RedownloadCorrupted makes Scrub download again the corrupted beatmaps,
+	// rather than removing them from the state.
+	RedownloadCorrupted bool
+	// MD5s, if set, returns the MD5s the .osu files of the set with the given
+	// ID must have.
+	MD5s func(id int) ([]string, error)
+	// Fetch, if set, downloads in the background a beatmap for which
+	// Redownload returned true, or the new version of an updated beatmap.
+	Fetch     func(b *CachedBeatmap)
+	scrubMtx  sync.Mutex
+	scrubbing bool
+	lastScrub *ScrubReport
+
 	// set to non-nil to avoid calling os.Remove on the files to remove, and
 	// place them here instead.
 	dryRun []*CachedBeatmap
@@ -29,13 +130,42 @@ type House struct {
 func New() *House {
 	return &House{
 		MaxSize:     1024 * 1024 * 1024 * 10, // 10 gigs
+		index:       newIndex(),
 		requestChan: make(chan struct{}, 1),
+
+		ColdAfter:         7 * 24 * time.Hour,
+		RebalanceInterval: time.Hour,
+		rebalanceChan:     make(chan struct{}, 1),
+		FreeSpaceInterval: time.Minute,
+
+		StateFile:         "cgbin.db",
+		FailuresFile:      "cgfailures.json",
+		PinsFile:          "cgpins.json",
+		FailureBackoff:    5 * time.Minute,
+		MaxFailureBackoff: 24 * time.Hour,
+		failures:          make(map[failureKey]*Failure),
+		rand:              newRand(),
+		RescanPause:       10 * time.Millisecond,
+		QuarantineFolder:  "quarantine",
+		ScrubRate:         5 * 1024 * 1024,
+		ScrubInterval:     time.Hour,
+		ScrubAfter:        30 * 24 * time.Hour,
 	}
 }
 
+// UpdateFolders sets the data folders, parsed with ParseFolders. It returns
+// false if they can't be parsed.
 func (h *House) UpdateFolders(folders string) bool {
-	var splittedPaths = strings.Split(folders, ",")
-	h.DataFolders = splittedPaths
+	parsed, err := ParseFolders(folders)
+	if err != nil {
+		logError(err)
+		return false
+	}
+	h.Folders = parsed
+	h.DataFolders = make([]string, len(parsed))
+	for i, f := range parsed {
+		h.DataFolders[i] = f.Path
+	}
 	return true
 }
 
@@ -51,8 +181,10 @@ func (h *House) scheduleCleanup() {
 }
 
 // StartCleaner starts the process that will do the necessary housekeeping
-// every time a cleanup is scheduled with scheduleCleanup.
+// every time a cleanup is scheduled with scheduleCleanup, and every
+// FreeSpaceInterval if free space watermarks are set.
 func (h *House) StartCleaner() {
+	h.startFreeSpaceTicker()
 	go func() {
 		for {
 			<-h.requestChan
@@ -66,130 +198,114 @@ func (h *House) CleanUp() {
 	log.Println("[C] Running cleanup")
 
 	toRemove := h.mapsToRemove()
-
-	f, err := os.Create("cgbin.db")
-	if err != nil {
-		logError(err)
+	if len(toRemove) == 0 {
 		return
 	}
 
-	// build new state by removing from it the beatmaps from toRemove
-	h.StateMutex.Lock()
-	newState := make([]*CachedBeatmap, 0, len(h.State))
-StateLoop:
-	for _, b := range h.State {
-		for _, r := range toRemove {
-			if r.ID == b.ID && r.NoVideo == b.NoVideo {
-				continue StateLoop
-			}
-		}
-		newState = append(newState, b)
+	if h.dryRun != nil {
+		h.dryRun = toRemove
+		return
 	}
-	h.State = newState
-	err = writeBeatmaps(f, h.State)
-	h.StateMutex.Unlock()
 
-	f.Close()
+	err := h.SaveState()
 	if err != nil {
 		logError(err)
 		return
 	}
 
-	if h.dryRun != nil {
-		h.dryRun = toRemove
-		return
-	}
-
 	for _, b := range toRemove {
-		err := os.Remove(b.fileName())
-		switch {
-		case err == nil, os.IsNotExist(err):
-			// silently ignore
-		default:
+		err := b.removeFile()
+		if err != nil {
 			logError(err)
 		}
 	}
 }
 
+// mapsToRemove removes from the state the least recently requested beatmaps,
+// until the cache fits in MaxSize and every folder fits in its quota, and
+// returns them. The beatmaps exceeding the quota of a folder are only removed
+// if the other folders don't have room for them; otherwise, the rebalancer
+// moves them.
 func (h *House) mapsToRemove() []*CachedBeatmap {
-	badBeatmaps := h.badBeatmaps()
-	if len(badBeatmaps) > 0 {
-		log.Println("[C] Bad Beatmaps", len(badBeatmaps))
-		return badBeatmaps
-	}
-
-	totalSize, removable := h.StateSizeAndRemovableMaps()
-
-	if totalSize <= h.MaxSize {
-		// no clean up needed, our totalSize has still not gotten over the
-		// threshold
-		return nil
-	}
-
-	sortByLastRequested(removable)
-
-	removeBytes := int(totalSize - h.MaxSize)
 	var toRemove []*CachedBeatmap
-	for _, b := range removable {
-		toRemove = append(toRemove, b)
-		fSize := b.FileSize()
-		removeBytes -= int(fSize)
-		if removeBytes <= 0 {
-			break
-		}
+	totalSize, _ := h.index.size()
+	if totalSize > h.MaxSize {
+		toRemove = h.index.evict(totalSize - h.MaxSize)
 	}
 
-	return toRemove
-}
-
-func (h *House) badBeatmaps() (removable []*CachedBeatmap) {
-	h.StateMutex.RLock()
-	for _, b := range h.State {
-		if !b.IsDownloaded() {
+	rebalance := false
+	for _, f := range h.folders() {
+		over := h.overQuota(f)
+		if over == 0 {
 			continue
 		}
-		fsize := b.FileSize()
-		if fsize > 0 && fsize < 10000 {
-			removable = append(removable, b)
+		room := h.roomFor(f)
+		if room >= over {
+			rebalance = true
+			continue
 		}
+		if room > 0 {
+			rebalance = true
+		}
+		toRemove = append(toRemove, h.index.evictFolder(f.Path, over-room)...)
+	}
+	if rebalance {
+		h.scheduleRebalance()
 	}
-	h.StateMutex.RUnlock()
-	return
+	return append(toRemove, h.freeSpaceToRemove(toRemove)...)
 }
 
 // i hate verbose names myself, but it was very hard to come up with something
 // even as short as this.
 func (h *House) StateSizeAndRemovableMaps() (totalSize uint64, removable []*CachedBeatmap) {
-	h.StateMutex.RLock()
-	for _, b := range h.State {
-		if !b.IsDownloaded() {
-			continue
-		}
-		fSize := b.FileSize()
-		totalSize += fSize
-		if fSize == 0 {
-			continue
-		}
-		removable = append(removable, b)
-	}
-	h.StateMutex.RUnlock()
-	return
+	totalSize, _ = h.index.size()
+	return totalSize, h.index.removable()
+}
+
+// Beatmaps returns all the beatmaps in the state, sorted by ID.
+func (h *House) Beatmaps() []*CachedBeatmap {
+	return h.index.all()
+}
+
+// Beatmap returns the beatmap in the state with the given ID and variant, or
+// nil if there is none.
+func (h *House) Beatmap(id int, noVideo bool) *CachedBeatmap {
+	return h.index.get(stateKey{id, noVideo})
 }
 
-func sortByLastRequested(b []*CachedBeatmap) {
-	sort.Slice(b, func(i, j int) bool {
-		b[i].mtx.RLock()
-		b[j].mtx.RLock()
-		r := b[i].lastRequested.Before(b[j].lastRequested)
-		b[i].mtx.RUnlock()
-		b[j].mtx.RUnlock()
-		return r
-	})
+// Len returns the number of beatmaps in the state.
+func (h *House) Len() int {
+	_, length := h.index.size()
+	return length
+}
+
+// setState replaces the state with the given beatmaps.
+func (h *House) setState(bms []*CachedBeatmap) {
+	for _, b := range h.index.all() {
+		h.index.remove(b)
+	}
+	for _, b := range bms {
+		b.house = h
+		h.index.put(b)
+	}
 }
 
-// LoadState attempts to load the state from cgbin.db
+// LoadState attempts to load the state from the StateFile, the records of the
+// failed downloads from the FailuresFile and the pinned sets from the
+// PinsFile. If part of the state is corrupted, the rest is loaded and the
+// error is only logged: Reconcile takes care of the files of the beatmaps
+// which have been lost.
 func (h *House) LoadState() error {
-	f, err := os.Open("cgbin.db")
+	err := h.loadFailures()
+	if err != nil {
+		return err
+	}
+	err = h.loadPins()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(h.StateFile)
 	switch {
 	case os.IsNotExist(err):
 		return nil
@@ -198,71 +314,51 @@ func (h *House) LoadState() error {
 	}
 	defer f.Close()
 
-	h.StateMutex.Lock()
-	h.State, err = readBeatmaps(f)
-	h.StateMutex.Unlock()
+	state, err := readBeatmaps(f)
+	if errors.Is(err, errCorruptState) {
+		log.Println("[C]", h.StateFile+":", err)
+		logError(err)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, b := range state {
+		// CGBIN001 did not record the folders
+		if len(b.DataFolders) == 0 {
+			b.DataFolders = h.DataFolders
+		}
+	}
 
-	return err
+	h.setState(state)
+	return nil
 }
 
-// const zipMagic = "PK\x03\x04"
-
-// RemoveNonZip reads all the beatmaps currently in the house to ensure that
-// they are all zip files. Those which are not get removed.
-func (h *House) RemoveNonZip() {
-	// Currently not using feature, so comment it :/
-
-	// f, err := os.Create("cgbin.db")
-	// if err != nil {
-	// 	logError(err)
-	// 	return
-	// }
-
-	// h.StateMutex.Lock()
-	// state2 := make([]*CachedBeatmap, 0, len(h.State))
-	// log.Println("[F] Removing non-zip files...", len(h.State), "beatmaps to read")
-	// for _, beatmap := range h.State {
-	// 	remove, err := checkBeatmap(beatmap)
-	// 	if err != nil {
-	// 		log.Println("[F] Error:", err)
-	// 		continue
-	// 	}
-	// 	if remove {
-	// 		err = os.Remove(beatmap.fileName())
-	// 		if err != nil {
-	// 			log.Println("[F] Error removing:", err)
-	// 		} else {
-	// 			log.Println("[F] Remove:", beatmap.ID, beatmap.NoVideo)
-	// 		}
-	// 	} else {
-	// 		state2 = append(state2, beatmap)
-	// 	}
-	// }
-	// err = writeBeatmaps(f, state2)
-	// if err != nil {
-	// 	logError(err)
-	// }
-	// h.State = state2
-	// h.StateMutex.Unlock()
-	// f.Close()
-	// log.Println("[F] CleanUp")
-	// h.CleanUp()
+// SaveState writes the state to the StateFile, so that it can be loaded back
+// with LoadState. The file is replaced atomically, so that a crash while
+// saving leaves the previous state intact.
+func (h *House) SaveState() error {
+	h.stateFileMtx.Lock()
+	defer h.stateFileMtx.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(h.StateFile), filepath.Base(h.StateFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	err = writeBeatmaps(f, h.index.all())
+
+	if err == nil {
+		err = commitFile(f, h.StateFile)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return err
 }
 
-// func checkBeatmap(b *CachedBeatmap) (bool, error) {
-// 	f, err := b.File()
-// 	if os.IsNotExist(err) {
-// 		return true, nil
-// 	}
-// 	if err != nil {
-// 		return false, err
-// 	}
-// 	defer f.Close()
-
-// 	header := make([]byte, 4)
-// 	_, err = f.Read(header)
-// 	return string(header) != zipMagic, err
-// }
+const zipMagic = "PK\x03\x04"
 
 var envSentryDSN = os.Getenv("SENTRY_DSN")
 
@@ -1,6 +1,10 @@
 package housekeeper
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -42,15 +46,15 @@ func TestCleanupOneMap(t *testing.T) {
 
 	h := New()
 	h.MaxSize = 50
-	h.state = append(expectRemain, expectRemove...)
+	h.setState(append(expectRemain, expectRemove...))
 	h.dryRun = make([]*CachedBeatmap, 0)
 
 	start := time.Now()
-	h.cleanUp()
+	h.CleanUp()
 	t.Log("cleanup took", time.Since(start))
 
-	if !reflect.DeepEqual(expectRemain, h.state) {
-		t.Errorf("Want %v got %v", expectRemain, h.state)
+	if !reflect.DeepEqual(expectRemain, h.Beatmaps()) {
+		t.Errorf("Want %v got %v", expectRemain, h.Beatmaps())
 	}
 	if !reflect.DeepEqual(expectRemove, h.dryRun) {
 		t.Errorf("Want %v got %v", expectRemove, h.dryRun)
@@ -71,15 +75,15 @@ func TestCleanupNoMaps(t *testing.T) {
 
 	h := New()
 	h.MaxSize = 10
-	h.state = append(expectRemain, expectRemove...)
+	h.setState(append(expectRemain, expectRemove...))
 	h.dryRun = make([]*CachedBeatmap, 0)
 
 	start := time.Now()
-	h.cleanUp()
+	h.CleanUp()
 	t.Log("cleanup took", time.Since(start))
 
-	if !reflect.DeepEqual(expectRemain, h.state) {
-		t.Errorf("Want %v got %v", expectRemain, h.state)
+	if !reflect.DeepEqual(expectRemain, h.Beatmaps()) {
+		t.Errorf("Want %v got %v", expectRemain, h.Beatmaps())
 	}
 	if !reflect.DeepEqual(expectRemove, h.dryRun) {
 		t.Errorf("Want %v got %v", expectRemove, h.dryRun)
@@ -122,17 +126,107 @@ func TestCleanupEmptyBeatmaps(t *testing.T) {
 
 	h := New()
 	h.MaxSize = 5
-	h.state = append(expectRemain, expectRemove...)
+	h.setState(append(expectRemain, expectRemove...))
 	h.dryRun = make([]*CachedBeatmap, 0)
 
 	start := time.Now()
-	h.cleanUp()
+	h.CleanUp()
 	t.Log("cleanup took", time.Since(start))
 
-	if !reflect.DeepEqual(expectRemain, h.state) {
-		t.Errorf("Want %v got %v", expectRemain, h.state)
+	if !reflect.DeepEqual(expectRemain, h.Beatmaps()) {
+		t.Errorf("Want %v got %v", expectRemain, h.Beatmaps())
 	}
 	if !reflect.DeepEqual(expectRemove, h.dryRun) {
 		t.Errorf("Want %v got %v", expectRemove, h.dryRun)
 	}
 }
+
+func TestWatchCancelsDownload(t *testing.T) {
+	h := New()
+	b, shouldDownload := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	if !shouldDownload {
+		t.Fatal("want to download new beatmap")
+	}
+	dl := b.DownloadContext()
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	b.Watch(ctx1)
+	b.Watch(ctx2)
+
+	cancel1()
+	select {
+	case <-dl.Done():
+		t.Fatal("download cancelled while a client is still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel2()
+	select {
+	case <-dl.Done():
+	case <-time.After(time.Second):
+		t.Fatal("download not cancelled after all the clients went away")
+	}
+
+	err := b.Wait(ctx2)
+	if err != context.Canceled {
+		t.Fatalf("want context.Canceled got %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	h := testHouse(t)
+	dir := h.DataFolders[0]
+	valid := testZip(t, "osu file format v14")
+	files := map[string][]byte{
+		"1.osz":            valid,
+		"2.osz":            valid[:len(valid)/2],
+		"4.osz.123456.tmp": valid[:10],
+		// stored by older versions with the name of the full beatmap
+		"5.osz": valid,
+		// corrupted, but with the expected size: left to Scrub
+		"6.osz": bytes.Repeat([]byte{'x'}, len(valid)),
+	}
+	for name, data := range files {
+		err := ioutil.WriteFile(dir+name, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var state []*CachedBeatmap
+	for id := 1; id <= 6; id++ {
+		size := uint64(len(valid))
+		if id == 4 {
+			// failed download
+			size = 0
+		}
+		state = append(state, &CachedBeatmap{
+			ID:           id,
+			NoVideo:      id == 5,
+			fileSize:     size,
+			isDownloaded: true,
+			DataFolders:  h.DataFolders,
+		})
+	}
+	h.setState(state)
+	rec, err := h.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.TempFiles != 1 || rec.Renamed != 1 || len(rec.Missing) != 1 || rec.Missing[0].ID != 3 ||
+		len(rec.Truncated) != 1 || rec.Truncated[0].ID != 2 {
+		t.Fatalf("unexpected reconciliation %+v", rec)
+	}
+	state = h.Beatmaps()
+	if len(state) != 4 || state[0].ID != 1 || state[1].ID != 4 || state[2].ID != 5 || state[3].ID != 6 {
+		t.Fatalf("unexpected state %v", state)
+	}
+	if _, err := os.Stat(dir + "5n.osz"); err != nil {
+		t.Errorf("beatmap without video not renamed: %v", err)
+	}
+	for _, name := range []string{"2.osz", "4.osz.123456.tmp", "5.osz"} {
+		if _, err := os.Stat(dir + name); !os.IsNotExist(err) {
+			t.Errorf("%s has not been removed", name)
+		}
+	}
+}
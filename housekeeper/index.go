@@ -0,0 +1,469 @@
+package housekeeper
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stateShards is the number of shards of the state. Requests for beatmaps in
+// different shards don't contend for the same lock.
+const stateShards = 64
+
+// stateKey identifies a beatmap in the state.
+type stateKey struct {
+	id      int
+	noVideo bool
+}
+
+type stateShard struct {
+	mtx      sync.RWMutex
+	beatmaps map[stateKey]*CachedBeatmap
+}
+
+// index holds the beatmaps of the state, indexed by set ID and variant, and
+// keeps the downloaded ones of each data folder ordered by eviction priority,
+// so that cleanups don't need to go through the whole state.
+type index struct {
+	shards [stateShards]stateShard
+
+	// mtx protects the queues, the sizes and the queue fields of the
+	// beatmaps. It must not be held while locking a beatmap.
+	mtx        sync.Mutex
+	queues     map[string]*evictionQueue
+	folderSize map[string]uint64
+	totalSize  uint64
+	length     int
+	// files are the files of the downloaded beatmaps, by path: files with
+	// the same content are shared, and their size is counted once.
+	files  map[string]*fileRefs
+	policy EvictionPolicy
+	// pinned are the IDs of the sets which are never evicted.
+	pinned map[int]bool
+}
+
+func newIndex() *index {
+	idx := &index{
+		queues:     make(map[string]*evictionQueue),
+		folderSize: make(map[string]uint64),
+		files:      make(map[string]*fileRefs),
+		policy:     LRU{},
+		pinned:     make(map[int]bool),
+	}
+	for i := range idx.shards {
+		idx.shards[i].beatmaps = make(map[stateKey]*CachedBeatmap)
+	}
+	return idx
+}
+
+func (idx *index) shard(k stateKey) *stateShard {
+	return &idx.shards[uint(k.id)%stateShards]
+}
+
+// get returns the beatmap with the given key, or nil.
+func (idx *index) get(k stateKey) *CachedBeatmap {
+	s := idx.shard(k)
+	s.mtx.RLock()
+	b := s.beatmaps[k]
+	s.mtx.RUnlock()
+	return b
+}
+
+// getOrAdd returns the beatmap with the given key, if any, and false.
+// Otherwise, it calls create to make the beatmap to add, adds it and returns
+// it with true.
+func (idx *index) getOrAdd(k stateKey, create func() *CachedBeatmap) (*CachedBeatmap, bool) {
+	// most of the times, the beatmap is already there.
+	if b := idx.get(k); b != nil {
+		return b, false
+	}
+	s := idx.shard(k)
+	s.mtx.Lock()
+	if b, ok := s.beatmaps[k]; ok {
+		s.mtx.Unlock()
+		return b, false
+	}
+	b := create()
+	s.beatmaps[k] = b
+	idx.mtx.Lock()
+	b.inState = true
+	b.queueIndex = -1
+	idx.length++
+	idx.mtx.Unlock()
+	s.mtx.Unlock()
+
+	idx.update(b)
+	return b, true
+}
+
+// put adds b to the index, replacing the beatmap with the same key, if any.
+func (idx *index) put(b *CachedBeatmap) {
+	k := stateKey{b.ID, b.NoVideo}
+	s := idx.shard(k)
+	s.mtx.Lock()
+	old := s.beatmaps[k]
+	s.beatmaps[k] = b
+	idx.mtx.Lock()
+	if old != nil {
+		idx.unlink(old)
+	}
+	b.inState = true
+	b.queueIndex = -1
+	idx.length++
+	idx.mtx.Unlock()
+	s.mtx.Unlock()
+
+	idx.update(b)
+}
+
+// remove removes b from the index. It returns false if b was not in it.
+func (idx *index) remove(b *CachedBeatmap) bool {
+	k := stateKey{b.ID, b.NoVideo}
+	s := idx.shard(k)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.beatmaps[k] != b {
+		return false
+	}
+	delete(s.beatmaps, k)
+	idx.mtx.Lock()
+	idx.unlink(b)
+	idx.mtx.Unlock()
+	return true
+}
+
+// unlink takes b out of its queue and of the totals. It must be called with
+// idx.mtx held.
+func (idx *index) unlink(b *CachedBeatmap) {
+	if !b.inState {
+		return
+	}
+	idx.dequeue(b)
+	idx.uncount(b)
+	b.countedSize = 0
+	b.countedFile = ""
+	b.inState = false
+	idx.length--
+}
+
+// fileRefs is a file referenced by downloaded beatmaps.
+type fileRefs struct {
+	refs int
+	// size and folder are those counted in the totals, when the first
+	// beatmap referenced the file.
+	size   uint64
+	folder string
+}
+
+// count adds the file of b to the totals, unless another beatmap references
+// it. It must be called with idx.mtx held.
+func (idx *index) count(b *CachedBeatmap) {
+	if b.countedSize == 0 {
+		return
+	}
+	f := idx.files[b.countedFile]
+	if f == nil {
+		f = &fileRefs{size: b.countedSize, folder: b.countedFolder}
+		idx.files[b.countedFile] = f
+		idx.totalSize += f.size
+		idx.folderSize[f.folder] += f.size
+	}
+	f.refs++
+}
+
+// uncount takes the file of b out of the totals, unless another beatmap
+// references it. It must be called with idx.mtx held.
+func (idx *index) uncount(b *CachedBeatmap) {
+	f := idx.files[b.countedFile]
+	if b.countedSize == 0 || f == nil {
+		return
+	}
+	f.refs--
+	if f.refs == 0 {
+		delete(idx.files, b.countedFile)
+		idx.totalSize -= f.size
+		idx.folderSize[f.folder] -= f.size
+	}
+}
+
+// references returns the number of downloaded beatmaps in the index whose file
+// has the given path.
+func (idx *index) references(path string) int {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	if f := idx.files[path]; f != nil {
+		return f.refs
+	}
+	return 0
+}
+
+// freed returns the number of bytes freed by removing b, which is 0 if other
+// beatmaps reference its file. It must be called with idx.mtx held.
+func (idx *index) freed(b *CachedBeatmap) uint64 {
+	if f := idx.files[b.countedFile]; f != nil && f.refs > 1 {
+		return 0
+	}
+	return b.countedSize
+}
+
+// dequeue takes b out of its queue, if any. It must be called with idx.mtx
+// held.
+func (idx *index) dequeue(b *CachedBeatmap) {
+	if b.queueIndex >= 0 {
+		heap.Remove(idx.queues[b.countedFolder], b.queueIndex)
+	}
+}
+
+// update must be called whenever the size, the folder, the download status or
+// the last request of b change, to keep the queues and the totals up to date.
+func (idx *index) update(b *CachedBeatmap) {
+	b.mtx.Lock()
+	size := b.fileSize
+	if !b.isDownloaded {
+		size = 0
+	}
+	folder := b.folder
+	file := folder + b.name()
+	a := b.access()
+	b.snapshots++
+	snapshot := b.snapshots
+	b.mtx.Unlock()
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	// concurrent updates can get here in any order: the fields read by an
+	// older one must not replace those read by a newer one.
+	if !b.inState || snapshot < b.applied {
+		return
+	}
+	b.applied = snapshot
+	tier, priority := idx.policy.Priority(a)
+	idx.uncount(b)
+	if folder != b.countedFolder {
+		idx.dequeue(b)
+	}
+	b.countedSize = size
+	b.countedFolder = folder
+	b.countedFile = file
+	idx.count(b)
+	switch {
+	case size == 0 || idx.pinned[b.ID]:
+		// beatmaps which failed to download take no space, and pinned ones
+		// are never evicted.
+		idx.dequeue(b)
+	case b.queueIndex >= 0:
+		b.tier, b.priority = tier, priority
+		heap.Fix(idx.queues[folder], b.queueIndex)
+	default:
+		b.tier, b.priority = tier, priority
+		q := idx.queues[folder]
+		if q == nil {
+			q = &evictionQueue{}
+			idx.queues[folder] = q
+		}
+		heap.Push(q, b)
+	}
+}
+
+// contains tells whether b is in the index.
+func (idx *index) contains(b *CachedBeatmap) bool {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	return b.inState
+}
+
+// evict removes from the index the beatmaps with the lowest priority until
+// their size is at least the given number of bytes, and returns them.
+func (idx *index) evict(bytes uint64) []*CachedBeatmap {
+	return idx.evictFrom(bytes, func() *CachedBeatmap {
+		var first *CachedBeatmap
+		for _, q := range idx.queues {
+			if q.Len() > 0 && (first == nil || q.less((*q)[0], first)) {
+				first = (*q)[0]
+			}
+		}
+		return first
+	})
+}
+
+// evictFolder is like evict, but only removes the beatmaps in folder.
+func (idx *index) evictFolder(folder string, bytes uint64) []*CachedBeatmap {
+	return idx.evictFrom(bytes, func() *CachedBeatmap {
+		q := idx.queues[folder]
+		if q == nil || q.Len() == 0 {
+			return nil
+		}
+		return (*q)[0]
+	})
+}
+
+// evictFrom removes the beatmaps returned by first, which is called with
+// idx.mtx held, until they free at least the given number of bytes. Removing
+// a beatmap whose file other beatmaps share frees nothing.
+func (idx *index) evictFrom(bytes uint64, first func() *CachedBeatmap) []*CachedBeatmap {
+	var removed []*CachedBeatmap
+	for freed := uint64(0); freed < bytes; {
+		idx.mtx.Lock()
+		b := first()
+		if b == nil {
+			idx.mtx.Unlock()
+			break
+		}
+		freed += idx.freed(b)
+		policy, priority := idx.policy, b.priority
+		idx.mtx.Unlock()
+
+		// remove locks the shard, which must be done before locking idx.mtx
+		if idx.remove(b) {
+			policy.Evicted(priority)
+			removed = append(removed, b)
+			continue
+		}
+		idx.mtx.Lock()
+		idx.dequeue(b)
+		idx.mtx.Unlock()
+	}
+	return removed
+}
+
+// request records that b has been requested at t.
+func (idx *index) request(b *CachedBeatmap, t time.Time) {
+	idx.mtx.Lock()
+	policy := idx.policy
+	idx.mtx.Unlock()
+	b.mtx.Lock()
+	b.requests = policy.Frequency(b.access(), t)
+	b.lastRequested = t
+	b.mtx.Unlock()
+	idx.update(b)
+}
+
+// setPolicy sets the eviction policy, and sorts the queues again.
+func (idx *index) setPolicy(p EvictionPolicy) {
+	idx.mtx.Lock()
+	idx.policy = p
+	idx.mtx.Unlock()
+	for _, b := range idx.all() {
+		idx.update(b)
+	}
+}
+
+// pin makes the beatmaps of the set with the given ID never be evicted, or
+// evictable again.
+func (idx *index) pin(id int, pinned bool) {
+	idx.mtx.Lock()
+	if pinned {
+		idx.pinned[id] = true
+	} else {
+		delete(idx.pinned, id)
+	}
+	idx.mtx.Unlock()
+	for _, noVideo := range []bool{false, true} {
+		if b := idx.get(stateKey{id, noVideo}); b != nil {
+			idx.update(b)
+		}
+	}
+}
+
+// size returns the total size of the downloaded beatmaps and their number.
+func (idx *index) size() (totalSize uint64, length int) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	return idx.totalSize, idx.length
+}
+
+// folderUsage returns the size of the downloaded beatmaps in folder.
+func (idx *index) folderUsage(folder string) uint64 {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	return idx.folderSize[folder]
+}
+
+// all returns all the beatmaps in the index, sorted by ID, with the full
+// beatmap before the one without video.
+func (idx *index) all() []*CachedBeatmap {
+	var bms []*CachedBeatmap
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mtx.RLock()
+		for _, b := range s.beatmaps {
+			bms = append(bms, b)
+		}
+		s.mtx.RUnlock()
+	}
+	sort.Slice(bms, func(i, j int) bool {
+		if bms[i].ID != bms[j].ID {
+			return bms[i].ID < bms[j].ID
+		}
+		return !bms[i].NoVideo && bms[j].NoVideo
+	})
+	return bms
+}
+
+// removable returns the downloaded beatmaps, in the order in which they are
+// evicted.
+func (idx *index) removable() []*CachedBeatmap {
+	idx.mtx.Lock()
+	var q evictionQueue
+	for _, fq := range idx.queues {
+		q = append(q, *fq...)
+	}
+	idx.mtx.Unlock()
+	sort.SliceStable(q, func(i, j int) bool { return q.less(q[i], q[j]) })
+	return q
+}
+
+// inFolder returns the downloaded beatmaps in folder, in the order in which
+// they are evicted.
+func (idx *index) inFolder(folder string) []*CachedBeatmap {
+	idx.mtx.Lock()
+	var q evictionQueue
+	if fq := idx.queues[folder]; fq != nil {
+		q = append(q, *fq...)
+	}
+	idx.mtx.Unlock()
+	sort.SliceStable(q, func(i, j int) bool { return q.less(q[i], q[j]) })
+	return q
+}
+
+// evictionQueue is a min-heap of beatmaps, ordered by priority: the first
+// beatmap is the first to be evicted.
+type evictionQueue []*CachedBeatmap
+
+func (q evictionQueue) less(a, b *CachedBeatmap) bool {
+	if a.tier != b.tier {
+		return a.tier < b.tier
+	}
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	if a.ID != b.ID {
+		return a.ID < b.ID
+	}
+	return !a.NoVideo && b.NoVideo
+}
+
+func (q evictionQueue) Len() int           { return len(q) }
+func (q evictionQueue) Less(i, j int) bool { return q.less(q[i], q[j]) }
+
+func (q evictionQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *evictionQueue) Push(x interface{}) {
+	b := x.(*CachedBeatmap)
+	b.queueIndex = len(*q)
+	*q = append(*q, b)
+}
+
+func (q *evictionQueue) Pop() interface{} {
+	old := *q
+	b := old[len(old)-1]
+	old[len(old)-1] = nil
+	b.queueIndex = -1
+	*q = old[:len(old)-1]
+	return b
+}
@@ -0,0 +1,138 @@
+package housekeeper
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIndexEvictionOrder(t *testing.T) {
+	h := New()
+	base := time.Date(2017, 4, 5, 15, 5, 3, 0, time.UTC)
+	var state []*CachedBeatmap
+	for id := 1; id <= 5; id++ {
+		state = append(state, &CachedBeatmap{
+			ID:            id,
+			lastRequested: base.Add(time.Duration(id) * time.Hour),
+			fileSize:      10,
+			isDownloaded:  true,
+		})
+	}
+	h.setState(state)
+	if size, length := h.index.size(); size != 50 || length != 5 {
+		t.Fatalf("want 50 bytes in 5 beatmaps got %d in %d", size, length)
+	}
+
+	// requesting the oldest beatmap moves it to the back of the queue
+	state[0].SetLastRequested(base.Add(10 * time.Hour))
+	_, removable := h.StateSizeAndRemovableMaps()
+	want := []*CachedBeatmap{state[1], state[2], state[3], state[4], state[0]}
+	if !reflect.DeepEqual(removable, want) {
+		t.Fatalf("want %v got %v", want, removable)
+	}
+
+	removed := h.index.evict(15)
+	if !reflect.DeepEqual(removed, want[:2]) {
+		t.Fatalf("want %v got %v", want[:2], removed)
+	}
+	if size, length := h.index.size(); size != 30 || length != 3 {
+		t.Fatalf("want 30 bytes in 3 beatmaps got %d in %d", size, length)
+	}
+	if h.Beatmap(2, false) != nil || h.Beatmap(4, false) != state[3] {
+		t.Fatal("evicted beatmaps still in the state")
+	}
+}
+
+func TestIndexReplace(t *testing.T) {
+	h := New()
+	h.setState([]*CachedBeatmap{
+		{ID: 1, fileSize: 10, isDownloaded: true},
+		{ID: 1, NoVideo: true, fileSize: 5, isDownloaded: true},
+	})
+	h.index.put(&CachedBeatmap{ID: 1, fileSize: 20, isDownloaded: true})
+	if size, length := h.index.size(); size != 25 || length != 2 {
+		t.Fatalf("want 25 bytes in 2 beatmaps got %d in %d", size, length)
+	}
+	if len(h.index.removable()) != 2 {
+		t.Fatalf("replaced beatmap still in the eviction queue")
+	}
+}
+
+// benchmarkState fills the state of h with n downloaded beatmaps.
+func benchmarkState(h *House, n int) {
+	base := time.Now().Add(-time.Hour)
+	state := make([]*CachedBeatmap, n)
+	for i := range state {
+		state[i] = &CachedBeatmap{
+			ID:            i + 1,
+			lastRequested: base.Add(time.Duration(i) * time.Millisecond),
+			fileSize:      1024,
+			isDownloaded:  true,
+		}
+	}
+	h.setState(state)
+}
+
+func BenchmarkAcquireBeatmap(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			h := New()
+			benchmarkState(h, n)
+			var next int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := int(atomic.AddInt64(&next, 1))%n + 1
+					bm, _ := h.AcquireBeatmap(&CachedBeatmap{ID: id})
+					bm.SetLastRequested(time.Now())
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCleanUp(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				h := New()
+				benchmarkState(h, n)
+				// evict a tenth of the cache
+				h.MaxSize = uint64(n) * 1024 * 9 / 10
+				h.dryRun = make([]*CachedBeatmap, 0)
+				b.StartTimer()
+				h.CleanUp()
+			}
+		})
+	}
+}
+
+func TestIndexConcurrentUpdates(t *testing.T) {
+	h := testHouse(t)
+	for i := 1; i <= 200; i++ {
+		b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: i})
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				b.SetLastRequested(time.Now())
+			}()
+		}
+		close(start)
+		b.finishDownload(h, 10, nil)
+		wg.Wait()
+		if size, _ := h.index.size(); size != uint64(i)*10 {
+			t.Fatalf("want %d bytes got %d", i*10, size)
+		}
+		if len(h.index.removable()) != i {
+			t.Fatalf("beatmap %d not in the eviction queue", i)
+		}
+	}
+}
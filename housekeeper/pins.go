@@ -0,0 +1,70 @@
+package housekeeper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Pin protects the beatmaps of the set with the given ID from eviction, even
+// if they are not in the cache yet.
+func (h *House) Pin(id int) error {
+	h.index.pin(id, true)
+	return h.savePins()
+}
+
+// Unpin lets the beatmaps of the set with the given ID be evicted again.
+func (h *House) Unpin(id int) error {
+	h.index.pin(id, false)
+	return h.savePins()
+}
+
+// Pinned returns the IDs of the pinned sets, sorted.
+func (h *House) Pinned() []int {
+	h.index.mtx.Lock()
+	ids := make([]int, 0, len(h.index.pinned))
+	for id := range h.index.pinned {
+		ids = append(ids, id)
+	}
+	h.index.mtx.Unlock()
+	sort.Ints(ids)
+	return ids
+}
+
+// SetEviction sets the policy deciding which beatmaps are evicted first.
+func (h *House) SetEviction(p EvictionPolicy) {
+	h.index.setPolicy(p)
+}
+
+// loadPins reads the pinned sets from h.PinsFile.
+func (h *House) loadPins() error {
+	data, err := ioutil.ReadFile(h.PinsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var ids []int
+	err = json.Unmarshal(data, &ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		h.index.pin(id, true)
+	}
+	return nil
+}
+
+// savePins writes the pinned sets to h.PinsFile. They are read with the file
+// locked, so that concurrent saves can't write an older set last.
+func (h *House) savePins() error {
+	h.pinsFileMtx.Lock()
+	defer h.pinsFileMtx.Unlock()
+	data, err := json.Marshal(h.Pinned())
+	if err != nil {
+		return err
+	}
+	return writeFile(h.PinsFile, data)
+}
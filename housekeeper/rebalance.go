@@ -0,0 +1,215 @@
+package housekeeper
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// isTarget tells whether the beatmaps of src can be moved to f: with the
+// tiered placement, beatmaps are only moved to the cold folders.
+func (h *House) isTarget(src Folder) func(Folder) bool {
+	return func(f Folder) bool {
+		return f.Path != src.Path && (h.Placement != PlaceTiered || f.Cold)
+	}
+}
+
+// roomFor returns the free space in the folders where the beatmaps of src can
+// be moved.
+func (h *House) roomFor(src Folder) uint64 {
+	isTarget := h.isTarget(src)
+	room := uint64(0)
+	for _, f := range h.folders() {
+		if !isTarget(f) {
+			continue
+		}
+		free := h.free(f)
+		if room+free < room {
+			// overflow: the room is unlimited
+			return free
+		}
+		room += free
+	}
+	return room
+}
+
+// scheduleRebalance enschedules a run of the rebalancer if one isn't already
+// present.
+func (h *House) scheduleRebalance() {
+	select {
+	case h.rebalanceChan <- struct{}{}:
+	default:
+	}
+}
+
+// StartRebalancer starts the process that runs Rebalance every
+// RebalanceInterval, and every time the cleanup finds a folder over its quota.
+func (h *House) StartRebalancer() {
+	go func() {
+		var tick <-chan time.Time
+		if h.RebalanceInterval > 0 {
+			t := time.NewTicker(h.RebalanceInterval)
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			select {
+			case <-tick:
+			case <-h.rebalanceChan:
+			}
+			_, err := h.Rebalance(context.Background())
+			if err != nil {
+				logError(err)
+			}
+		}
+	}()
+}
+
+// Rebalance moves beatmaps between the data folders: out of the folders over
+// their quota, into those with room for them, and, with the tiered placement,
+// from the hot folders to the cold ones when they have not been requested for
+// ColdAfter. It returns the number of beatmaps moved.
+func (h *House) Rebalance(ctx context.Context) (int, error) {
+	folders := h.folders()
+	hasCold := false
+	for _, f := range folders {
+		hasCold = hasCold || f.Cold
+	}
+
+	moved := 0
+	for _, src := range folders {
+		over := h.overQuota(src)
+		var coldBefore time.Time
+		if h.Placement == PlaceTiered && !src.Cold && hasCold && h.ColdAfter > 0 {
+			coldBefore = time.Now().Add(-h.ColdAfter)
+		}
+		if over == 0 && coldBefore.IsZero() {
+			continue
+		}
+
+		isTarget := h.isTarget(src)
+		for _, b := range h.index.inFolder(src.Path) {
+			// the beatmaps are in the order in which they are evicted,
+			// which is not always that of their last request.
+			if over == 0 && !b.LastRequested().Before(coldBefore) {
+				continue
+			}
+			size := b.FileSize()
+			dst := h.mostFree(size, isTarget)
+			if dst == "" {
+				break
+			}
+			ok, err := h.move(b, src.Path, dst)
+			if err != nil {
+				logError(err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			moved++
+			if over > size {
+				over -= size
+			} else {
+				over = 0
+			}
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+		}
+	}
+
+	if moved > 0 {
+		log.Println("[C] Rebalanced", moved, "beatmaps")
+		return moved, h.SaveState()
+	}
+	return moved, nil
+}
+
+// move moves the file of b from src to dst. It returns false if b is not in
+// src anymore, or is being downloaded. The file is copied, so that it can be
+// served until the copy is complete, and the folders can be on different
+// disks. If dst already holds the same content, b references that file.
+func (h *House) move(b *CachedBeatmap, src, dst string) (bool, error) {
+	name := b.storedName()
+	var tmp *os.File
+	if !h.hold(dst, name) {
+		var err error
+		tmp, err = copyToTemp(b, src+name, dst)
+		if err != nil {
+			h.unhold(dst, name)
+			return false, err
+		}
+	}
+
+	// the file is only put in place if b has not changed meanwhile, so that
+	// a new download is never overwritten.
+	var err error
+	b.mtx.Lock()
+	ok := b.folder == src && b.name() == name && b.stream == nil && b.isDownloaded
+	if ok && tmp != nil {
+		err = os.Rename(tmp.Name(), dst+name)
+		ok = err == nil
+	}
+	if ok {
+		b.folder = dst
+	}
+	b.mtx.Unlock()
+	if !ok {
+		if tmp != nil {
+			os.Remove(tmp.Name())
+		}
+		h.unhold(dst, name)
+		return false, err
+	}
+	if tmp != nil {
+		syncDir(filepath.Dir(dst + name))
+	}
+	h.index.update(b)
+
+	// if b was evicted during the copy, the file is removed unless other
+	// beatmaps reference it.
+	h.unhold(dst, name)
+	return true, h.release(src, name)
+}
+
+// copyToTemp copies the file at path to a temporary file of b in folder,
+// which is returned closed.
+func copyToTemp(b *CachedBeatmap, path, folder string) (*os.File, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	tmp, err := b.createTempFile(folder)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// syncDir makes the renames in the folder durable.
+func syncDir(folder string) error {
+	dir, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	dir.Close()
+	return err
+}
@@ -0,0 +1,140 @@
+package housekeeper
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Reconciliation is the outcome of Reconcile.
+type Reconciliation struct {
+	// TempFiles is the number of temporary files left by downloads which
+	// had not been completed, and which have been removed.
+	TempFiles int
+	// Renamed is the number of beatmaps without video which were stored with
+	// the name of the full beatmap by older versions, and have been renamed.
+	Renamed int
+	// Missing are the beatmaps in the state whose file does not exist.
+	Missing []*CachedBeatmap
+	// Truncated are the beatmaps in the state whose file does not have the
+	// expected size.
+	Truncated []*CachedBeatmap
+}
+
+// Reconcile recovers the cache after a crash. It must be called after
+// LoadState, before any beatmap is downloaded: the temporary files of
+// downloads are removed from the data folders, and the beatmaps whose file is
+// missing or truncated are removed from the state, so that they are downloaded
+// again. Only the size of the files in the data folders is checked, so that
+// the server can start quickly: their content is verified by Scrub.
+func (h *House) Reconcile() (Reconciliation, error) {
+	var rec Reconciliation
+	for _, folder := range h.DataFolders {
+		files, err := ioutil.ReadDir(folder)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return rec, err
+		}
+		for _, f := range files {
+			if f.IsDir() || !strings.HasSuffix(f.Name(), ".tmp") {
+				continue
+			}
+			err = os.Remove(folder + f.Name())
+			if err != nil {
+				return rec, err
+			}
+			rec.TempFiles++
+		}
+	}
+
+	for _, b := range h.index.all() {
+		// beatmaps which could not be downloaded have no file.
+		if !b.IsDownloaded() || b.FileSize() == 0 {
+			continue
+		}
+		renamed, err := renameLegacyFile(b)
+		if err != nil {
+			logError(err)
+		}
+		if renamed {
+			rec.Renamed++
+		}
+		err = h.checkFile(b)
+		switch {
+		case os.IsNotExist(err):
+			rec.Missing = append(rec.Missing, b)
+			h.index.remove(b)
+		case err == nil:
+		default:
+			rec.Truncated = append(rec.Truncated, b)
+			h.index.remove(b)
+			err = b.removeFile()
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+
+	if rec.Renamed > 0 {
+		log.Println("[C] Renamed", rec.Renamed, "beatmaps without video")
+	}
+	if len(rec.Missing) > 0 || len(rec.Truncated) > 0 {
+		log.Println("[C] Reconciled state:", len(rec.Missing), "missing and",
+			len(rec.Truncated), "truncated beatmaps removed")
+		return rec, h.SaveState()
+	}
+	return rec, nil
+}
+
+// renameLegacyFile moves the file of a beatmap without video from <id>.osz,
+// where older versions stored it, to its own name.
+func renameLegacyFile(b *CachedBeatmap) (bool, error) {
+	if !b.NoVideo || b.Hash() != "" {
+		return false, nil
+	}
+	legacy := strconv.Itoa(b.ID) + ".osz"
+	for _, folder := range b.DataFolders {
+		if _, err := os.Stat(folder + b.FileName()); err == nil {
+			return false, nil
+		}
+	}
+	for _, folder := range b.DataFolders {
+		_, err := os.Stat(folder + legacy)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, os.Rename(folder+legacy, folder+b.FileName())
+	}
+	return false, nil
+}
+
+var errTruncated = errors.New("cheesegull/housekeeper: beatmap does not have the expected size")
+
+// checkFile checks that the file of the beatmap has the size recorded in the
+// state. The files in the Storage of the house are not checked, as they are
+// stored at once.
+func (h *House) checkFile(b *CachedBeatmap) error {
+	folder := b.Folder()
+	if folder == "" {
+		return os.ErrNotExist
+	}
+	if _, local := h.storage(folder).(Local); !local {
+		return nil
+	}
+	stat, err := os.Stat(folder + b.storedName())
+	if err != nil {
+		return err
+	}
+	if uint64(stat.Size()) != b.FileSize() {
+		return errTruncated
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package housekeeper
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Stale tells whether a newer version of the beatmap than the one in the cache
+// is known to exist upstream.
+func (c *CachedBeatmap) Stale() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.upstream.After(c.LastUpdate)
+}
+
+// Refreshing tells whether the newer version of the beatmap is being
+// downloaded in the background.
+func (c *CachedBeatmap) Refreshing() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.refresh != nil
+}
+
+// SetUpdated tells the house that the set with the given ID has been updated
+// upstream at lastUpdate. Its beatmaps in the cache, if any, are marked as
+// stale and, with RefreshUpdated, the new version is downloaded in the
+// background right away; otherwise this happens at their next request. The
+// old version is served until the new one is complete and valid.
+func (h *House) SetUpdated(id int, lastUpdate time.Time) {
+	for _, noVideo := range []bool{false, true} {
+		b := h.index.get(stateKey{id, noVideo})
+		if b == nil {
+			continue
+		}
+		b.mtx.Lock()
+		stale := b.isDownloaded && b.LastUpdate.Before(lastUpdate)
+		if stale && b.upstream.Before(lastUpdate) {
+			b.upstream = lastUpdate
+		}
+		b.mtx.Unlock()
+		if stale && h.RefreshUpdated {
+			h.refresh(b, lastUpdate)
+		}
+	}
+}
+
+// refresh starts downloading in the background, with Fetch, the version of b
+// updated at lastUpdate, while the file in the cache keeps being served. It
+// returns false if it can't, for instance because b is already being
+// downloaded, or the latest refresh failed less than FailureBackoff ago.
+func (h *House) refresh(b *CachedBeatmap, lastUpdate time.Time) bool {
+	if h.Fetch == nil {
+		return false
+	}
+	b.mtx.Lock()
+	if b.upstream.Before(lastUpdate) {
+		b.upstream = lastUpdate
+	}
+	if b.refresh != nil || b.stream != nil || !b.isDownloaded || b.fileSize == 0 ||
+		time.Since(b.refreshFailed) < h.FailureBackoff {
+		b.mtx.Unlock()
+		return false
+	}
+	// the new version is downloaded as a beatmap which is not in the state,
+	// and replaces the file of b once committed.
+	n := &CachedBeatmap{
+		ID:           b.ID,
+		NoVideo:      b.NoVideo,
+		LastUpdate:   lastUpdate,
+		RankedStatus: b.RankedStatus,
+		DataFolders:  b.DataFolders,
+		replaces:     b,
+	}
+	n.startDownload(h)
+	b.refresh = n
+	b.mtx.Unlock()
+
+	log.Println("[⬇️][🔄] Refreshing", b.String())
+	go h.Fetch(n)
+	return true
+}
+
+// finishRefresh is called instead of finishDownload once the download of n,
+// the new version of the beatmap n.replaces, is over. If it succeeded, the
+// file of n, already committed, becomes that of the beatmap.
+func (h *House) finishRefresh(n *CachedBeatmap, fileSize uint64, err error) {
+	b := n.replaces
+	if err != nil {
+		b.mtx.Lock()
+		b.refresh = nil
+		if !errors.Is(err, context.Canceled) {
+			b.refreshFailed = time.Now()
+		}
+		b.mtx.Unlock()
+		log.Println("[⬇️][❌] Refresh failed:", b.String(), err)
+		return
+	}
+
+	n.mtx.RLock()
+	folder, name, hash := n.folder, n.name(), n.hash
+	n.mtx.RUnlock()
+
+	b.mtx.Lock()
+	old, oldName := b.folder, b.name()
+	// b may have been downloaded again meanwhile, for instance because its
+	// file was corrupted.
+	ok := b.stream == nil && b.isDownloaded
+	if ok {
+		b.folder = folder
+		b.hash = hash
+		b.fileSize = fileSize
+		b.LastUpdate = n.LastUpdate
+		b.verified = time.Time{}
+	}
+	b.refresh = nil
+	b.mtx.Unlock()
+	if !ok {
+		// the new file is removed once the stream stops holding it.
+		return
+	}
+	h.index.update(b)
+	if old != "" && old+oldName != folder+name {
+		h.release(old, oldName)
+	}
+	if !h.index.contains(b) {
+		// evicted during the download: the new file is removed once the
+		// stream stops holding it.
+		return
+	}
+	if oldName == name {
+		log.Println("[⬇️][🔄] Same content:", b.String())
+	}
+
+	log.Println("[⬇️][🔄] Refreshed", b.String())
+	err = h.SaveState()
+	if err != nil {
+		logError(err)
+	}
+	h.scheduleCleanup()
+}
@@ -0,0 +1,98 @@
+package housekeeper
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// readTestFile returns the content of the file of b.
+func readTestFile(t *testing.T, b *CachedBeatmap) []byte {
+	data, err := ioutil.ReadFile(b.Folder() + b.storedName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRefreshUpdated(t *testing.T) {
+	h := testHouse(t)
+	oldZip, newZip := testZip(t, "old"), testZip(t, "new version")
+	b := storeTestFile(t, h, 1, oldZip)
+	b.LastUpdate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	updated := b.LastUpdate.Add(24 * time.Hour)
+
+	proceed, done := make(chan struct{}), make(chan error)
+	h.Fetch = func(n *CachedBeatmap) {
+		<-proceed
+		s := n.Stream()
+		err := s.Start(int64(len(newZip)))
+		if err == nil {
+			s.Write(newZip)
+			err = s.Commit()
+		}
+		done <- err
+	}
+
+	// without RefreshUpdated, the beatmap is only marked as stale.
+	h.SetUpdated(1, updated)
+	if !b.Stale() || b.Refreshing() {
+		t.Fatal("want beatmap stale and not refreshing")
+	}
+
+	// the next request gets the old version while the new one is downloaded.
+	got, download := h.AcquireBeatmap(&CachedBeatmap{ID: 1, LastUpdate: updated})
+	if got != b || download || b.Stream() != nil {
+		t.Fatal("old version not served")
+	}
+	if !b.Refreshing() {
+		t.Fatal("new version not being downloaded")
+	}
+	if !bytes.Equal(readTestFile(t, b), oldZip) {
+		t.Fatal("old file replaced before the download is complete")
+	}
+
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if b.Stale() || b.Refreshing() || !b.LastUpdate.Equal(updated) {
+		t.Fatalf("beatmap not refreshed: %v", b)
+	}
+	if b.FileSize() != uint64(len(newZip)) || !bytes.Equal(readTestFile(t, b), newZip) {
+		t.Fatal("file not replaced by the new version")
+	}
+}
+
+func TestRefreshFailed(t *testing.T) {
+	h := testHouse(t)
+	h.RefreshUpdated = true
+	oldZip := testZip(t, "old")
+	b := storeTestFile(t, h, 1, oldZip)
+	updated := time.Now()
+
+	fetched := make(chan struct{}, 2)
+	h.Fetch = func(n *CachedBeatmap) {
+		n.Stream().Abort(errors.New("mirror down"))
+		fetched <- struct{}{}
+	}
+	h.SetUpdated(1, updated)
+	select {
+	case <-fetched:
+	case <-time.After(time.Second):
+		t.Fatal("new version not downloaded right away")
+	}
+	if !b.IsDownloaded() || !b.Stale() || !bytes.Equal(readTestFile(t, b), oldZip) {
+		t.Fatal("old version lost after a failed refresh")
+	}
+	if h.Failure(1, false) != nil {
+		t.Fatal("failed refresh recorded as a failed download")
+	}
+
+	// not attempted again before FailureBackoff
+	if h.refresh(b, updated) {
+		t.Fatal("refresh attempted again right away")
+	}
+}
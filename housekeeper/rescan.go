@@ -0,0 +1,448 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRescanRunning is returned by Rescan when a scan of the data folders is
+// already running.
+var ErrRescanRunning = errors.New("cheesegull/housekeeper: a rescan is already running")
+
+// rescanBatch is the number of files handled by Rescan between two pauses.
+const rescanBatch = 256
+
+// RescanEntry is a beatmap found in a discrepancy by Rescan.
+type RescanEntry struct {
+	ID      int  `json:"id"`
+	NoVideo bool `json:"no_video"`
+	// Size is the size of the file, or of the beatmap in the state if the
+	// file vanished.
+	Size uint64 `json:"size"`
+}
+
+// RescanReport is the outcome of Rescan.
+type RescanReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Files is the number of beatmap files found in the data folders.
+	Files int `json:"files"`
+	// Adopted are the files which were not in the state, and have been added
+	// to it.
+	Adopted []RescanEntry `json:"adopted"`
+	// Vanished are the beatmaps in the state whose file does not exist, and
+	// which have been removed from it.
+	Vanished []RescanEntry `json:"vanished"`
+	// Resized are the beatmaps whose size in the state was not that of their
+	// file, and has been corrected.
+	Resized []RescanEntry `json:"resized"`
+	// Removed are the files named after their content which no beatmap
+	// referenced, and which could not be adopted.
+	Removed []string `json:"removed"`
+}
+
+func (r *RescanReport) changed() bool {
+	return len(r.Adopted) > 0 || len(r.Vanished) > 0 || len(r.Resized) > 0
+}
+
+// parseFileName parses the name of the file of a beatmap, as returned by
+// FileName.
+func parseFileName(name string) (id int, noVideo bool, ok bool) {
+	if !strings.HasSuffix(name, ".osz") {
+		return 0, false, false
+	}
+	name = strings.TrimSuffix(name, ".osz")
+	noVideo = strings.HasSuffix(name, "n")
+	id, err := strconv.Atoi(strings.TrimSuffix(name, "n"))
+	if err != nil || id <= 0 {
+		return 0, false, false
+	}
+	return id, noVideo, true
+}
+
+// parseContentName parses the name of a file named after its content, as
+// returned by contentName.
+func parseContentName(name string) (hash string, ok bool) {
+	if !strings.HasSuffix(name, ".osz") {
+		return "", false
+	}
+	hash = strings.TrimSuffix(name, ".osz")
+	if len(hash) != 2*sha256.Size {
+		return "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil || strings.ToLower(hash) != hash {
+		return "", false
+	}
+	return hash, true
+}
+
+// metadataSetID returns the BeatmapSetID of the .osu file read from r, or 0 if
+// it has none.
+func metadataSetID(r io.Reader) int {
+	inMetadata := false
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			if inMetadata {
+				return 0
+			}
+			inMetadata = line == "[Metadata]"
+			continue
+		}
+		if inMetadata && strings.HasPrefix(line, "BeatmapSetID:") {
+			id, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "BeatmapSetID:")))
+			return id
+		}
+	}
+	return 0
+}
+
+// zipSetID returns the first BeatmapSetID of the .osu files in zr, or 0 if
+// none has one.
+func zipSetID(zr *zip.Reader) (int, error) {
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".osu") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return 0, err
+		}
+		id := metadataSetID(rc)
+		rc.Close()
+		if id > 0 {
+			return id, nil
+		}
+	}
+	return 0, nil
+}
+
+// contentKey returns the beatmap of the file with the given name in folder,
+// which has the given size and is named after its content, with the given
+// hash: the set is read from the .osu files, and the file is taken as the
+// beatmap without video unless it holds one, as it is not known whether the
+// set has one. ok is false if the content does not match the hash, or
+// does not tell the set.
+func (h *House) contentKey(folder, name, hash string, size int64) (k stateKey, ok bool, err error) {
+	f, err := h.storage(folder).Open(name)
+	if err != nil {
+		return k, false, err
+	}
+	defer f.Close()
+	sum, err := hashFile(f)
+	if err != nil || sum != hash {
+		return k, false, err
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return k, false, nil
+	}
+	// the errors reading the zip are those of its content.
+	k.id, err = zipSetID(zr)
+	if err != nil || k.id <= 0 {
+		return k, false, nil
+	}
+	videos, err := Videos(zr)
+	if err != nil {
+		return k, false, nil
+	}
+	k.noVideo = len(videos) == 0
+	return k, true, nil
+}
+
+// Rescan makes the state match the files in the data folders, for instance
+// after the state file has been lost: the files which are not in the state are
+// adopted, with their size and their modification time as the time they were
+// last requested, and the beatmaps whose file vanished are removed from the
+// state. The files named after their content which no beatmap references are
+// adopted as the beatmap found in them by contentKey, or removed from the data
+// folders if they can't be. The data folders are read in batches, sleeping RescanPause between
+// them, so that a large cache can be scanned while serving requests.
+func (h *House) Rescan(ctx context.Context) (*RescanReport, error) {
+	h.rescanMtx.Lock()
+	if h.rescanning {
+		h.rescanMtx.Unlock()
+		return nil, ErrRescanRunning
+	}
+	h.rescanning = true
+	h.rescanMtx.Unlock()
+
+	rep := &RescanReport{Started: time.Now()}
+	err := h.rescan(ctx, rep)
+	rep.Finished = time.Now()
+	if err == nil && rep.changed() {
+		err = h.SaveState()
+	}
+
+	h.rescanMtx.Lock()
+	h.rescanning = false
+	if err == nil {
+		h.lastRescan = rep
+	}
+	h.rescanMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("[C] Rescan:", rep.Files, "files,", len(rep.Adopted), "adopted,",
+		len(rep.Vanished), "vanished and", len(rep.Resized), "resized beatmaps,",
+		len(rep.Removed), "removed files")
+	return rep, nil
+}
+
+// StartRescan runs Rescan in the background. It returns false if a rescan is
+// already running.
+func (h *House) StartRescan() bool {
+	h.rescanMtx.Lock()
+	running := h.rescanning
+	h.rescanMtx.Unlock()
+	if running {
+		return false
+	}
+	go func() {
+		_, err := h.Rescan(context.Background())
+		if err != nil && err != ErrRescanRunning {
+			logError(err)
+		}
+	}()
+	return true
+}
+
+// LastRescan returns the report of the latest rescan, or nil if none has been
+// completed, and whether one is running.
+func (h *House) LastRescan() (rep *RescanReport, running bool) {
+	h.rescanMtx.Lock()
+	defer h.rescanMtx.Unlock()
+	return h.lastRescan, h.rescanning
+}
+
+// pause sleeps RescanPause between two batches of a rescan.
+func (h *House) pause(ctx context.Context) error {
+	return sleep(ctx, h.RescanPause)
+}
+
+func (h *House) rescan(ctx context.Context, rep *RescanReport) error {
+	seen := make(map[stateKey]bool)
+	for _, folder := range h.DataFolders {
+		err := h.rescanFolder(ctx, folder, seen, rep)
+		if err != nil {
+			return err
+		}
+	}
+	if h.Storage != nil {
+		err := h.rescanStorage(ctx, seen, rep)
+		if err != nil {
+			return err
+		}
+	}
+
+	state := h.index.all()
+	for i, b := range state {
+		if i > 0 && i%rescanBatch == 0 {
+			if err := h.pause(ctx); err != nil {
+				return err
+			}
+		}
+		// beatmaps which could not be downloaded have no file.
+		// the files named after their content are not found by the name of
+		// their beatmap.
+		found := seen[stateKey{b.ID, b.NoVideo}] && b.Hash() == ""
+		if found || !b.IsDownloaded() || b.FileSize() == 0 {
+			continue
+		}
+		// the file might have been downloaded after its folder was read.
+		f, err := b.File()
+		if err == nil {
+			f.Close()
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		size := b.FileSize()
+		if h.index.remove(b) {
+			rep.Vanished = append(rep.Vanished, RescanEntry{b.ID, b.NoVideo, size})
+		}
+	}
+	return nil
+}
+
+func (h *House) rescanFolder(ctx context.Context, folder string, seen map[stateKey]bool, rep *RescanReport) error {
+	dir, err := os.Open(folder)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		files, err := dir.Readdir(rescanBatch)
+		h.rescanFiles(folder, files, seen, rep)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := h.pause(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// rescanStorage is like rescanFolder, for the files in Storage.
+func (h *House) rescanStorage(ctx context.Context, seen map[stateKey]bool, rep *RescanReport) error {
+	files, err := h.Storage.List()
+	if err != nil {
+		return err
+	}
+	for len(files) > 0 {
+		n := rescanBatch
+		if n > len(files) {
+			n = len(files)
+		}
+		h.rescanFiles(h.Storage.Location(), files[:n], seen, rep)
+		files = files[n:]
+		if err := h.pause(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rescanFiles handles the files found in folder with rescanFile.
+func (h *House) rescanFiles(folder string, files []os.FileInfo, seen map[stateKey]bool, rep *RescanReport) {
+	for _, f := range files {
+		if hash, ok := parseContentName(f.Name()); ok && !f.IsDir() {
+			rep.Files++
+			h.rescanContent(folder, hash, f, rep)
+			continue
+		}
+		id, noVideo, ok := parseFileName(f.Name())
+		k := stateKey{id, noVideo}
+		// the first folder holding the file is the one File opens.
+		if !ok || f.IsDir() || seen[k] {
+			continue
+		}
+		seen[k] = true
+		rep.Files++
+		h.rescanFile(k, folder, f, rep)
+	}
+}
+
+// rescanFile adopts the file f, in folder, of the beatmap with the given key,
+// or corrects the size and the folder of the beatmap in the state.
+func (h *House) rescanFile(k stateKey, folder string, f os.FileInfo, rep *RescanReport) {
+	size := uint64(f.Size())
+	b, added := h.index.getOrAdd(k, func() *CachedBeatmap {
+		return &CachedBeatmap{
+			ID:      k.id,
+			NoVideo: k.noVideo,
+			// the file holds the version of the set at the time it was
+			// written, so it is downloaded again if the set was updated
+			// later.
+			LastUpdate:    f.ModTime(),
+			DataFolders:   h.DataFolders,
+			folder:        folder,
+			lastRequested: f.ModTime(),
+			fileSize:      size,
+			isDownloaded:  true,
+			house:         h,
+		}
+	})
+	if added {
+		rep.Adopted = append(rep.Adopted, RescanEntry{k.id, k.noVideo, size})
+		return
+	}
+
+	b.mtx.Lock()
+	// the file of a beatmap being downloaded is about to be replaced, and
+	// that of a beatmap named after its content is not this one.
+	current := b.isDownloaded && b.stream == nil && b.fileSize > 0 && b.hash == ""
+	resized := current && b.fileSize != size
+	if resized {
+		b.fileSize = size
+	}
+	moved := current && b.folder != folder && (b.folder == "" || !h.hasFile(b.folder, b.name()))
+	if moved {
+		b.folder = folder
+	}
+	b.mtx.Unlock()
+	if resized || moved {
+		h.index.update(b)
+	}
+	if resized {
+		rep.Resized = append(rep.Resized, RescanEntry{k.id, k.noVideo, size})
+	}
+}
+
+// rescanContent adopts the file f, in folder, named after its content with the
+// given hash, if no beatmap references it. The files which can't be adopted,
+// because their beatmap is not known or already has another file, are removed,
+// unless they are in Storage, where they might be those of another instance.
+func (h *House) rescanContent(folder, hash string, f os.FileInfo, rep *RescanReport) {
+	name := contentName(hash)
+	// the file is held, so that it is not removed while being adopted.
+	if h.hold(folder, name) {
+		h.unhold(folder, name)
+		return
+	}
+	k, ok, err := h.contentKey(folder, name, hash, f.Size())
+	if err != nil {
+		logError(err)
+	}
+	size := uint64(f.Size())
+	if ok {
+		_, ok = h.index.getOrAdd(k, func() *CachedBeatmap {
+			return &CachedBeatmap{
+				ID:      k.id,
+				NoVideo: k.noVideo,
+				// as in rescanFile.
+				LastUpdate:    f.ModTime(),
+				DataFolders:   h.DataFolders,
+				folder:        folder,
+				hash:          hash,
+				lastRequested: f.ModTime(),
+				fileSize:      size,
+				isDownloaded:  true,
+				house:         h,
+			}
+		})
+	}
+	if ok {
+		rep.Adopted = append(rep.Adopted, RescanEntry{k.id, k.noVideo, size})
+	}
+
+	h.contents.mtx.Lock()
+	defer h.contents.mtx.Unlock()
+	_, local := h.storage(folder).(Local)
+	if !h.dropHoldLocked(folder+name) || !local || err != nil || h.index.references(folder+name) > 0 {
+		return
+	}
+	if err := ignoreNotExist(Local(folder).Remove(name)); err != nil {
+		logError(err)
+		return
+	}
+	rep.Removed = append(rep.Removed, folder+name)
+}
+
+// hasFile tells whether there is a file with the given name in folder.
+func (h *House) hasFile(folder, name string) bool {
+	_, err := h.storage(folder).Stat(name)
+	return err == nil
+}
@@ -0,0 +1,207 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRescan(t *testing.T) {
+	h := testHouse(t)
+	h.RescanPause = 0
+	dir := h.DataFolders[0]
+	valid := testZip(t, "osu file format v14")
+	for _, name := range []string{"1.osz", "2n.osz", "3.osz", "notes.txt", "4.osz.123456.tmp"} {
+		err := ioutil.WriteFile(dir+name, valid, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(dir+"2n.osz", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	size := uint64(len(valid))
+	h.setState([]*CachedBeatmap{
+		// in the state with the wrong size
+		{ID: 1, fileSize: size + 10, isDownloaded: true, DataFolders: h.DataFolders},
+		// in the state, with the right size
+		{ID: 3, fileSize: size, isDownloaded: true, DataFolders: h.DataFolders},
+		// the file vanished
+		{ID: 5, fileSize: size, isDownloaded: true, DataFolders: h.DataFolders},
+		// failed download
+		{ID: 6, isDownloaded: true, DataFolders: h.DataFolders},
+	})
+
+	rep, err := h.Rescan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Files != 3 {
+		t.Errorf("want 3 files got %d", rep.Files)
+	}
+	if len(rep.Adopted) != 1 || rep.Adopted[0] != (RescanEntry{2, true, size}) {
+		t.Errorf("unexpected adopted beatmaps %v", rep.Adopted)
+	}
+	if len(rep.Vanished) != 1 || rep.Vanished[0] != (RescanEntry{5, false, size}) {
+		t.Errorf("unexpected vanished beatmaps %v", rep.Vanished)
+	}
+	if len(rep.Resized) != 1 || rep.Resized[0] != (RescanEntry{1, false, size}) {
+		t.Errorf("unexpected resized beatmaps %v", rep.Resized)
+	}
+
+	adopted := h.Beatmap(2, true)
+	if adopted == nil || !adopted.IsDownloaded() || adopted.FileSize() != size ||
+		!adopted.LastRequested().Equal(mtime) {
+		t.Fatalf("beatmap not adopted: %v", adopted)
+	}
+	if h.Beatmap(5, false) != nil || h.Beatmap(6, false) == nil {
+		t.Fatalf("unexpected state %v", h.Beatmaps())
+	}
+	if total, _ := h.StateSizeAndRemovableMaps(); total != 3*size {
+		t.Errorf("want %d bytes in the state got %d", 3*size, total)
+	}
+	if last, running := h.LastRescan(); last != rep || running {
+		t.Errorf("unexpected last rescan %v (running: %t)", last, running)
+	}
+
+	// the state has been saved
+	h.setState(nil)
+	if err := h.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Len() != 4 || h.Beatmap(2, true) == nil {
+		t.Fatalf("unexpected saved state %v", h.Beatmaps())
+	}
+
+	// nothing to do the second time
+	rep, err = h.Rescan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Adopted) != 0 || len(rep.Vanished) != 0 || len(rep.Resized) != 0 {
+		t.Fatalf("unexpected rescan %+v", rep)
+	}
+}
+
+// testSetZip returns a beatmap of the set with the given ID, with a video if
+// video is set.
+func testSetZip(t *testing.T, id int, video bool) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	files := map[string]string{"test.osu": fmt.Sprintf("osu file format v14\n\n[Metadata]\nBeatmapSetID:%d\n\n[Events]\n", id)}
+	if video {
+		files["video.mp4"] = "video"
+	}
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRescanContent(t *testing.T) {
+	h := testHouse(t)
+	h.RescanPause = 0
+	dir := h.DataFolders[0]
+	referenced := downloadTestFile(t, h, 1, false, testSetZip(t, 1, true))
+	noVideo, full := testSetZip(t, 2, false), testSetZip(t, 3, true)
+	// another file of a beatmap in the state.
+	stale := testSetZip(t, 1, true)
+	stale = append(stale[:len(stale):len(stale)], 0)
+	unknown := testZip(t, "osu file format v5")
+	for _, content := range [][]byte{noVideo, full, stale, unknown} {
+		if err := ioutil.WriteFile(dir+contentName(sha256Hex(content)), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not the content named by the file.
+	changed := contentName(sha256Hex([]byte("changed")))
+	if err := ioutil.WriteFile(dir+changed, full, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := h.Rescan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Files != 6 {
+		t.Errorf("want 6 files got %d", rep.Files)
+	}
+	want := map[RescanEntry]bool{
+		{2, true, uint64(len(noVideo))}: true,
+		{3, false, uint64(len(full))}:   true,
+	}
+	if len(rep.Adopted) != 2 || !want[rep.Adopted[0]] || !want[rep.Adopted[1]] {
+		t.Errorf("unexpected adopted beatmaps %v", rep.Adopted)
+	}
+	if len(rep.Vanished) != 0 || len(rep.Removed) != 3 {
+		t.Errorf("unexpected rescan %+v", rep)
+	}
+	for _, content := range [][]byte{stale, unknown} {
+		if exists(dir + contentName(sha256Hex(content))) {
+			t.Error("orphan file not removed")
+		}
+	}
+	if exists(dir + changed) {
+		t.Error("changed file not removed")
+	}
+
+	adopted := h.Beatmap(2, true)
+	if adopted == nil || adopted.Hash() != sha256Hex(noVideo) || !bytes.Equal(readTestFile(t, adopted), noVideo) {
+		t.Fatalf("beatmap not adopted: %v", adopted)
+	}
+	if h.Beatmap(1, false) != referenced || h.Beatmap(1, true) != nil || h.Beatmap(3, false) == nil {
+		t.Fatalf("unexpected state %v", h.Beatmaps())
+	}
+
+	// the adopted beatmaps are kept in the state.
+	h.setState(nil)
+	if err := h.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	rep, err = h.Rescan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Files != 3 || len(rep.Adopted) != 0 || len(rep.Vanished) != 0 || len(rep.Removed) != 0 {
+		t.Fatalf("unexpected rescan %+v", rep)
+	}
+}
+
+func TestRescanCancelled(t *testing.T) {
+	h := testHouse(t)
+	dir := h.DataFolders[0]
+	for id := 1; id <= rescanBatch+1; id++ {
+		err := ioutil.WriteFile(dir+(&CachedBeatmap{ID: id}).FileName(), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.Rescan(ctx); err != context.Canceled {
+		t.Fatalf("want context.Canceled got %v", err)
+	}
+	if _, running := h.LastRescan(); running {
+		t.Fatal("rescan still running")
+	}
+}
+
+// exists tells whether there is a file at path.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,427 @@
+package housekeeper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config configures an S3 storage.
+type S3Config struct {
+	// Endpoint is the URL of the object storage, such as
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for a
+	// local MinIO. The bucket is part of the path of the requests.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the names of the files, for instance
+	// "beatmaps/".
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3 is a Storage in a bucket of an S3-compatible object storage, such as
+// Amazon S3 or MinIO. The requests are signed with AWS Signature Version 4.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	// Client is the HTTP client sending the requests.
+	Client *http.Client
+	// now returns the time of the signatures.
+	now func() time.Time
+}
+
+// NewS3 returns the S3 storage with the given configuration.
+func NewS3(cfg S3Config) (*S3, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("cheesegull/housekeeper: invalid S3 endpoint " + cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("cheesegull/housekeeper: no S3 bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &S3{
+		cfg:      cfg,
+		endpoint: u,
+		Client:   &http.Client{Timeout: 10 * time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+// Location is s3://<bucket>/<prefix>.
+func (s *S3) Location() string {
+	return "s3://" + s.cfg.Bucket + "/" + s.cfg.Prefix
+}
+
+// objectURL returns the URL of the object with the given key, or of the
+// bucket if key is empty.
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path += "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+// do sends a request for the object with the given key, signed with the hash
+// of its payload. A 404 is returned as an error satisfying os.IsNotExist.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := s.objectURL(key)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", s.now().UTC().Format(amzDateFormat))
+	s.sign(req, payloadHash)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	op := strings.ToLower(method)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: op, Path: s.Location() + strings.TrimPrefix(key, s.cfg.Prefix), Err: os.ErrNotExist}
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(data, &e)
+	return nil, fmt.Errorf("cheesegull/housekeeper: s3 %s %s: %s %s %s", op, key, resp.Status, e.Code, e.Message)
+}
+
+// Open opens the object with the given name. It is read with as few requests
+// as possible, and ReadAt uses ranged requests.
+func (s *S3) Open(name string) (File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, name: name, info: info.(*objectInfo)}, nil
+}
+
+// Stat describes the object with the given name.
+func (s *S3) Stat(name string) (os.FileInfo, error) {
+	resp, err := s.do("HEAD", s.cfg.Prefix+name, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &objectInfo{name: name, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// Put uploads the object with the given name. The payload is not signed, so
+// that it can be streamed.
+func (s *S3) Put(name string, r io.Reader, size int64) error {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	var body io.Reader
+	if size > 0 {
+		// a body of unknown length would be sent in chunks, which S3
+		// doesn't accept.
+		body = ioutil.NopCloser(r)
+	}
+	resp, err := s.do("PUT", s.cfg.Prefix+name, nil, header, body, size, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Remove deletes the object with the given name.
+func (s *S3) Remove(name string) error {
+	resp, err := s.do("DELETE", s.cfg.Prefix+name, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List describes the objects whose key starts with the prefix, and contains no
+// other slash.
+func (s *S3) List() ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.cfg.Prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key          string
+				LastModified time.Time
+				Size         int64
+			}
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			name := strings.TrimPrefix(c.Key, s.cfg.Prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			files = append(files, &objectInfo{name: name, size: c.Size, modTime: c.LastModified})
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Presign returns a URL from which the object with the given name can be
+// downloaded, with the given file name, for the given time.
+func (s *S3) Presign(name, filename string, expires time.Duration) (string, error) {
+	t := s.now().UTC()
+	u := s.objectURL(s.cfg.Prefix + name)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.cfg.AccessKey + "/" + s.scope(t)},
+		"X-Amz-Date":          {t.Format(amzDateFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if filename != "" {
+		query.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	sig := s.signature(req, []string{"host"}, "UNSIGNED-PAYLOAD", t)
+	return u.String() + "&X-Amz-Signature=" + sig, nil
+}
+
+const amzDateFormat = "20060102T150405Z"
+
+// scope is the credential scope of the signatures made at t.
+func (s *S3) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// sign adds the Authorization header to req, whose X-Amz-Date header is set.
+// The host, the range and the x-amz-* headers are signed.
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	t, _ := time.Parse(amzDateFormat, req.Header.Get("X-Amz-Date"))
+	signed := []string{"host"}
+	for k := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			signed = append(signed, k)
+		}
+	}
+	sort.Strings(signed)
+	sig := s.signature(req, signed, payloadHash, t)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, s.scope(t), strings.Join(signed, ";"), sig))
+}
+
+// signature computes the signature of req made at t, with the given signed
+// headers, sorted.
+func (s *S3) signature(req *http.Request, signed []string, payloadHash string, t time.Time) string {
+	var headers strings.Builder
+	for _, k := range signed {
+		v := req.Header.Get(k)
+		if k == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(k + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format(amzDateFormat) + "\n" + s.scope(t) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query as required by the signatures: sorted by key,
+// and with everything but the unreserved characters escaped.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes every byte of s but the unreserved characters, and the
+// slashes unless encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectInfo describes an object of an S3 storage.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i *objectInfo) Name() string       { return i.name }
+func (i *objectInfo) Size() int64        { return i.size }
+func (i *objectInfo) Mode() os.FileMode  { return 0644 }
+func (i *objectInfo) ModTime() time.Time { return i.modTime }
+func (i *objectInfo) IsDir() bool        { return false }
+func (i *objectInfo) Sys() interface{}   { return nil }
+
+// s3File is an object of an S3 storage opened for reading.
+type s3File struct {
+	s    *S3
+	name string
+	info *objectInfo
+	// body is the response being read by Read, from off.
+	body io.ReadCloser
+	off  int64
+}
+
+// get requests the bytes of the object from off, up to end, or to the end of
+// the object if end is negative.
+func (f *s3File) get(off, end int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", off)
+	if end >= 0 {
+		rng += strconv.FormatInt(end, 10)
+	}
+	resp, err := f.s.do("GET", f.s.cfg.Prefix+f.name, nil, http.Header{"Range": {rng}}, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.get(f.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	if err == io.EOF && f.off < f.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	want := p
+	if rest := f.info.size - off; int64(len(want)) > rest {
+		want = want[:rest]
+	}
+	if len(want) == 0 {
+		return 0, nil
+	}
+	body, err := f.get(off, off+int64(len(want))-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, want)
+	if err == nil && len(want) < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) { return f.info, nil }
@@ -0,0 +1,338 @@
+package housekeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrScrubRunning is returned by Scrub when a verification of the cache is
+// already running.
+var ErrScrubRunning = errors.New("cheesegull/housekeeper: a scrub is already running")
+
+// ScrubOptions change what Scrub does.
+type ScrubOptions struct {
+	// All verifies every beatmap, rather than only those which have not been
+	// verified for ScrubAfter.
+	All bool
+	// DryRun only reports the corrupted beatmaps, leaving them in place, and
+	// doesn't record the verification in the state.
+	DryRun bool
+}
+
+// ScrubEntry is a corrupted beatmap found by Scrub.
+type ScrubEntry struct {
+	ID      int    `json:"id"`
+	NoVideo bool   `json:"no_video"`
+	Reason  string `json:"reason"`
+	// Quarantine is the path of the file in QuarantineFolder, if it has been
+	// moved there.
+	Quarantine string `json:"quarantine,omitempty"`
+	// Redownloading tells whether the beatmap is being downloaded again.
+	Redownloading bool `json:"redownloading"`
+}
+
+// ScrubReport is the outcome of Scrub.
+type ScrubReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Checked is the number of beatmaps verified, and Bytes their size.
+	Checked int    `json:"checked"`
+	Bytes   uint64 `json:"bytes"`
+	// Errors is the number of beatmaps which could not be verified, for
+	// instance because their file could not be read.
+	Errors    int          `json:"errors"`
+	Corrupted []ScrubEntry `json:"corrupted"`
+}
+
+// Verified returns the last time the file of the beatmap was found intact by
+// Scrub, or the zero time if it has not been verified yet.
+func (c *CachedBeatmap) Verified() time.Time {
+	c.mtx.RLock()
+	t := c.verified
+	c.mtx.RUnlock()
+	return t
+}
+
+// Scrub verifies the files of the beatmaps in the cache: their content must
+// have the SHA-256 which names them, they must be intact zip files, and the
+// MD5s of their .osu files must be those returned by MD5s, if set. The files
+// written by older versions are named after their content once verified. The
+// corrupted files are moved to QuarantineFolder rather than deleted, and the
+// beatmaps are removed from the state or, with RedownloadCorrupted, downloaded
+// again. To leave the disks to the requests, the files are read at ScrubRate
+// bytes per second at most.
+func (h *House) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubReport, error) {
+	h.scrubMtx.Lock()
+	if h.scrubbing {
+		h.scrubMtx.Unlock()
+		return nil, ErrScrubRunning
+	}
+	h.scrubbing = true
+	h.scrubMtx.Unlock()
+
+	rep := &ScrubReport{Started: time.Now()}
+	err := h.scrub(ctx, opts, rep)
+	rep.Finished = time.Now()
+	if rep.Checked > 0 && !opts.DryRun {
+		// even when cancelled, so that the next run resumes where this
+		// one stopped.
+		if saveErr := h.SaveState(); err == nil {
+			err = saveErr
+		}
+	}
+
+	h.scrubMtx.Lock()
+	h.scrubbing = false
+	if err == nil {
+		h.lastScrub = rep
+	}
+	h.scrubMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("[C] Scrub:", rep.Checked, "beatmaps verified,", len(rep.Corrupted), "corrupted,",
+		rep.Errors, "errors")
+	return rep, nil
+}
+
+func (h *House) scrub(ctx context.Context, opts ScrubOptions, rep *ScrubReport) error {
+	for _, b := range h.index.all() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !b.IsDownloaded() || b.FileSize() == 0 || b.Stream() != nil {
+			continue
+		}
+		if !opts.All && h.ScrubAfter > 0 && time.Since(b.Verified()) < h.ScrubAfter {
+			continue
+		}
+
+		start := time.Now()
+		folder, size, sum, err := h.verify(b)
+		rep.Checked++
+		rep.Bytes += uint64(size)
+		switch {
+		case err == nil && opts.DryRun:
+			// nothing to record
+		case err == nil:
+			b.mtx.Lock()
+			b.verified = start
+			legacy := b.hash == ""
+			b.mtx.Unlock()
+			if legacy {
+				if err := h.hashLegacyFile(b, folder, sum); err != nil {
+					logError(err)
+				}
+			}
+		case IsInvalid(err):
+			log.Println("[C] Corrupted beatmap:", b.String(), err)
+			e := ScrubEntry{ID: b.ID, NoVideo: b.NoVideo, Reason: err.Error()}
+			if !opts.DryRun {
+				e.Quarantine, e.Redownloading, err = h.quarantine(b, folder, err)
+				if err != nil {
+					logError(err)
+				}
+			}
+			rep.Corrupted = append(rep.Corrupted, e)
+		default:
+			log.Println("[C] Can't verify", b.String()+":", err)
+			rep.Errors++
+		}
+
+		if h.ScrubRate > 0 {
+			wait := time.Duration(float64(size)/float64(h.ScrubRate)*float64(time.Second)) - time.Since(start)
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verify validates the file of b, and returns its folder, its size and the
+// hash of its content.
+func (h *House) verify(b *CachedBeatmap) (string, int64, string, error) {
+	folder := b.Folder()
+	if folder == "" {
+		return "", 0, "", os.ErrNotExist
+	}
+	b.mtx.RLock()
+	name, hash := b.name(), b.hash
+	b.mtx.RUnlock()
+	f, err := h.storage(folder).Open(name)
+	if err != nil {
+		return folder, 0, "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return folder, 0, "", err
+	}
+	size := stat.Size()
+
+	sum, err := hashFile(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return folder, size, "", err
+	}
+	if hash != "" && sum != hash {
+		return folder, size, sum, fmt.Errorf("%w: its SHA-256 is %s", ErrInvalidBeatmap, sum)
+	}
+	var md5s []string
+	if h.MD5s != nil {
+		md5s, err = h.MD5s(b.ID)
+		if err != nil {
+			return folder, size, sum, err
+		}
+	}
+	return folder, size, sum, ValidateBeatmap(f, size, md5s)
+}
+
+// quarantine moves the file of b, in folder, to QuarantineFolder, along with
+// a file telling why it is corrupted. b is then removed from the state or, with
+// RedownloadCorrupted, downloaded again. It returns the path of the file in
+// quarantine, or "" if b changed meanwhile, and whether b is being downloaded
+// again.
+func (h *House) quarantine(b *CachedBeatmap, folder string, reason error) (string, bool, error) {
+	name := b.storedName()
+	err := os.MkdirAll(h.QuarantineFolder, 0755)
+	if err != nil {
+		return "", false, err
+	}
+	dst := filepath.Join(h.QuarantineFolder,
+		fmt.Sprintf("%s.%d.osz", strings.TrimSuffix(b.FileName(), ".osz"), time.Now().Unix()))
+	// the file is copied rather than renamed, as the quarantine folder can be
+	// on another disk.
+	err = copyFile(h.storage(folder), name, dst)
+	if err != nil {
+		return "", false, err
+	}
+
+	// the file is only removed if b has not changed meanwhile, so that a new
+	// download is never lost. The other beatmaps sharing it are quarantined
+	// when they are verified.
+	b.mtx.Lock()
+	ok := b.folder == folder && b.name() == name && b.stream == nil && b.isDownloaded
+	if ok {
+		b.isDownloaded = false
+		b.fileSize = 0
+		b.folder = ""
+		b.hash = ""
+		b.verified = time.Time{}
+	}
+	b.mtx.Unlock()
+	if !ok {
+		os.Remove(dst)
+		return "", false, nil
+	}
+	if h.RedownloadCorrupted {
+		h.index.update(b)
+	} else {
+		h.index.remove(b)
+	}
+	err = ioutil.WriteFile(dst+".txt", []byte(b.String()+"\n"+reason.Error()+"\n"), 0644)
+	if releaseErr := h.release(folder, name); err == nil {
+		err = releaseErr
+	}
+	if !h.RedownloadCorrupted {
+		return dst, false, err
+	}
+	// without Fetch, the beatmap is downloaded again at its next request.
+	redownloading := h.Fetch != nil && h.Redownload(b)
+	if redownloading {
+		go h.Fetch(b)
+	}
+	return dst, redownloading, err
+}
+
+// copyFile copies the file with the given name in src to dst, which must not
+// exist.
+func copyFile(src Storage, name, dst string) error {
+	in, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// StartScrub runs Scrub in the background. It returns false if a scrub is
+// already running.
+func (h *House) StartScrub(opts ScrubOptions) bool {
+	h.scrubMtx.Lock()
+	running := h.scrubbing
+	h.scrubMtx.Unlock()
+	if running {
+		return false
+	}
+	go func() {
+		_, err := h.Scrub(context.Background(), opts)
+		if err != nil && err != ErrScrubRunning {
+			logError(err)
+		}
+	}()
+	return true
+}
+
+// StartScrubber starts the process that runs Scrub every ScrubInterval, to
+// verify the beatmaps which have not been verified for ScrubAfter.
+func (h *House) StartScrubber() {
+	if h.ScrubInterval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(h.ScrubInterval)
+		defer t.Stop()
+		for range t.C {
+			_, err := h.Scrub(context.Background(), ScrubOptions{})
+			if err != nil && err != ErrScrubRunning {
+				logError(err)
+			}
+		}
+	}()
+}
+
+// LastScrub returns the report of the latest scrub, or nil if none has been
+// completed, and whether one is running.
+func (h *House) LastScrub() (rep *ScrubReport, running bool) {
+	h.scrubMtx.Lock()
+	defer h.scrubMtx.Unlock()
+	return h.lastScrub, h.scrubbing
+}
+
+// sleep sleeps for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
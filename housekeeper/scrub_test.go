@@ -0,0 +1,127 @@
+package housekeeper
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// storeTestFile stores a beatmap with the given content in the first data
+// folder of h.
+func storeTestFile(t *testing.T, h *House, id int, content []byte) *CachedBeatmap {
+	folder := h.DataFolders[0]
+	b := &CachedBeatmap{
+		ID:            id,
+		DataFolders:   h.DataFolders,
+		folder:        folder,
+		lastRequested: time.Now(),
+		fileSize:      uint64(len(content)),
+		isDownloaded:  true,
+		house:         h,
+	}
+	if err := ioutil.WriteFile(folder+b.FileName(), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.index.put(b)
+	return b
+}
+
+func TestScrub(t *testing.T) {
+	h := testHouse(t)
+	h.ScrubRate = 0
+	sum := md5.Sum([]byte("good"))
+	h.MD5s = func(id int) ([]string, error) {
+		return []string{hex.EncodeToString(sum[:])}, nil
+	}
+	good := storeTestFile(t, h, 1, testZip(t, "good"))
+	storeTestFile(t, h, 2, []byte(zipMagic+"not really a zip"))
+	outdated := storeTestFile(t, h, 3, testZip(t, "outdated"))
+
+	rep, err := h.Scrub(context.Background(), ScrubOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Checked != 3 || len(rep.Corrupted) != 2 {
+		t.Fatalf("dry run: unexpected report %+v", rep)
+	}
+	if h.Len() != 3 || !exists(outdated.Folder()+outdated.FileName()) {
+		t.Fatal("dry run changed the cache")
+	}
+
+	rep, err = h.Scrub(context.Background(), ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Corrupted) != 2 || rep.Corrupted[0].ID != 2 || rep.Corrupted[1].ID != 3 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	for _, e := range rep.Corrupted {
+		if !exists(e.Quarantine) || !exists(e.Quarantine+".txt") {
+			t.Fatalf("%d not in quarantine: %+v", e.ID, e)
+		}
+		if h.Beatmap(e.ID, false) != nil {
+			t.Fatalf("%d still in the state", e.ID)
+		}
+	}
+	if good.Verified().IsZero() {
+		t.Fatal("intact beatmap not marked as verified")
+	}
+	if rep, _ := h.LastScrub(); rep == nil || rep.Checked != 3 {
+		t.Fatalf("unexpected last report %+v", rep)
+	}
+
+	// the verification is saved with the state, and not done again soon.
+	h2 := testHouse(t)
+	h2.StateFile = h.StateFile
+	if err := h2.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+	b := h2.Beatmap(1, false)
+	if b == nil || !b.Verified().Equal(good.Verified()) {
+		t.Fatalf("verification not saved: %v", b)
+	}
+	rep, err = h.Scrub(context.Background(), ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Checked != 0 {
+		t.Fatalf("verified again %d beatmaps", rep.Checked)
+	}
+}
+
+func TestScrubRedownload(t *testing.T) {
+	h := testHouse(t)
+	h.ScrubRate = 0
+	h.RedownloadCorrupted = true
+	fetched := make(chan *CachedBeatmap, 1)
+	h.Fetch = func(b *CachedBeatmap) {
+		fetched <- b
+	}
+	b := storeTestFile(t, h, 1, []byte("garbage"))
+
+	rep, err := h.Scrub(context.Background(), ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Corrupted) != 1 || !rep.Corrupted[0].Redownloading {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	select {
+	case got := <-fetched:
+		if got != b {
+			t.Fatalf("fetched %v instead of %v", got, b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("beatmap not downloaded again")
+	}
+	if b.IsDownloaded() || b.Stream() == nil || h.Beatmap(1, false) != b {
+		t.Fatal("beatmap not being downloaded again")
+	}
+	if _, err := os.Stat(h.DataFolders[0] + b.FileName()); !os.IsNotExist(err) {
+		t.Fatal("corrupted file left in the data folder")
+	}
+}
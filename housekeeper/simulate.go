@@ -0,0 +1,163 @@
+package housekeeper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewEvictionPolicy returns the eviction policy with the given name: lru, lfu
+// or gdsf. halfLife is the half-life of the requests with lfu.
+func NewEvictionPolicy(name string, halfLife time.Duration) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return LRU{}, nil
+	case "lfu":
+		if halfLife <= 0 {
+			return nil, errors.New("cheesegull/housekeeper: the half-life of lfu must be positive")
+		}
+		return LFU{HalfLife: halfLife}, nil
+	case "gdsf":
+		return &GDSF{}, nil
+	}
+	return nil, errors.New("cheesegull/housekeeper: unknown eviction policy " + name)
+}
+
+// LoggedAccess is a request of a beatmap, as written by LogAccess.
+type LoggedAccess struct {
+	Time    time.Time
+	ID      int
+	NoVideo bool
+	// Size is the size of the beatmap, or -1 if it was not known yet.
+	Size         int64
+	RankedStatus int
+}
+
+// LogAccess writes a request of b to AccessLog, if any, so that the requests
+// can be replayed by Simulate. size is the size of the beatmap, or -1 if it is
+// not known yet.
+func (h *House) LogAccess(b *CachedBeatmap, size int64) {
+	if h.AccessLog == nil {
+		return
+	}
+	b.mtx.RLock()
+	status := b.RankedStatus
+	b.mtx.RUnlock()
+	h.accessLogMtx.Lock()
+	_, err := fmt.Fprintf(h.AccessLog, "%d %d %d %d %d\n",
+		time.Now().UnixNano(), b.ID, b2i(b.NoVideo), size, status)
+	h.accessLogMtx.Unlock()
+	if err != nil {
+		logError(err)
+	}
+}
+
+// ReadAccessLog reads the requests written by LogAccess.
+func ReadAccessLog(r io.Reader) ([]LoggedAccess, error) {
+	var log []LoggedAccess
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var nums [5]int64
+		var err error
+		if len(fields) != len(nums) {
+			err = errors.New("wrong number of fields")
+		}
+		for i := 0; err == nil && i < len(nums); i++ {
+			nums[i], err = strconv.ParseInt(fields[i], 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cheesegull/housekeeper: access log line %d: %v", line, err)
+		}
+		log = append(log, LoggedAccess{
+			Time:         time.Unix(0, nums[0]),
+			ID:           int(nums[1]),
+			NoVideo:      nums[2] == 1,
+			Size:         nums[3],
+			RankedStatus: int(nums[4]),
+		})
+	}
+	return log, s.Err()
+}
+
+// SimulationResult is the outcome of Simulate.
+type SimulationResult struct {
+	Requests int
+	Hits     int
+	Bytes    uint64
+	ByteHits uint64
+}
+
+// HitRatio is the fraction of the requests served from the cache.
+func (r SimulationResult) HitRatio() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Requests)
+}
+
+// ByteHitRatio is the fraction of the bytes served from the cache.
+func (r SimulationResult) ByteHitRatio() float64 {
+	if r.Bytes == 0 {
+		return 0
+	}
+	return float64(r.ByteHits) / float64(r.Bytes)
+}
+
+// Simulate replays the requests of log against a cache of the given size,
+// using the eviction policy p, and reports how many of them would have been
+// served from the cache. The requests whose size is never known are skipped.
+func Simulate(p EvictionPolicy, capacity uint64, log []LoggedAccess) SimulationResult {
+	sizes := make(map[stateKey]int64)
+	for _, a := range log {
+		if a.Size > 0 {
+			sizes[stateKey{a.ID, a.NoVideo}] = a.Size
+		}
+	}
+
+	var res SimulationResult
+	idx := newIndex()
+	idx.policy = p
+	for _, a := range log {
+		k := stateKey{a.ID, a.NoVideo}
+		size := a.Size
+		if size <= 0 {
+			size = sizes[k]
+		}
+		if size <= 0 {
+			continue
+		}
+		res.Requests++
+		res.Bytes += uint64(size)
+
+		b := idx.get(k)
+		if b != nil {
+			res.Hits++
+			res.ByteHits += uint64(size)
+		} else {
+			b = &CachedBeatmap{
+				ID:           a.ID,
+				NoVideo:      a.NoVideo,
+				fileSize:     uint64(size),
+				isDownloaded: true,
+			}
+			idx.put(b)
+		}
+		b.mtx.Lock()
+		b.RankedStatus = a.RankedStatus
+		b.mtx.Unlock()
+		idx.request(b, a.Time)
+
+		if total, _ := idx.size(); total > capacity {
+			idx.evict(total - capacity)
+		}
+	}
+	return res
+}
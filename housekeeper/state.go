@@ -1,8 +1,11 @@
 package housekeeper
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
@@ -17,12 +20,62 @@ type CachedBeatmap struct {
 	LastUpdate  time.Time
 	DataFolders []string
 
+	// RankedStatus is the status of the set, which is taken into account by
+	// the StatusAware eviction policy.
+	RankedStatus int
+
 	lastRequested time.Time
+	// requests is the frequency of the requests, as computed by the eviction
+	// policy.
+	requests float64
 
 	fileSize     uint64
 	isDownloaded bool
-	mtx          sync.RWMutex
-	waitGroup    sync.WaitGroup
+	// hash is the SHA-256 of the file, in hexadecimal, which names it, or ""
+	// for the files written by older versions.
+	hash string
+	// verified is the last time the file was found intact by Scrub.
+	verified time.Time
+	// upstream is the LastUpdate of the newest version of the beatmap known
+	// to exist upstream.
+	upstream time.Time
+	// refresh is the download of the newer version in progress, if any, and
+	// refreshFailed the time the latest one failed.
+	refresh       *CachedBeatmap
+	refreshFailed time.Time
+	// replaces is, for the download of a newer version, the beatmap in the
+	// state whose file it replaces.
+	replaces *CachedBeatmap
+	// folder is the data folder holding the file of the beatmap, or "" if it
+	// is not known, in which case it is searched in DataFolders.
+	folder string
+	// snapshots is the number of times the index has read the fields above.
+	snapshots uint64
+	mtx       sync.RWMutex
+
+	// flight is the latest download of the beatmap, if any.
+	flight *Flight
+	// stream is the download in progress, if any.
+	stream *Stream
+	// downloadCtx is cancelled once all the requests watching the download
+	// have gone away.
+	downloadCtx    context.Context
+	downloadCancel context.CancelFunc
+	watchers       int
+
+	// house is the house whose state contains the beatmap, if any.
+	house *House
+	// the following fields are protected by the mutex of the index of the
+	// house.
+	inState       bool
+	queueIndex    int
+	countedSize   uint64
+	countedFolder string
+	countedFile   string
+	tier          int
+	priority      float64
+	// applied is the latest snapshot of the beatmap applied to the index.
+	applied uint64
 }
 
 func (c *CachedBeatmap) UpdateFolders(folders string) bool {
@@ -31,38 +84,97 @@ func (c *CachedBeatmap) UpdateFolders(folders string) bool {
 	return true
 }
 
-// File opens the File of the beatmap from the filesystem.
-func (c *CachedBeatmap) File() (*os.File, error) {
-	if len(c.DataFolders) < 1 {
+// File opens the File of the beatmap from its data folder, or from the
+// Storage of the house.
+func (c *CachedBeatmap) File() (File, error) {
+	folder := c.Folder()
+	if folder == "" {
 		return nil, os.ErrNotExist
 	}
+	return c.house.storage(folder).Open(c.storedName())
+}
+
+// Folder returns the data folder holding the file of the beatmap, the Location
+// of the Storage of the house if it is there, or "" if there is no file. The
+// beatmaps of the states saved by older versions don't record it, so it is
+// searched in DataFolders the first time.
+func (c *CachedBeatmap) Folder() string {
+	c.mtx.RLock()
+	folder, name := c.folder, c.name()
+	c.mtx.RUnlock()
+	// the file of the beatmap a newer version replaces is not that of the
+	// newer version.
+	if folder != "" || c.replaces != nil {
+		return folder
+	}
 
 	for _, path := range c.DataFolders {
-		if _, err := os.Stat(path + c.fileName()); errors.Is(err, os.ErrNotExist) {
-			continue
+		if _, err := os.Stat(path + name); err == nil {
+			c.setFolder(path)
+			return path
+		}
+	}
+	// another instance sharing the storage may have downloaded it.
+	if h := c.house; h != nil && h.Storage != nil {
+		if _, err := h.Storage.Stat(name); err == nil {
+			c.setFolder(h.Storage.Location())
+			return h.Storage.Location()
 		}
-		// file exists...
-		return os.Open(path + c.fileName())
 	}
-	return os.Open(c.DataFolders[len(c.DataFolders)-1] + c.fileName())
+	return ""
 }
 
-// CreateFile creates the File of the beatmap in the filesystem, and returns it
-// in write mode.
-func (c *CachedBeatmap) CreateFile() (*os.File, error) {
-	if len(c.DataFolders) < 1 {
+// setFolder records that the file of the beatmap is in folder, and returns
+// the folder where it was before.
+func (c *CachedBeatmap) setFolder(folder string) string {
+	c.mtx.Lock()
+	old := c.folder
+	c.folder = folder
+	h := c.house
+	c.mtx.Unlock()
+	if h != nil && old != folder {
+		h.index.update(c)
+	}
+	return old
+}
+
+// createTempFile creates a temporary file in folder, where the beatmap can be
+// written before being moved to its final place.
+func (c *CachedBeatmap) createTempFile(folder string) (*os.File, error) {
+	if folder == "" {
 		return nil, os.ErrInvalid
 	}
+	return ioutil.TempFile(folder, c.FileName()+".*.tmp")
+}
 
-	return os.Create(c.DataFolders[len(c.DataFolders)-1] + c.fileName())
+// removeFile removes the file of the beatmap from its folder, or from all the
+// data folders if it is not known, unless other beatmaps in the state share
+// it.
+func (c *CachedBeatmap) removeFile() error {
+	c.mtx.RLock()
+	folders := c.DataFolders
+	if c.folder != "" {
+		folders = []string{c.folder}
+	}
+	name := c.name()
+	c.mtx.RUnlock()
+	for _, path := range folders {
+		err := c.house.release(path, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *CachedBeatmap) fileName() string {
-	// n := ""
-	// if c.NoVideo {
-	// 	n = "n"
-	// }
-	return strconv.Itoa(c.ID) + ".osz"
+// FileName returns the name of the file of the beatmap inside the data folders:
+// <id>.osz, or <id>n.osz for the beatmaps without video.
+func (c *CachedBeatmap) FileName() string {
+	n := ""
+	if c.NoVideo {
+		n = "n"
+	}
+	return strconv.Itoa(c.ID) + n + ".osz"
 }
 
 // IsDownloaded checks whether the beatmap has been downloaded.
@@ -73,9 +185,12 @@ func (c *CachedBeatmap) IsDownloaded() bool {
 	return i
 }
 
-// GetLastAttempt Get Last Attempt time for re-download in some cases ;d
-func (c *CachedBeatmap) GetLastAttempt() int {
-	return int(c.lastRequested.Unix())
+// LastRequested returns the last time the beatmap was requested.
+func (c *CachedBeatmap) LastRequested() time.Time {
+	c.mtx.RLock()
+	t := c.lastRequested
+	c.mtx.RUnlock()
+	return t
 }
 
 // FileSize returns the FileSize of c.
@@ -89,52 +204,145 @@ func (c *CachedBeatmap) FileSize() uint64 {
 // MustBeDownloaded will check whether the beatmap is downloaded.
 // If it is not, it will wait for it to become downloaded.
 func (c *CachedBeatmap) MustBeDownloaded() {
-	if c.IsDownloaded() {
-		return
+	c.Wait(context.Background())
+}
+
+// Wait waits for the download of the beatmap in progress, if any, and returns
+// its error, which is also returned if the latest download has failed. It
+// stops waiting when ctx is done, returning its error.
+func (c *CachedBeatmap) Wait(ctx context.Context) error {
+	c.mtx.RLock()
+	f := c.flight
+	c.mtx.RUnlock()
+	if f == nil {
+		return nil
 	}
-	c.waitGroup.Wait()
+	return f.Wait(ctx)
 }
 
-// DownloadCompleted must be called once the beatmap has finished downloading.
-func (c *CachedBeatmap) DownloadCompleted(fileSize uint64, parentHouse *House) {
+// startDownload creates the stream and the context of a new download of the
+// beatmap. It must be called with c.mtx held.
+func (c *CachedBeatmap) startDownload(h *House) {
+	c.flight = NewFlight()
+	c.stream = newStream(c, h)
+	c.downloadCtx, c.downloadCancel = context.WithCancel(context.Background())
+}
+
+// finishDownload is called by the stream of the beatmap once the download is
+// over, delivering err to everyone waiting for it. If the download failed, it
+// is recorded so that it is not attempted again too soon; if it was
+// cancelled, or the disk was full, the next request starts a new download.
+func (c *CachedBeatmap) finishDownload(h *House, fileSize uint64, err error) {
+	if c.replaces != nil {
+		c.mtx.Lock()
+		c.stream = nil
+		f := c.flight
+		c.mtx.Unlock()
+		h.finishRefresh(c, fileSize, err)
+		f.Finish(err)
+		return
+	}
+
+	switch {
+	case err == nil:
+		h.clearFailure(c)
+	case !errors.Is(err, context.Canceled) && !errors.Is(err, ErrDiskFull):
+		h.recordFailure(c, err)
+	}
+
 	c.mtx.Lock()
+	c.stream = nil
 	c.fileSize = fileSize
-	c.isDownloaded = true
+	c.isDownloaded = err == nil
+	c.verified = time.Time{}
+	f := c.flight
 	c.mtx.Unlock()
-	c.waitGroup.Done()
-	parentHouse.scheduleCleanup()
+	h.index.update(c)
+	f.Finish(err)
+	h.scheduleCleanup()
 }
 
-// NotDownloaded must be called when file is fucking empty!
-func (c *CachedBeatmap) NotDownloaded(parentHouse *House) {
-	for _, path := range c.DataFolders {
-		if _, err := os.Stat(path + c.fileName()); errors.Is(err, os.ErrNotExist) {
-			continue
-		}
-		// file exists...
-		var f, err = os.Open(path + c.fileName())
-		stat, err := f.Stat()
-		if err == nil && stat.Size() < 100 {
-			os.Remove(path + c.fileName())
-		}
-		defer f.Close()
+// Stream returns the download of the beatmap in progress, or nil if the
+// beatmap is not being downloaded.
+func (c *CachedBeatmap) Stream() *Stream {
+	c.mtx.RLock()
+	s := c.stream
+	c.mtx.RUnlock()
+	return s
+}
+
+// DownloadContext returns the context to use to download the beatmap. It is
+// cancelled when all the requests watching the download, through Watch, have
+// gone away.
+func (c *CachedBeatmap) DownloadContext() context.Context {
+	c.mtx.RLock()
+	ctx := c.downloadCtx
+	c.mtx.RUnlock()
+	if ctx == nil {
+		return context.Background()
 	}
+	return ctx
+}
 
+// Watch marks the request having the given context as interested in the
+// download of the beatmap, until ctx is done or the returned function is
+// called. When nobody is interested anymore, the download is cancelled.
+func (c *CachedBeatmap) Watch(ctx context.Context) (stop func()) {
 	c.mtx.Lock()
-	c.fileSize = 0
-	c.isDownloaded = false
+	c.watchers++
 	c.mtx.Unlock()
-	c.waitGroup.Done()
-	parentHouse.scheduleCleanup()
+
+	var once sync.Once
+	unwatch := func() {
+		once.Do(func() {
+			c.mtx.Lock()
+			c.watchers--
+			if c.watchers == 0 && c.downloadCancel != nil {
+				c.downloadCancel()
+			}
+			c.mtx.Unlock()
+		})
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			unwatch()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		unwatch()
+	}
 }
 
 // SetLastRequested changes the last requested time.
 func (c *CachedBeatmap) SetLastRequested(t time.Time) {
+	c.mtx.RLock()
+	h := c.house
+	c.mtx.RUnlock()
+	if h != nil {
+		h.index.request(c, t)
+		return
+	}
 	c.mtx.Lock()
 	c.lastRequested = t
+	c.requests++
 	c.mtx.Unlock()
 }
 
+// access returns what the eviction policies know about c. It must be called
+// with c.mtx held.
+func (c *CachedBeatmap) access() Access {
+	return Access{
+		LastRequested: c.lastRequested,
+		Requests:      c.requests,
+		Size:          c.fileSize,
+		RankedStatus:  c.RankedStatus,
+	}
+}
+
 func (c *CachedBeatmap) String() string {
 	return fmt.Sprintf("{ID: %d NoVideo: %t LastUpdate: %v}", c.ID, c.NoVideo, c.LastUpdate)
 }
@@ -146,7 +354,9 @@ func (c *CachedBeatmap) String() string {
 // that of the beatmap stored in the state, then the beatmap in the state's
 // downloaded status is switched back to false and the LastUpdate is changed.
 // true is also returned, indicating that the caller now has the burden of
-// downloading the beatmap.
+// downloading the beatmap. If the house can Fetch beatmaps, though, the new
+// version is downloaded in the background, and the old one is returned with
+// false to be served meanwhile.
 //
 // In the case the cachedbeatmap has not been stored in the state, then
 // it is added to the state and, like the case where LastUpdated has been
@@ -172,43 +382,112 @@ func (h *House) AcquireBeatmap(c *CachedBeatmap) (*CachedBeatmap, bool) {
 		return nil, false
 	}
 
-	h.StateMutex.Lock()
-	for _, b := range h.State {
-		// if the id or novideo is different, then all is good and we
-		// can proceed with the next element.
-		if b.ID != c.ID || b.NoVideo != c.NoVideo {
-			continue
-		}
-		// unlocking because in either branch, we will return.
-		h.StateMutex.Unlock()
-
-		b.mtx.Lock()
-		b.DataFolders = c.DataFolders
-		// if c is not newer than b, then just return.
-		if !b.LastUpdate.Before(c.LastUpdate) {
-			b.mtx.Unlock()
-			return b, false
+	b, added := h.index.getOrAdd(stateKey{c.ID, c.NoVideo}, func() *CachedBeatmap {
+		// we need to recreate the CachedBeatmap: this way we can be sure the
+		// zero is set for the unexported fields.
+		n := &CachedBeatmap{
+			ID:           c.ID,
+			NoVideo:      c.NoVideo,
+			LastUpdate:   c.LastUpdate,
+			RankedStatus: c.RankedStatus,
+			DataFolders:  h.DataFolders,
+			house:        h,
 		}
+		n.startDownload(h)
+		return n
+	})
+	if added {
+		return b, true
+	}
 
-		b.LastUpdate = c.LastUpdate
+	b.mtx.Lock()
+	b.DataFolders = c.DataFolders
+	statusChanged := b.RankedStatus != c.RankedStatus
+	b.RankedStatus = c.RankedStatus
+	// if c is not newer than b, or b is already being downloaded, then just
+	// return.
+	if !b.LastUpdate.Before(c.LastUpdate) || b.stream != nil {
 		b.mtx.Unlock()
-		b.waitGroup.Add(1)
-		return b, true
+		if statusChanged {
+			h.index.update(b)
+		}
+		return b, false
+	}
+	// when the new version can be downloaded in the background, the old one
+	// is served meanwhile.
+	if h.Fetch != nil && b.isDownloaded && b.fileSize > 0 {
+		b.mtx.Unlock()
+		if statusChanged {
+			h.index.update(b)
+		}
+		h.refresh(b, c.LastUpdate)
+		return b, false
 	}
 
-	// c was not present in our state: we need to add it.
+	b.LastUpdate = c.LastUpdate
+	b.startDownload(h)
+	b.mtx.Unlock()
+	return b, true
+}
 
-	// we need to recreate the CachedBeatmap: this way we can be sure the zero
-	// is set for the unexported fields.
-	n := &CachedBeatmap{
-		ID:          c.ID,
-		NoVideo:     c.NoVideo,
-		LastUpdate:  c.LastUpdate,
-		DataFolders: h.DataFolders,
+// Redownload starts a new download of a beatmap which is in the state, but
+// whose download failed or was cancelled. It returns false if the beatmap is
+// already being downloaded; otherwise, like with AcquireBeatmap, the caller now
+// has the burden of downloading the beatmap.
+func (h *House) Redownload(b *CachedBeatmap) bool {
+	b.mtx.Lock()
+	if b.stream != nil {
+		b.mtx.Unlock()
+		return false
 	}
-	h.State = append(h.State, n)
-	h.StateMutex.Unlock()
+	b.startDownload(h)
+	b.mtx.Unlock()
+	return true
+}
 
-	n.waitGroup.Add(1)
-	return n, true
+// Import copies the beatmap read from r into the cache, replacing the one
+// already in the state with the same ID and NoVideo, if any.
+func (h *House) Import(c *CachedBeatmap, r io.Reader) error {
+	n := &CachedBeatmap{
+		ID:            c.ID,
+		NoVideo:       c.NoVideo,
+		LastUpdate:    c.LastUpdate,
+		RankedStatus:  c.RankedStatus,
+		DataFolders:   h.DataFolders,
+		lastRequested: time.Now(),
+		requests:      1,
+		house:         h,
+	}
+	folder := h.placeFile(0)
+	f, err := n.createTempFile(folder)
+	if err != nil {
+		return err
+	}
+	hw := newHash()
+	size, err := io.Copy(io.MultiWriter(f, hw), r)
+	if err == nil {
+		err = checkZip(f, size)
+	}
+	if err == nil {
+		n.hash = hashSum(hw)
+		folder, err = h.storeContent(f, folder, n.hash)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	n.folder = folder
+	n.fileSize = uint64(size)
+	n.isDownloaded = true
+	old := h.Beatmap(n.ID, n.NoVideo)
+	h.index.put(n)
+	h.unhold(folder, n.storedName())
+	if old != nil && old.Folder() != "" {
+		err = old.removeFile()
+	}
+	if err == nil {
+		err = h.offload(n, n.folder)
+	}
+	return err
 }
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package housekeeper
+
+import "errors"
+
+var errStatfs = errors.New("cheesegull/housekeeper: free disk space not supported")
+
+// statfs is not supported on this platform: only the quotas of the folders
+// are taken into account.
+func statfs(path string) (uint64, error) {
+	return 0, errStatfs
+}
+
+// device is not supported on this platform: every folder is taken as being on
+// its own disk.
+func device(path string) (uint64, error) {
+	return 0, errStatfs
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package housekeeper
+
+import "syscall"
+
+// statfs returns the space available to unprivileged users on the disk
+// holding path.
+func statfs(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// device returns the ID of the disk holding path.
+func device(path string) (uint64, error) {
+	var st syscall.Stat_t
+	err := syscall.Stat(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
@@ -0,0 +1,183 @@
+package housekeeper
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// File is the file of a beatmap, opened from a Storage.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// Storage holds the files of the beatmaps. The data folders are Local
+// storages, where the beatmaps are downloaded; once downloaded, they can be
+// moved to the Storage of the house, for instance an S3 bucket shared by
+// several instances.
+type Storage interface {
+	// Location identifies the storage: it is the folder recorded for the
+	// beatmaps it holds.
+	Location() string
+	// Open opens the file with the given name.
+	Open(name string) (File, error)
+	// Stat describes the file with the given name. The error satisfies
+	// os.IsNotExist if there is none.
+	Stat(name string) (os.FileInfo, error)
+	// Put stores the size bytes read from r as the file with the given name,
+	// replacing the one already there at once.
+	Put(name string, r io.Reader, size int64) error
+	// Remove removes the file with the given name.
+	Remove(name string) error
+	// List describes all the files in the storage.
+	List() ([]os.FileInfo, error)
+}
+
+// Presigner is implemented by the storages whose files can be downloaded by
+// the clients directly.
+type Presigner interface {
+	// Presign returns a URL from which the file with the given name can be
+	// downloaded, as filename, for the given time.
+	Presign(name, filename string, expires time.Duration) (string, error)
+}
+
+// Local is a Storage in a folder of the local filesystem. Its path ends with a
+// slash.
+type Local string
+
+// Location is the path of the folder.
+func (l Local) Location() string { return string(l) }
+
+// Open opens the file with the given name in the folder.
+func (l Local) Open(name string) (File, error) { return os.Open(string(l) + name) }
+
+// Stat describes the file with the given name in the folder.
+func (l Local) Stat(name string) (os.FileInfo, error) { return os.Stat(string(l) + name) }
+
+// Remove removes the file with the given name from the folder.
+func (l Local) Remove(name string) error { return os.Remove(string(l) + name) }
+
+// List describes the files in the folder.
+func (l Local) List() ([]os.FileInfo, error) { return ioutil.ReadDir(string(l)) }
+
+// Put writes r to a temporary file in the folder, which is then renamed.
+func (l Local) Put(name string, r io.Reader, size int64) error {
+	f, err := ioutil.TempFile(string(l), name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = commitFile(f, string(l)+name)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// storage returns the storage of the beatmaps whose recorded folder is the
+// given one. h can be nil, for beatmaps which are not in a house.
+func (h *House) storage(folder string) Storage {
+	if h != nil && h.Storage != nil && folder == h.Storage.Location() {
+		return h.Storage
+	}
+	return Local(folder)
+}
+
+// offload moves the file of b from the data folder src, where it has just
+// been downloaded, to Storage, if the house has one, unless Storage already
+// holds the same content. It is a no-op if b is not in src anymore, or is
+// being downloaded again.
+func (h *House) offload(b *CachedBeatmap, src string) error {
+	if h.Storage == nil || src == "" || src == h.Storage.Location() {
+		return nil
+	}
+	name := b.storedName()
+	dst := h.Storage.Location()
+	if !h.hold(dst, name) {
+		err := h.put(src, name)
+		if err != nil {
+			h.unhold(dst, name)
+		}
+		if os.IsNotExist(err) {
+			// evicted already
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// the file is served from the data folder until then.
+	b.mtx.Lock()
+	ok := b.folder == src && b.name() == name && b.stream == nil && b.isDownloaded
+	if ok {
+		b.folder = dst
+	}
+	b.mtx.Unlock()
+	if ok {
+		h.index.update(b)
+	}
+	// if b changed, or was evicted during the upload, the object is removed
+	// unless other beatmaps reference it.
+	h.unhold(dst, name)
+	if !ok {
+		return nil
+	}
+	return h.release(src, name)
+}
+
+// put copies the file with the given name from the data folder src to
+// Storage.
+func (h *House) put(src, name string) error {
+	f, err := os.Open(src + name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return h.Storage.Put(name, f, stat.Size())
+}
+
+// offloadInBackground runs offload in the background, logging its errors.
+func (h *House) offloadInBackground(b *CachedBeatmap, src string) {
+	if h.Storage == nil {
+		return
+	}
+	go func() {
+		err := h.offload(b, src)
+		if err != nil {
+			log.Println("[C] Can't move", b.String(), "to", h.Storage.Location()+":", err)
+			logError(err)
+		}
+	}()
+}
+
+// PresignedURL returns a URL from which the client can download the file of
+// b, as filename, directly from Storage, or "" if it can't: for instance if
+// RedirectExpiry is 0, or if b is not in Storage.
+func (h *House) PresignedURL(b *CachedBeatmap, filename string) string {
+	p, ok := h.Storage.(Presigner)
+	if !ok || h.RedirectExpiry <= 0 || b.Folder() != h.Storage.Location() {
+		return ""
+	}
+	u, err := p.Presign(b.storedName(), filename, h.RedirectExpiry)
+	if err != nil {
+		logError(err)
+		return ""
+	}
+	return u
+}
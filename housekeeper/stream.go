@@ -0,0 +1,374 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Stream is a beatmap being downloaded into the cache. It is written to a
+// temporary file, and any number of readers can follow the writer, receiving
+// the data as soon as it arrives. Once the download is complete, Commit moves
+// it to its place in the cache.
+type Stream struct {
+	b     *CachedBeatmap
+	house *House
+
+	mtx sync.Mutex
+	// changed is closed, and replaced, every time something is written or
+	// the state of the stream changes.
+	changed chan struct{}
+	started bool
+	done    bool
+	err     error
+	file    *os.File
+	path    string
+	// folder is the data folder where the beatmap is written.
+	folder   string
+	size     int64
+	expected int64
+	// hash is the hash of what has been written.
+	hash hash.Hash
+	// gen is incremented every time the download is restarted.
+	gen int
+	// md5s are the MD5s the .osu files of the beatmap must have.
+	md5s []string
+	// validated is the size of the beatmap when it was last validated.
+	validated int64
+}
+
+func newStream(b *CachedBeatmap, h *House) *Stream {
+	return &Stream{
+		b:         b,
+		house:     h,
+		changed:   make(chan struct{}),
+		expected:  -1,
+		validated: -1,
+	}
+}
+
+// Expect sets the MD5s that the .osu files of the beatmap must have for the
+// download to be committed. It must be called before Start.
+func (s *Stream) Expect(md5s []string) {
+	s.mtx.Lock()
+	s.md5s = md5s
+	s.mtx.Unlock()
+}
+
+// notify wakes up the readers. It must be called with s.mtx held.
+func (s *Stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Start creates the temporary file where the beatmap is written, and lets the
+// readers start reading. expected is the size of the beatmap, or -1 if it is
+// not known.
+func (s *Stream) Start(expected int64) error {
+	folder := s.house.placeFile(expected)
+	if !s.house.hasFreeSpace(folder) {
+		s.Abort(ErrDiskFull)
+		return ErrDiskFull
+	}
+	f, err := s.b.createTempFile(folder)
+	if err != nil {
+		s.Abort(err)
+		return err
+	}
+	s.mtx.Lock()
+	s.file = f
+	s.folder = folder
+	s.path = f.Name()
+	s.expected = expected
+	s.hash = newHash()
+	s.started = true
+	s.notify()
+	s.mtx.Unlock()
+	return nil
+}
+
+// Write appends p to the beatmap. It must only be called after Start.
+func (s *Stream) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	s.mtx.Lock()
+	s.hash.Write(p[:n])
+	s.size += int64(n)
+	s.notify()
+	s.mtx.Unlock()
+	return n, err
+}
+
+// errNotZip is returned by Commit when the beatmap is not a valid zip file.
+var errNotZip = errors.New("cheesegull/housekeeper: beatmap is not a valid zip file")
+
+// errRestarted is returned to the readers which had already read part of the
+// beatmap when the download is restarted.
+var errRestarted = errors.New("cheesegull/housekeeper: download restarted")
+
+// Validate checks, with ValidateBeatmap, the beatmap which has been written,
+// without committing it.
+func (s *Stream) Validate() error {
+	s.mtx.Lock()
+	size, md5s := s.size, s.md5s
+	s.mtx.Unlock()
+	err := ValidateBeatmap(s.file, size, md5s)
+	if err == nil {
+		s.mtx.Lock()
+		s.validated = size
+		s.mtx.Unlock()
+	}
+	return err
+}
+
+// Restart discards what has been written, for instance because it was not
+// valid, so that the beatmap can be written again from the start. expected is
+// the new size of the beatmap. The readers which had already read part of the
+// beatmap get an error.
+func (s *Stream) Restart(expected int64) error {
+	folder := s.house.placeFile(expected)
+	if !s.house.hasFreeSpace(folder) {
+		s.Abort(ErrDiskFull)
+		return ErrDiskFull
+	}
+	f, err := s.b.createTempFile(folder)
+	if err != nil {
+		s.Abort(err)
+		return err
+	}
+	s.mtx.Lock()
+	old := s.file
+	s.file = f
+	s.folder = folder
+	s.path = f.Name()
+	s.size = 0
+	s.expected = expected
+	s.hash = newHash()
+	s.validated = -1
+	s.gen++
+	s.notify()
+	s.mtx.Unlock()
+	if old != nil {
+		old.Close()
+		os.Remove(old.Name())
+	}
+	return nil
+}
+
+// Commit checks that the beatmap which has been written is valid, unless
+// Validate has already done it, and moves it to its place in the cache, named
+// after its content. If a data folder already holds the same content, the
+// beatmap references that file instead. If the beatmap is not valid, the
+// stream is aborted.
+func (s *Stream) Commit() error {
+	s.mtx.Lock()
+	size, md5s, validated, folder, sum := s.size, s.md5s, s.validated, s.folder, hashSum(s.hash)
+	s.mtx.Unlock()
+	var err error
+	if validated != size {
+		err = ValidateBeatmap(s.file, size, md5s)
+	}
+	if err == nil {
+		folder, err = s.house.storeContent(s.file, folder, sum)
+	}
+	if err != nil {
+		s.Abort(err)
+		return err
+	}
+	name := contentName(sum)
+
+	// the previous version of the beatmap may be in another folder, or have
+	// another name.
+	oldFolder, oldName := s.b.setContent(folder, sum)
+
+	s.mtx.Lock()
+	s.done = true
+	s.folder = folder
+	s.path = folder + name
+	s.notify()
+	s.mtx.Unlock()
+	s.b.finishDownload(s.house, uint64(s.size), nil)
+	s.house.unhold(folder, name)
+	if oldFolder != "" && oldFolder+oldName != folder+name {
+		s.house.release(oldFolder, oldName)
+	}
+
+	b := s.b
+	if b.replaces != nil {
+		b = b.replaces
+	}
+	s.house.offloadInBackground(b, folder)
+	return nil
+}
+
+// checkZip checks that f is a zip file of the given size with a readable
+// central directory.
+func checkZip(f io.ReaderAt, size int64) error {
+	_, err := zip.NewReader(f, size)
+	if err != nil {
+		return errNotZip
+	}
+	return nil
+}
+
+// commitFile flushes the temporary file f to the disk, closes it and moves it
+// to path. This way, a crash never leaves a partially written beatmap at path.
+func commitFile(f *os.File, path string) error {
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+	// make the rename durable as well
+	return syncDir(filepath.Dir(path))
+}
+
+// Adopt completes the download using the file of the beatmap already in the
+// cache, which has the given size. It can be called instead of Start.
+func (s *Stream) Adopt(size int64) {
+	folder := s.b.Folder()
+	s.mtx.Lock()
+	s.started = true
+	s.done = true
+	s.folder = folder
+	s.path = folder + s.b.storedName()
+	s.size = size
+	s.expected = size
+	s.notify()
+	s.mtx.Unlock()
+	s.b.finishDownload(s.house, uint64(size), nil)
+}
+
+// Abort stops the download because of err, which is returned to the readers
+// and to those waiting for the download. The temporary file is removed.
+func (s *Stream) Abort(err error) {
+	s.mtx.Lock()
+	if s.done {
+		s.mtx.Unlock()
+		return
+	}
+	if s.file != nil {
+		// the file may have already been closed by Commit
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+	s.done = true
+	s.err = err
+	s.notify()
+	s.mtx.Unlock()
+	s.b.finishDownload(s.house, 0, err)
+}
+
+// ExpectedSize returns the size of the beatmap, or -1 if it is not known.
+func (s *Stream) ExpectedSize() int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.expected
+}
+
+// NewReader returns a reader of the beatmap, which follows the writer until
+// the download is complete. It waits for the download to start: if the
+// download fails before that, its error is returned. If the download fails
+// later, the error is returned by Read.
+func (s *Stream) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	for {
+		s.mtx.Lock()
+		started, err, path, changed, gen := s.started, s.err, s.path, s.changed, s.gen
+		s.mtx.Unlock()
+
+		switch {
+		case err != nil:
+			return nil, err
+		case !started:
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// the file has just been moved by Commit, or removed by Abort.
+			s.mtx.Lock()
+			moved := s.path != path || s.err != nil || s.gen != gen
+			s.mtx.Unlock()
+			if moved {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &streamReader{s: s, f: f, ctx: ctx, gen: gen}, nil
+	}
+}
+
+type streamReader struct {
+	s   *Stream
+	f   *os.File
+	off int64
+	ctx context.Context
+	gen int
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for {
+		r.s.mtx.Lock()
+		size, done, err, changed, gen, path := r.s.size, r.s.done, r.s.err, r.s.changed, r.s.gen, r.s.path
+		r.s.mtx.Unlock()
+
+		if gen != r.gen && err == nil {
+			if r.off > 0 {
+				return 0, errRestarted
+			}
+			// nothing has been read yet: follow the new download.
+			f, err := os.Open(path)
+			if err != nil {
+				return 0, err
+			}
+			r.f.Close()
+			r.f, r.gen = f, gen
+			continue
+		}
+
+		switch {
+		case r.off < size:
+			if int64(len(p)) > size-r.off {
+				p = p[:size-r.off]
+			}
+			n, err := r.f.ReadAt(p, r.off)
+			r.off += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		case err != nil:
+			return 0, err
+		case done:
+			return 0, io.EOF
+		}
+
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *streamReader) Close() error {
+	return r.f.Close()
+}
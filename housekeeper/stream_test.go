@@ -0,0 +1,176 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// testZip returns a valid zip file containing a single file with the given
+// content.
+func testZip(t *testing.T, content string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	f, err := w.Create("test.osu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(content))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testHouse creates a house storing beatmaps, its state, its failure records,
+// its pinned sets and its quarantine in a temporary folder.
+func testHouse(t *testing.T) *House {
+	dir, err := ioutil.TempDir("", "cheesegull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err = os.Mkdir(dir+"/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := New()
+	h.DataFolders = []string{dir + "/data/"}
+	h.StateFile = dir + "/cgbin.db"
+	h.FailuresFile = dir + "/cgfailures.json"
+	h.PinsFile = dir + "/cgpins.json"
+	h.QuarantineFolder = dir + "/quarantine"
+	return h
+}
+
+func TestStreamFollowWriter(t *testing.T) {
+	h := testHouse(t)
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	s := b.Stream()
+	data := testZip(t, "osu file format v14")
+
+	// readers created before the download starts wait for it
+	const readers = 4
+	var wg sync.WaitGroup
+	results := make([][]byte, readers)
+	errs := make([]error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := s.NewReader(context.Background())
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer r.Close()
+			results[i], errs[i] = ioutil.ReadAll(r)
+		}(i)
+	}
+
+	if err := s.Start(int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		s.Write(data[i:end])
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !bytes.Equal(results[i], data) {
+			t.Fatalf("reader %d: want %d bytes got %d", i, len(data), len(results[i]))
+		}
+	}
+	if !b.IsDownloaded() || b.FileSize() != uint64(len(data)) || b.Stream() != nil {
+		t.Fatalf("beatmap not completed: %v %d", b.IsDownloaded(), b.FileSize())
+	}
+	committed, err := ioutil.ReadFile(b.Folder() + b.storedName())
+	if err != nil || !bytes.Equal(committed, data) {
+		t.Fatalf("committed file differs: %v", err)
+	}
+
+	// readers created after the commit read the committed file
+	r, err := s.NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("reading after commit: %v", err)
+	}
+}
+
+func TestStreamCommitInvalid(t *testing.T) {
+	h := testHouse(t)
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	s := b.Stream()
+	s.Start(-1)
+	s.Write([]byte(zipMagic + "not really a zip"))
+
+	r, err := s.NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := s.Commit(); err != errNotZip {
+		t.Fatalf("want errNotZip got %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err != errNotZip {
+		t.Fatalf("want errNotZip from reader got %v", err)
+	}
+	if _, err := os.Stat(h.DataFolders[0] + b.FileName()); !os.IsNotExist(err) {
+		t.Fatalf("invalid beatmap committed: %v", err)
+	}
+	files, _ := ioutil.ReadDir(h.DataFolders[0])
+	if len(files) != 0 {
+		t.Fatalf("temporary file left behind: %v", files[0].Name())
+	}
+}
+
+func TestStreamAbort(t *testing.T) {
+	h := testHouse(t)
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	s := b.Stream()
+	failure := errors.New("mirror exploded")
+	s.Abort(failure)
+
+	_, err := s.NewReader(context.Background())
+	if err != failure {
+		t.Fatalf("want %v got %v", failure, err)
+	}
+	if b.IsDownloaded() || b.FileSize() != 0 {
+		t.Fatal("failed download recorded as downloaded")
+	}
+	f := h.Failure(1, false)
+	if f == nil || f.Attempts != 1 || f.Reason != failure.Error() {
+		t.Fatalf("failure not recorded: %+v", f)
+	}
+
+	// a cancelled download can be started again straight away
+	if !h.Redownload(b) {
+		t.Fatal("can't download beatmap again")
+	}
+	b.Stream().Abort(context.Canceled)
+	if b.IsDownloaded() {
+		t.Fatal("cancelled download recorded as downloaded")
+	}
+	if f := h.Failure(1, false); f == nil || f.Attempts != 1 {
+		t.Fatalf("cancelled download recorded as failure: %+v", f)
+	}
+}
@@ -0,0 +1,136 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"bufio"
+	"io"
+	"path"
+	"strings"
+)
+
+// videoExtensions are the extensions of the files which are taken as videos,
+// even if no .osu file refers to them.
+var videoExtensions = map[string]bool{
+	".avi":  true,
+	".flv":  true,
+	".m4v":  true,
+	".mkv":  true,
+	".mov":  true,
+	".mp4":  true,
+	".mpeg": true,
+	".mpg":  true,
+	".webm": true,
+	".wmv":  true,
+}
+
+// normalizeZipPath makes the paths used in .osu files comparable to the names
+// of the files in the zip.
+func normalizeZipPath(p string) string {
+	return strings.ToLower(path.Clean(strings.Replace(p, "\\", "/", -1)))
+}
+
+// videoEvents returns the files used as video by the Video events of the .osu
+// file read from r.
+func videoEvents(r io.Reader) []string {
+	var videos []string
+	inEvents := false
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			inEvents = line == "[Events]"
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		// Video,<start time>,"<file name>"; type 1 is the same as Video.
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) == 3 && (fields[0] == "Video" || fields[0] == "1") {
+			videos = append(videos, strings.Trim(strings.TrimSpace(fields[2]), `"`))
+		}
+	}
+	return videos
+}
+
+// Videos returns the names of the files in the zip which are videos: those
+// used by the Video events of the .osu files, and those having the extension
+// of a video.
+func Videos(zr *zip.Reader) ([]string, error) {
+	referenced := make(map[string]bool)
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".osu") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range videoEvents(rc) {
+			referenced[normalizeZipPath(v)] = true
+		}
+		rc.Close()
+	}
+
+	var videos []string
+	for _, f := range zr.File {
+		name := normalizeZipPath(f.Name)
+		if referenced[name] || videoExtensions[path.Ext(name)] {
+			videos = append(videos, f.Name)
+		}
+	}
+	return videos, nil
+}
+
+// StripVideo writes to w the beatmap read from r, which has the given size,
+// without its videos. It returns the number of files removed.
+func StripVideo(w io.Writer, r io.ReaderAt, size int64) (int, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, errNotZip
+	}
+	videos, err := Videos(zr)
+	if err != nil {
+		return 0, err
+	}
+	skip := make(map[string]bool, len(videos))
+	for _, v := range videos {
+		skip[v] = true
+	}
+
+	zw := zip.NewWriter(w)
+	for _, f := range zr.File {
+		if skip[f.Name] {
+			continue
+		}
+		err = copyZipFile(zw, f)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(videos), zw.Close()
+}
+
+// copyZipFile copies f into zw, keeping its name, compression method and
+// modification time.
+func copyZipFile(zw *zip.Writer, f *zip.File) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:           f.Name,
+		Comment:        f.Comment,
+		Method:         f.Method,
+		Modified:       f.Modified,
+		CreatorVersion: f.CreatorVersion,
+		ExternalAttrs:  f.ExternalAttrs,
+	})
+	if err != nil {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(fw, rc)
+	return err
+}
@@ -0,0 +1,83 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const testOsu = `osu file format v14
+
+[General]
+AudioFilename: audio.mp3
+
+[Events]
+//Background and Video events
+Video,-200,"SB\Intro.AVI"
+0,0,"bg.jpg",0,0
+`
+
+func TestStripVideo(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	files := map[string]string{
+		"test [Insane].osu": testOsu,
+		"audio.mp3":         "audio",
+		"bg.jpg":            "background",
+		"sb/intro.avi":      "video referenced by the .osu",
+		"other.mp4":         "video found by extension",
+	}
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	removed, err := StripVideo(out, bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("want 2 videos removed got %d", removed)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(content) != files[f.Name] {
+			t.Fatalf("%s: unexpected content %q (%v)", f.Name, content, err)
+		}
+	}
+	sort.Strings(names)
+	want := []string{"audio.mp3", "bg.jpg", "test [Insane].osu"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("want files %v got %v", want, names)
+	}
+}
+
+func TestStripVideoNotZip(t *testing.T) {
+	data := []byte(zipMagic + "not really a zip")
+	_, err := StripVideo(ioutil.Discard, bytes.NewReader(data), int64(len(data)))
+	if err != errNotZip {
+		t.Fatalf("want errNotZip got %v", err)
+	}
+}
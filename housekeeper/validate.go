@@ -0,0 +1,75 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ErrInvalidBeatmap is returned, wrapped, when a beatmap is a valid zip file
+// but not what was expected.
+var ErrInvalidBeatmap = errors.New("cheesegull/housekeeper: invalid beatmap")
+
+// IsInvalid tells whether err is returned because a beatmap is not valid, as
+// opposed to an error while reading it.
+func IsInvalid(err error) bool {
+	return err == errNotZip || errors.Is(err, ErrInvalidBeatmap)
+}
+
+// ValidateBeatmap checks that r, of the given size, is a beatmap: a zip file
+// with an intact central directory, containing at least a .osu file. If md5s
+// is not empty, the MD5 of each .osu file must be one of them, which catches
+// the outdated versions of the beatmap.
+func ValidateBeatmap(r io.ReaderAt, size int64, md5s []string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errNotZip
+	}
+	expected := make(map[string]bool, len(md5s))
+	for _, m := range md5s {
+		expected[strings.ToLower(m)] = true
+	}
+
+	osuFiles := 0
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".osu") {
+			continue
+		}
+		osuFiles++
+		if len(expected) == 0 {
+			continue
+		}
+		sum, err := zipFileMD5(f)
+		if err != nil {
+			return err
+		}
+		if !expected[sum] {
+			return fmt.Errorf("%w: %s has MD5 %s, which is not in the metadata of the set", ErrInvalidBeatmap, f.Name, sum)
+		}
+	}
+	if osuFiles == 0 {
+		return fmt.Errorf("%w: no .osu file", ErrInvalidBeatmap)
+	}
+	return nil
+}
+
+// zipFileMD5 returns the hex MD5 of the content of f.
+func zipFileMD5(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrInvalidBeatmap, f.Name, err)
+	}
+	defer rc.Close()
+	h := md5.New()
+	_, err = io.Copy(h, rc)
+	if err != nil {
+		// the checksum or the compressed data are broken
+		return "", fmt.Errorf("%w: %s: %v", ErrInvalidBeatmap, f.Name, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
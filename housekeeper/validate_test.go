@@ -0,0 +1,113 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func testArchive(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestValidateBeatmap(t *testing.T) {
+	const easy, hard = "osu file format v14\n[Easy]", "osu file format v14\n[Hard]"
+	valid := testArchive(t, map[string]string{"easy.osu": easy, "hard.osu": hard, "audio.mp3": "audio"})
+	truncated := valid[:len(valid)-10]
+	tests := []struct {
+		name    string
+		data    []byte
+		md5s    []string
+		invalid bool
+	}{
+		{"valid", valid, []string{md5Hex(easy), md5Hex(hard), md5Hex("another diff")}, false},
+		{"no metadata", valid, nil, false},
+		{"outdated", valid, []string{md5Hex(easy), md5Hex("new hard")}, true},
+		{"no .osu", testArchive(t, map[string]string{"index.html": "<html>"}), nil, true},
+		{"truncated", truncated, nil, true},
+		{"not zip", []byte("<html>"), nil, true},
+	}
+	for _, tt := range tests {
+		err := ValidateBeatmap(bytes.NewReader(tt.data), int64(len(tt.data)), tt.md5s)
+		if tt.invalid != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if err != nil && !IsInvalid(err) {
+			t.Errorf("%s: error %v is not an invalid beatmap error", tt.name, err)
+		}
+	}
+}
+
+func TestStreamRestart(t *testing.T) {
+	h := testHouse(t)
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	s := b.Stream()
+	good := testArchive(t, map[string]string{"easy.osu": "good"})
+	s.Expect([]string{md5Hex("good")})
+
+	s.Start(-1)
+	early, err := s.NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer early.Close()
+	partial, err := s.NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.Close()
+
+	s.Write(testArchive(t, map[string]string{"easy.osu": "outdated"}))
+	if _, err := partial.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(); !errors.Is(err, ErrInvalidBeatmap) {
+		t.Fatalf("want ErrInvalidBeatmap got %v", err)
+	}
+
+	if err := s.Restart(int64(len(good))); err != nil {
+		t.Fatal(err)
+	}
+	s.Write(good)
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader which had not read anything follows the new download
+	data, err := ioutil.ReadAll(early)
+	if err != nil || !bytes.Equal(data, good) {
+		t.Fatalf("unexpected data from restarted download (%v)", err)
+	}
+	if _, err := ioutil.ReadAll(partial); err != errRestarted {
+		t.Fatalf("want errRestarted got %v", err)
+	}
+	files, _ := ioutil.ReadDir(h.DataFolders[0])
+	if len(files) != 1 || files[0].Name() != b.storedName() {
+		t.Fatalf("unexpected files in the cache: %v", files)
+	}
+}
@@ -0,0 +1,129 @@
+package housekeeper
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDiskFull is returned when a beatmap can't be downloaded because the free
+// space of every data folder is below CriticalFree.
+var ErrDiskFull = errors.New("cheesegull/housekeeper: disk critically full")
+
+// diskFree returns the space left on the disk holding path. It is a variable
+// so that the tests can fake the disks.
+var diskFree = statfs
+
+// diskDevice returns the ID of the disk holding path, so that the folders on
+// the same disk are counted once.
+var diskDevice = device
+
+// freeSpaceToRemove returns the beatmaps to evict so that the free space of
+// every disk holding a data folder is back over HighFree, once it has dropped
+// below LowFree. toRemove are the beatmaps already being removed, whose space
+// is counted as free.
+func (h *House) freeSpaceToRemove(toRemove []*CachedBeatmap) []*CachedBeatmap {
+	if h.LowFree == 0 {
+		return nil
+	}
+	high := h.HighFree
+	if high < h.LowFree {
+		high = h.LowFree
+	}
+
+	// the folders on the same disk share its free space.
+	type disk struct {
+		free    uint64
+		folders []string
+	}
+	var disks []*disk
+	byDevice := make(map[uint64]*disk)
+	diskOf := make(map[string]*disk)
+	for _, f := range h.folders() {
+		free, err := diskFree(f.Path)
+		if err != nil {
+			continue
+		}
+		dev, err := diskDevice(f.Path)
+		d := byDevice[dev]
+		if err != nil || d == nil {
+			d = &disk{free: free}
+			disks = append(disks, d)
+			if err == nil {
+				byDevice[dev] = d
+			}
+		}
+		d.folders = append(d.folders, f.Path)
+		diskOf[f.Path] = d
+	}
+	for _, b := range toRemove {
+		if d := diskOf[b.Folder()]; d != nil {
+			d.free += h.freedBy(b)
+		}
+	}
+
+	var removed []*CachedBeatmap
+	for _, d := range disks {
+		if d.free >= h.LowFree {
+			continue
+		}
+		need := high - d.free
+		for _, folder := range d.folders {
+			for _, b := range h.index.evictFolder(folder, need) {
+				removed = append(removed, b)
+				size := h.freedBy(b)
+				if size >= need {
+					need = 0
+				} else {
+					need -= size
+				}
+			}
+			if need == 0 {
+				break
+			}
+		}
+	}
+	return removed
+}
+
+// DiskFull tells whether the free space of every data folder is below
+// CriticalFree, in which case new beatmaps can't be downloaded. It schedules
+// a cleanup to make room.
+func (h *House) DiskFull() bool {
+	if h.CriticalFree == 0 {
+		return false
+	}
+	for _, f := range h.folders() {
+		if h.hasFreeSpace(f.Path) {
+			return false
+		}
+	}
+	h.scheduleCleanup()
+	return true
+}
+
+// hasFreeSpace tells whether the free space of the disk holding folder is
+// over CriticalFree. The disks whose free space is not known are taken as
+// having room.
+func (h *House) hasFreeSpace(folder string) bool {
+	if h.CriticalFree == 0 {
+		return true
+	}
+	free, err := diskFree(folder)
+	return err != nil || free >= h.CriticalFree
+}
+
+// startFreeSpaceTicker schedules a cleanup every FreeSpaceInterval, so that
+// the free space is checked even when no beatmap is downloaded, for instance
+// when another process fills the disk.
+func (h *House) startFreeSpaceTicker() {
+	if h.FreeSpaceInterval <= 0 || (h.LowFree == 0 && h.CriticalFree == 0) {
+		return
+	}
+	go func() {
+		t := time.NewTicker(h.FreeSpaceInterval)
+		defer t.Stop()
+		for range t.C {
+			h.scheduleCleanup()
+		}
+	}()
+}
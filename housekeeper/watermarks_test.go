@@ -0,0 +1,89 @@
+package housekeeper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeDisks makes each folder look like it is on the disk given by devices,
+// with the free space given by free.
+func fakeDisks(t *testing.T, devices map[string]uint64, free map[uint64]uint64) {
+	oldFree, oldDevice := diskFree, diskDevice
+	t.Cleanup(func() {
+		diskFree, diskDevice = oldFree, oldDevice
+	})
+	diskFree = func(path string) (uint64, error) {
+		return free[devices[path]], nil
+	}
+	diskDevice = func(path string) (uint64, error) {
+		return devices[path], nil
+	}
+}
+
+func TestFreeSpaceWatermarks(t *testing.T) {
+	h := testFolders(t, Folder{}, Folder{}, Folder{})
+	a1, a2, b := h.DataFolders[0], h.DataFolders[1], h.DataFolders[2]
+	free := map[uint64]uint64{1: 1000, 2: 1000}
+	fakeDisks(t, map[string]uint64{a1: 1, a2: 1, b: 2}, free)
+	h.LowFree, h.HighFree = 100, 200
+
+	base := time.Now().Add(-time.Hour)
+	for i, folder := range []string{a1, a2, a1, a2, b} {
+		storeTestBeatmap(t, h, i+1, folder, 50, base.Add(time.Duration(i)*time.Minute))
+	}
+
+	h.dryRun = make([]*CachedBeatmap, 0)
+	h.CleanUp()
+	if len(h.dryRun) != 0 {
+		t.Fatalf("want nothing removed got %v", h.dryRun)
+	}
+
+	// the first disk needs 150 bytes more: its oldest beatmaps go, whatever
+	// their folder.
+	free[1] = 50
+	h.CleanUp()
+	var ids []int
+	for _, b := range h.dryRun {
+		ids = append(ids, b.ID)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("want 3 beatmaps removed got %v", ids)
+	}
+	for _, id := range ids {
+		if id == 5 {
+			t.Fatalf("beatmap removed from the other disk: %v", ids)
+		}
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	h := testFolders(t, Folder{}, Folder{})
+	free := map[uint64]uint64{1: 10, 2: 1000}
+	fakeDisks(t, map[string]uint64{h.DataFolders[0]: 1, h.DataFolders[1]: 2}, free)
+
+	if h.DiskFull() {
+		t.Fatal("disk full without CriticalFree")
+	}
+	h.CriticalFree = 100
+	if h.DiskFull() {
+		t.Fatal("disk full while a folder has room")
+	}
+
+	free[2] = 50
+	if !h.DiskFull() {
+		t.Fatal("want disk full")
+	}
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	err := b.Stream().Start(-1)
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("want ErrDiskFull got %v", err)
+	}
+	if err := b.Wait(context.Background()); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("want ErrDiskFull from Wait got %v", err)
+	}
+	if f := h.Failure(1, false); f != nil {
+		t.Fatalf("full disk recorded as a failure: %+v", f)
+	}
+}
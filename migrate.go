@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	migrateCmd       = kingpin.Command("migrate", "Manage the migrations of the database.")
+	migrateUpCmd     = migrateCmd.Command("up", "Apply all the pending migrations.")
+	migrateDownCmd   = migrateCmd.Command("down", "Revert the latest applied migrations.")
+	migrateDownSteps = migrateDownCmd.Arg("steps", "Number of migrations to revert.").Default("1").Int()
+	migrateStatusCmd = migrateCmd.Command("status", "Show the status of every migration.")
+)
+
+func migrateUp() {
+	err := openDB().MigrateUp()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Database is up to date.")
+}
+
+func migrateDown() {
+	reverted, err := openDB().MigrateDown(*migrateDownSteps)
+	fmt.Println("Reverted", reverted, "migration(s).")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func migrateStatus() {
+	statuses, err := openDB().MigrationStatus()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED AT")
+	for _, ms := range statuses {
+		status := "pending"
+		switch {
+		case ms.Unknown:
+			status = "unknown"
+		case ms.Dirty:
+			status = "dirty"
+		case ms.Modified:
+			status = "modified"
+		case ms.Applied:
+			status = "applied"
+		}
+		appliedAt := "-"
+		if ms.Applied {
+			appliedAt = ms.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", ms.Version, status, appliedAt)
+	}
+	w.Flush()
+}
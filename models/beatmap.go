@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 )
 
 // Beatmap represents a single beatmap (difficulty) on osu!.
@@ -51,6 +52,14 @@ beatmaps.id, beatmaps.parent_set_id, beatmaps.diff_name, beatmaps.file_md5, beat
 beatmaps.ar, beatmaps.od, beatmaps.cs, beatmaps.hp, beatmaps.total_length, beatmaps.hit_length,
 beatmaps.playcount, beatmaps.passcount, beatmaps.max_combo, beatmaps.difficulty_rating`
 
+// beatmapColumns are the beatmapFields without the table name, as neither
+// SQLite nor PostgreSQL allow qualified column names in INSERT statements.
+var beatmapColumns = []string{
+	"id", "parent_set_id", "diff_name", "file_md5", "mode", "bpm",
+	"ar", "od", "cs", "hp", "total_length", "hit_length",
+	"playcount", "passcount", "max_combo", "difficulty_rating",
+}
+
 func readBeatmapsFromRows(rows *sql.Rows, capacity int) ([]Beatmap, error) {
 	var err error
 	bms := make([]Beatmap, 0, capacity)
@@ -118,14 +127,14 @@ func sIntToSInterface(i []int) []interface{} {
 }
 
 // FetchBeatmaps retrieves a list of beatmap knowing their IDs.
-func FetchBeatmaps(db *sql.DB, ids ...int) ([]Beatmap, error) {
+func (s *Store) FetchBeatmaps(ids ...int) ([]Beatmap, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
 
 	q := `SELECT ` + beatmapFields + ` FROM beatmaps WHERE id IN (` + inClause(len(ids)) + `)`
 
-	rows, err := db.Query(q, sIntToSInterface(ids)...)
+	rows, err := s.query(q, sIntToSInterface(ids)...)
 	if err != nil {
 		return nil, err
 	}
@@ -133,15 +142,15 @@ func FetchBeatmaps(db *sql.DB, ids ...int) ([]Beatmap, error) {
 	return readBeatmapsFromRows(rows, len(ids))
 }
 
-// FetchBeatmaps retrieves a list of beatmap knowing their IDs.
-func FetchBeatmapsByMd5(db *sql.DB, md5 string) ([]Beatmap, error) {
+// FetchBeatmapsByMd5 retrieves the beatmaps having the given file MD5.
+func (s *Store) FetchBeatmapsByMd5(md5 string) ([]Beatmap, error) {
 	if len(md5) == 0 {
 		return nil, nil
 	}
 
 	q := `SELECT ` + beatmapFields + ` FROM beatmaps WHERE file_md5 = ? `
 
-	rows, err := db.Query(q, md5)
+	rows, err := s.query(q, md5)
 	if err != nil {
 		return nil, err
 	}
@@ -149,15 +158,15 @@ func FetchBeatmapsByMd5(db *sql.DB, md5 string) ([]Beatmap, error) {
 	return readBeatmapsFromRows(rows, 1)
 }
 
-// FetchBeatmaps retrieves a list of beatmap knowing their IDs.
-func FetchBeatmapsChimu(db *sql.DB, ids ...int) ([]BeatmapChimu, error) {
+// FetchBeatmapsChimu retrieves a list of beatmap knowing their IDs.
+func (s *Store) FetchBeatmapsChimu(ids ...int) ([]BeatmapChimu, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
 
-	q := `SELECT ` + beatmapFields + `, sets.artist, sets.title, sets.creator FROM beatmaps RIGHT JOIN sets ON sets.id = beatmaps.parent_set_id WHERE beatmaps.id IN (` + inClause(len(ids)) + `)`
+	q := `SELECT ` + beatmapFields + `, sets.artist, sets.title, sets.creator FROM beatmaps INNER JOIN sets ON sets.id = beatmaps.parent_set_id WHERE beatmaps.id IN (` + inClause(len(ids)) + `)`
 
-	rows, err := db.Query(q, sIntToSInterface(ids)...)
+	rows, err := s.query(q, sIntToSInterface(ids)...)
 	if err != nil {
 		return nil, err
 	}
@@ -165,13 +174,23 @@ func FetchBeatmapsChimu(db *sql.DB, ids ...int) ([]BeatmapChimu, error) {
 	return readBeatmapsFromRowsChimu(rows, len(ids))
 }
 
-// CreateBeatmaps adds beatmaps in the database.
-func CreateBeatmaps(db *sql.DB, bms ...Beatmap) error {
+// CreateBeatmaps adds beatmaps in the database, updating those which already
+// exist.
+func (s *Store) CreateBeatmaps(bms ...Beatmap) error {
+	return s.createBeatmaps(s.DB, bms...)
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *Store) createBeatmaps(e execer, bms ...Beatmap) error {
 	if len(bms) == 0 {
 		return nil
 	}
 
-	q := `INSERT IGNORE INTO beatmaps(` + beatmapFields + `) VALUES `
+	q := `INSERT INTO beatmaps(` + strings.Join(beatmapColumns, ", ") + `) VALUES `
 	const valuePlaceholder = `(
 		?, ?, ?, ?, ?, ?,
 		?, ?, ?, ?, ?, ?,
@@ -191,6 +210,8 @@ func CreateBeatmaps(db *sql.DB, bms ...Beatmap) error {
 		)
 	}
 
-	_, err := db.Exec(q, args...)
+	q += s.Dialect.Upsert(beatmapColumns[:1], beatmapColumns[1:])
+
+	_, err := e.Exec(s.Dialect.Rebind(q), args...)
 	return err
 }
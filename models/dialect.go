@@ -0,0 +1,201 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect abstracts away the differences between the SQL flavours spoken by
+// the databases CheeseGull can keep its metadata in.
+type Dialect interface {
+	// Name returns the name of the dialect. This is also the name of the
+	// database/sql driver that must be used with it.
+	Name() string
+	// DSN adds to dsn whatever option is needed by the models package to
+	// work properly with the dialect.
+	DSN(dsn string) string
+	// Rebind replaces the ? placeholders in query with the ones used by the
+	// dialect.
+	Rebind(query string) string
+	// Upsert returns the clause to append to an INSERT statement so that the
+	// rows conflicting with existing ones on keys update the given columns
+	// instead.
+	Upsert(keys, columns []string) string
+	// HasTable checks whether table exists in the database.
+	HasTable(db *sql.DB, table string) (bool, error)
+
+	// setUp configures the connection pool of a newly opened database.
+	setUp(db *sql.DB)
+	// transactionalDDL reports whether statements such as CREATE TABLE can
+	// be rolled back as part of a transaction.
+	transactionalDDL() bool
+	// timestampType is the type of the columns holding a date and time.
+	timestampType() string
+}
+
+var (
+	// MySQL is the dialect for MySQL and MariaDB.
+	MySQL Dialect = mysqlDialect{}
+	// SQLite is the dialect for SQLite 3, useful for small deployments and
+	// tests as it does not require any external service.
+	SQLite Dialect = sqliteDialect{}
+	// PostgreSQL is the dialect for PostgreSQL 12 and above.
+	PostgreSQL Dialect = postgresDialect{}
+)
+
+var dialects = map[string]Dialect{
+	MySQL.Name():      MySQL,
+	SQLite.Name():     SQLite,
+	PostgreSQL.Name(): PostgreSQL,
+}
+
+// DialectByName returns the Dialect having the given name.
+func DialectByName(name string) (Dialect, error) {
+	d, ok := dialects[name]
+	if !ok {
+		return nil, fmt.Errorf("cheesegull/models: unknown dialect %q", name)
+	}
+	return d, nil
+}
+
+func addDSNOptions(dsn, options string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + options
+}
+
+// onConflictUpsert is the upsert clause used by both SQLite and PostgreSQL.
+func onConflictUpsert(keys, columns []string) string {
+	b := strings.Builder{}
+	b.WriteString(" ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET ")
+	for idx, c := range columns {
+		if idx != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c + " = excluded." + c)
+	}
+	return b.String()
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string { return "mysql" }
+
+func (mysqlDialect) DSN(dsn string) string {
+	return addDSNOptions(dsn, "parseTime=true&multiStatements=true")
+}
+
+func (mysqlDialect) Rebind(query string) string { return query }
+
+func (mysqlDialect) Upsert(keys, columns []string) string {
+	b := strings.Builder{}
+	b.WriteString(" ON DUPLICATE KEY UPDATE ")
+	for idx, c := range columns {
+		if idx != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c + " = VALUES(" + c + ")")
+	}
+	return b.String()
+}
+
+func (mysqlDialect) HasTable(db *sql.DB, table string) (bool, error) {
+	var name string
+	err := db.QueryRow("SHOW TABLES LIKE ?", table).Scan(&name)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (mysqlDialect) setUp(db *sql.DB) {}
+
+func (mysqlDialect) transactionalDDL() bool { return false }
+
+func (mysqlDialect) timestampType() string { return "DATETIME" }
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite3" }
+
+func (sqliteDialect) DSN(dsn string) string {
+	// foreign keys are disabled by default on SQLite, and we need them for
+	// ON DELETE CASCADE.
+	return addDSNOptions(dsn, "_foreign_keys=1")
+}
+
+func (sqliteDialect) Rebind(query string) string { return query }
+
+func (sqliteDialect) Upsert(keys, columns []string) string {
+	return onConflictUpsert(keys, columns)
+}
+
+func (sqliteDialect) HasTable(db *sql.DB, table string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+	return n > 0, err
+}
+
+func (sqliteDialect) setUp(db *sql.DB) {
+	// SQLite only allows one writer at a time, so by sharing a single
+	// connection we avoid getting "database is locked" errors. This also
+	// makes in-memory databases work, as every connection to ":memory:"
+	// would otherwise get a database of its own.
+	db.SetMaxOpenConns(1)
+}
+
+func (sqliteDialect) transactionalDDL() bool { return true }
+
+func (sqliteDialect) timestampType() string { return "DATETIME" }
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) DSN(dsn string) string { return dsn }
+
+// Rebind replaces every ? in query with $1, $2 and so on. None of the queries
+// in the models package contain question marks in string literals, so there
+// is no need to actually parse the query.
+func (postgresDialect) Rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	b := make([]byte, 0, len(query)+16)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '?' {
+			b = append(b, query[i])
+			continue
+		}
+		n++
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(n), 10)
+	}
+	return string(b)
+}
+
+func (postgresDialect) Upsert(keys, columns []string) string {
+	return onConflictUpsert(keys, columns)
+}
+
+func (postgresDialect) HasTable(db *sql.DB, table string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.tables "+
+		"WHERE table_schema = current_schema() AND table_name = $1", table).Scan(&n)
+	return n > 0, err
+}
+
+func (postgresDialect) setUp(db *sql.DB) {}
+
+func (postgresDialect) transactionalDDL() bool { return true }
+
+func (postgresDialect) timestampType() string { return "TIMESTAMP" }
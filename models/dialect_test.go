@@ -0,0 +1,59 @@
+package models
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tt := []struct {
+		d        Dialect
+		in, want string
+	}{
+		{MySQL, "SELECT 1 FROM sets WHERE id = ? AND ranked_status = ?", "SELECT 1 FROM sets WHERE id = ? AND ranked_status = ?"},
+		{SQLite, "SELECT 1 FROM sets WHERE id = ?", "SELECT 1 FROM sets WHERE id = ?"},
+		{PostgreSQL, "SELECT 1 FROM sets", "SELECT 1 FROM sets"},
+		{PostgreSQL, "SELECT 1 FROM sets WHERE id = ? AND ranked_status = ?", "SELECT 1 FROM sets WHERE id = $1 AND ranked_status = $2"},
+		{PostgreSQL, inClause(11), "$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11"},
+	}
+	for _, tc := range tt {
+		got := tc.d.Rebind(tc.in)
+		if got != tc.want {
+			t.Errorf("%s: want %q got %q", tc.d.Name(), tc.want, got)
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	keys := []string{"id"}
+	cols := []string{"title", "artist"}
+	tt := []struct {
+		d    Dialect
+		want string
+	}{
+		{MySQL, " ON DUPLICATE KEY UPDATE title = VALUES(title), artist = VALUES(artist)"},
+		{SQLite, " ON CONFLICT (id) DO UPDATE SET title = excluded.title, artist = excluded.artist"},
+		{PostgreSQL, " ON CONFLICT (id) DO UPDATE SET title = excluded.title, artist = excluded.artist"},
+	}
+	for _, tc := range tt {
+		got := tc.d.Upsert(keys, cols)
+		if got != tc.want {
+			t.Errorf("%s: want %q got %q", tc.d.Name(), tc.want, got)
+		}
+	}
+}
+
+func TestDialectByName(t *testing.T) {
+	for _, name := range []string{"mysql", "sqlite3", "postgres"} {
+		d, err := DialectByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Name() != name {
+			t.Errorf("want %s got %s", name, d.Name())
+		}
+		if len(migrations[name]) == 0 {
+			t.Errorf("no migrations for %s", name)
+		}
+	}
+	if _, err := DialectByName("oracle"); err == nil {
+		t.Error("want error for unknown dialect")
+	}
+}
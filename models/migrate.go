@@ -0,0 +1,325 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Migration is a single versioned change to the schema of the database.
+type Migration struct {
+	Version int
+	Up      string
+	Down    string
+}
+
+// Checksum returns the SHA-256 of the Up statements of the migration, which is
+// stored alongside the applied migrations to detect the ones edited after
+// having been applied.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationStatus is the state of a migration in the database.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Dirty is set when the migration failed half-way on a dialect which
+	// does not support transactional DDL, or when it is still being applied.
+	Dirty bool
+	// Modified is set when the migration has been edited after having been
+	// applied.
+	Modified bool
+	// Unknown is set when the migration has been applied to the database,
+	// but it is not known to this version of CheeseGull.
+	Unknown bool
+}
+
+// Errors returned by CheckMigrations, MigrateUp and MigrateDown.
+var (
+	ErrPendingMigrations = errors.New("cheesegull/models: there are pending migrations")
+	ErrDirtyMigration    = errors.New("cheesegull/models: a migration failed half-way and the database must be fixed by hand")
+	ErrModifiedMigration = errors.New("cheesegull/models: a migration has been modified after being applied")
+	ErrUnknownMigration  = errors.New("cheesegull/models: the database has migrations unknown to this version of cheesegull")
+	ErrIrreversible      = errors.New("cheesegull/models: migration can't be reverted")
+)
+
+// setUpMigrations creates the schema_migrations table if it does not exist
+// yet. If the database was migrated by a version of CheeseGull using the
+// db_version table, the migrations it applied are imported.
+func (s *Store) setUpMigrations() error {
+	exists, err := s.Dialect.HasTable(s.DB, "schema_migrations")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = s.DB.Exec(`CREATE TABLE schema_migrations(
+	version INTEGER NOT NULL,
+	checksum CHAR(64) NOT NULL,
+	dirty BOOLEAN NOT NULL,
+	applied_at ` + s.Dialect.timestampType() + ` NOT NULL,
+	PRIMARY KEY(version)
+)`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// db_version is only dropped once the import is complete: if it is still
+	// there, the import was interrupted and must be done again.
+	legacy, err := s.Dialect.HasTable(s.DB, "db_version")
+	if err != nil || !legacy {
+		return err
+	}
+	if !s.Dialect.transactionalDDL() {
+		return s.importLegacyVersion(s.DB)
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	err = s.importLegacyVersion(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// importLegacyVersion records in schema_migrations the migrations applied
+// according to db_version, skipping those already recorded, and drops
+// db_version.
+func (s *Store) importLegacyVersion(db querier) error {
+	// db_version contains the index of the last migration applied.
+	var version int
+	err := db.QueryRow("SELECT version FROM db_version").Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	for i := 0; i <= version && i < len(s.migrations); i++ {
+		var n int
+		err = db.QueryRow(s.Dialect.Rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"),
+			s.migrations[i].Version).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		_, err = db.Exec(s.Dialect.Rebind("INSERT INTO schema_migrations(version, checksum, dirty, applied_at) VALUES (?, ?, ?, ?)"),
+			s.migrations[i].Version, s.migrations[i].Checksum(), false, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("DROP TABLE db_version")
+	return err
+}
+
+// MigrationStatus returns the status of all the migrations, sorted by
+// version.
+func (s *Store) MigrationStatus() ([]MigrationStatus, error) {
+	err := s.setUpMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.query("SELECT version, checksum, dirty, applied_at FROM schema_migrations ORDER BY version ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make([]MigrationStatus, 0, len(s.migrations))
+	i := 0
+	for rows.Next() {
+		var (
+			ms       MigrationStatus
+			checksum string
+		)
+		err = rows.Scan(&ms.Version, &checksum, &ms.Dirty, &ms.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		ms.Applied = true
+
+		// add the migrations which have not been applied, coming before this
+		for ; i < len(s.migrations) && s.migrations[i].Version < ms.Version; i++ {
+			statuses = append(statuses, MigrationStatus{Migration: s.migrations[i]})
+		}
+		if i < len(s.migrations) && s.migrations[i].Version == ms.Version {
+			ms.Migration = s.migrations[i]
+			ms.Modified = ms.Checksum() != checksum
+			i++
+		} else {
+			ms.Unknown = true
+		}
+		statuses = append(statuses, ms)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for ; i < len(s.migrations); i++ {
+		statuses = append(statuses, MigrationStatus{Migration: s.migrations[i]})
+	}
+
+	return statuses, nil
+}
+
+// checkStatuses makes sure that there are no dirty, modified or unknown
+// migrations. If pending is true, pending migrations are an error as well.
+func checkStatuses(statuses []MigrationStatus, pending bool) error {
+	for _, ms := range statuses {
+		switch {
+		case ms.Dirty:
+			return fmt.Errorf("%w (version %d)", ErrDirtyMigration, ms.Version)
+		case ms.Modified:
+			return fmt.Errorf("%w (version %d)", ErrModifiedMigration, ms.Version)
+		case ms.Unknown:
+			return fmt.Errorf("%w (version %d)", ErrUnknownMigration, ms.Version)
+		case pending && !ms.Applied:
+			return fmt.Errorf("%w (version %d)", ErrPendingMigrations, ms.Version)
+		}
+	}
+	return nil
+}
+
+// CheckMigrations returns an error if the database is not exactly at the
+// latest migration, or if any of the applied migrations failed or has been
+// edited.
+func (s *Store) CheckMigrations() error {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	return checkStatuses(statuses, true)
+}
+
+// RunMigrations brings the database up to date following the migrations.
+// It is the same as MigrateUp.
+func (s *Store) RunMigrations() error {
+	return s.MigrateUp()
+}
+
+// MigrateUp applies all the pending migrations, in order. Every migration is
+// applied in its own transaction, if the dialect allows it.
+func (s *Store) MigrateUp() error {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	err = checkStatuses(statuses, false)
+	if err != nil {
+		return err
+	}
+
+	for _, ms := range statuses {
+		if ms.Applied {
+			continue
+		}
+		err = s.migrate(ms.Migration, true)
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", ms.Version, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts the last steps migrations applied, and returns the
+// number of migrations it reverted, which is lower if there were fewer applied
+// migrations or if reverting one failed.
+func (s *Store) MigrateDown(steps int) (int, error) {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+	reverted := 0
+
+	for i := len(statuses) - 1; i >= 0 && steps > 0; i-- {
+		ms := statuses[i]
+		if !ms.Applied {
+			continue
+		}
+		// reverting a dirty migration is allowed, as it is the way to get
+		// back to a known state when a migration failed half-way.
+		switch {
+		case ms.Unknown:
+			return reverted, fmt.Errorf("%w (version %d)", ErrUnknownMigration, ms.Version)
+		case ms.Modified:
+			return reverted, fmt.Errorf("%w (version %d)", ErrModifiedMigration, ms.Version)
+		case ms.Down == "":
+			return reverted, fmt.Errorf("%w (version %d)", ErrIrreversible, ms.Version)
+		}
+		err = s.migrate(ms.Migration, false)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d: %w", ms.Version, err)
+		}
+		steps--
+		reverted++
+	}
+	return reverted, nil
+}
+
+// migrate applies m if up is true, and reverts it otherwise.
+func (s *Store) migrate(m Migration, up bool) error {
+	stmts := m.Up
+	if !up {
+		stmts = m.Down
+	}
+
+	if s.Dialect.transactionalDDL() {
+		tx, err := s.DB.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(stmts)
+		if err == nil {
+			if up {
+				_, err = tx.Exec(s.Dialect.Rebind("INSERT INTO schema_migrations(version, checksum, dirty, applied_at) VALUES (?, ?, ?, ?)"),
+					m.Version, m.Checksum(), false, time.Now().UTC())
+			} else {
+				_, err = tx.Exec(s.Dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), m.Version)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// The dialect does not support rolling back DDL statements, so the
+	// migration is marked as dirty while it is running: this way, if it
+	// fails half-way, we know the database needs manual intervention.
+	var err error
+	if up {
+		_, err = s.exec("INSERT INTO schema_migrations(version, checksum, dirty, applied_at) VALUES (?, ?, ?, ?)",
+			m.Version, m.Checksum(), true, time.Now().UTC())
+	} else {
+		_, err = s.exec("UPDATE schema_migrations SET dirty = ? WHERE version = ?", true, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(stmts)
+	if err != nil {
+		return err
+	}
+	if up {
+		_, err = s.exec("UPDATE schema_migrations SET dirty = ? WHERE version = ?", false, m.Version)
+	} else {
+		_, err = s.exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+	}
+	return err
+}
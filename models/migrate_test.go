@@ -0,0 +1,202 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func appliedCount(t *testing.T, s *Store) int {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, ms := range statuses {
+		if ms.Applied {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	s := openTestStore(t)
+	total := len(s.migrations)
+
+	err := s.CheckMigrations()
+	if !errors.Is(err, ErrPendingMigrations) {
+		t.Fatalf("want ErrPendingMigrations got %v", err)
+	}
+
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := appliedCount(t, s); n != total {
+		t.Fatalf("want %d applied migrations got %d", total, n)
+	}
+	if err = s.CheckMigrations(); err != nil {
+		t.Fatal(err)
+	}
+
+	reverted, err := s.MigrateDown(1)
+	if err != nil || reverted != 1 {
+		t.Fatalf("want 1 reverted migration got %d, %v", reverted, err)
+	}
+	if n := appliedCount(t, s); n != total-1 {
+		t.Fatalf("want %d applied migrations got %d", total-1, n)
+	}
+
+	reverted, err = s.MigrateDown(total)
+	if err != nil || reverted != total-1 {
+		t.Fatalf("want %d reverted migrations got %d, %v", total-1, reverted, err)
+	}
+	exists, err := s.Dialect.HasTable(s.DB, "sets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("sets still exists after reverting all migrations")
+	}
+
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := appliedCount(t, s); n != total {
+		t.Fatalf("want %d applied migrations got %d", total, n)
+	}
+}
+
+func TestMigrateModified(t *testing.T) {
+	s := openTestStore(t)
+	err := s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.DB.Exec("UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CheckMigrations()
+	if !errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("want ErrModifiedMigration got %v", err)
+	}
+	err = s.MigrateUp()
+	if !errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("want ErrModifiedMigration got %v", err)
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	s := openTestStore(t)
+	s.migrations = append(s.migrations[:len(s.migrations):len(s.migrations)], Migration{
+		Version: 1000,
+		Up:      "CREATE TABLE half_applied(id INTEGER); SELECT * FROM does_not_exist;",
+	})
+
+	err := s.MigrateUp()
+	if err == nil {
+		t.Fatal("want error from broken migration")
+	}
+	// all the migrations before the broken one must have been recorded
+	if n := appliedCount(t, s); n != len(s.migrations)-1 {
+		t.Fatalf("want %d applied migrations got %d", len(s.migrations)-1, n)
+	}
+	// SQLite supports transactional DDL, so the table must not exist
+	exists, err := s.Dialect.HasTable(s.DB, "half_applied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("broken migration was not rolled back")
+	}
+	err = s.CheckMigrations()
+	if !errors.Is(err, ErrPendingMigrations) {
+		t.Fatalf("want ErrPendingMigrations got %v", err)
+	}
+}
+
+func TestMigrateLegacyVersion(t *testing.T) {
+	s := openTestStore(t)
+	// simulate a database migrated by the old db_version system up to the
+	// first migration.
+	_, err := s.DB.Exec(s.migrations[0].Up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB.Exec("CREATE TABLE db_version(version INT NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB.Exec("INSERT INTO db_version(version) VALUES (0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := appliedCount(t, s); n != 1 {
+		t.Fatalf("want 1 applied migration got %d", n)
+	}
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := s.Dialect.HasTable(s.DB, "db_version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("db_version has not been dropped")
+	}
+}
+
+func TestMigrateLegacyVersionInterrupted(t *testing.T) {
+	s := openTestStore(t)
+	// simulate a database migrated by the old db_version system up to the
+	// second migration, whose import into schema_migrations was interrupted
+	// after the first one.
+	for _, m := range s.migrations[:2] {
+		if _, err := s.DB.Exec(m.Up); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := s.DB.Exec("CREATE TABLE db_version(version INT NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB.Exec("INSERT INTO db_version(version) VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.setUpMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB.Exec("DELETE FROM schema_migrations WHERE version <> ?", s.migrations[0].Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB.Exec("CREATE TABLE db_version(version INT NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB.Exec("INSERT INTO db_version(version) VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := appliedCount(t, s); n != 2 {
+		t.Fatalf("want 2 applied migrations got %d", n)
+	}
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := s.Dialect.HasTable(s.DB, "db_version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("db_version has not been dropped")
+	}
+}
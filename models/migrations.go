@@ -3,8 +3,13 @@
 
 package models
 
-var migrations = [...]string{
-	`CREATE TABLE sets(
+// migrations contains the migrations for every dialect, indexed by the name
+// of the dialect.
+var migrations = map[string][]Migration{
+	"mysql": {
+		{
+			Version: 1,
+			Up: `CREATE TABLE sets(
 	id INT NOT NULL,
 	ranked_status TINYINT NOT NULL,
 	approved_date DATETIME NOT NULL,
@@ -23,7 +28,12 @@ var migrations = [...]string{
 	PRIMARY KEY(id)
 );
 `,
-	`CREATE TABLE beatmaps(
+			Down: `DROP TABLE sets;
+`,
+		},
+		{
+			Version: 2,
+			Up: `CREATE TABLE beatmaps(
 	id INT NOT NULL,
 	parent_set_id INT NOT NULL,
 	diff_name VARCHAR(1000) NOT NULL,
@@ -45,8 +55,153 @@ var migrations = [...]string{
 		ON DELETE CASCADE
 		ON UPDATE CASCADE
 );`,
-	`ALTER TABLE sets ADD FULLTEXT(artist, title, creator, source, tags);`,
-	`ALTER TABLE beatmaps MODIFY difficulty_rating DECIMAL(20, 15);
+			Down: `DROP TABLE beatmaps;
+`,
+		},
+		{
+			Version: 3,
+			Up:      `ALTER TABLE sets ADD FULLTEXT(artist, title, creator, source, tags);`,
+			Down: `ALTER TABLE sets DROP INDEX artist;
+`,
+		},
+		{
+			Version: 4,
+			Up: `ALTER TABLE beatmaps MODIFY difficulty_rating DECIMAL(20, 15);
+`,
+			Down: `ALTER TABLE beatmaps MODIFY difficulty_rating INT NOT NULL;
+`,
+		},
+		{
+			Version: 5,
+			Up:      `ALTER TABLE sets DROP INDEX artist;`,
+			Down: `ALTER TABLE sets ADD FULLTEXT(artist, title, creator, source, tags);
+`,
+		},
+	},
+	"postgres": {
+		{
+			Version: 1,
+			Up: `CREATE TABLE sets(
+	id INTEGER NOT NULL,
+	ranked_status SMALLINT NOT NULL,
+	approved_date TIMESTAMP NOT NULL,
+	last_update TIMESTAMP NOT NULL,
+	last_checked TIMESTAMP NOT NULL,
+	artist VARCHAR(1000) NOT NULL,
+	title VARCHAR(1000) NOT NULL,
+	creator VARCHAR(1000) NOT NULL,
+	source VARCHAR(1000) NOT NULL,
+	tags VARCHAR(1000) NOT NULL,
+	has_video BOOLEAN NOT NULL,
+	genre SMALLINT NOT NULL,
+	language SMALLINT NOT NULL,
+	favourites INTEGER NOT NULL,
+	set_modes SMALLINT NOT NULL,
+	PRIMARY KEY(id)
+);
+CREATE INDEX sets_last_checked ON sets(last_checked);
+`,
+			Down: `DROP TABLE sets;
+`,
+		},
+		{
+			Version: 2,
+			Up: `CREATE TABLE beatmaps(
+	id INTEGER NOT NULL,
+	parent_set_id INTEGER NOT NULL,
+	diff_name VARCHAR(1000) NOT NULL,
+	file_md5 CHAR(32) NOT NULL,
+	mode INTEGER NOT NULL,
+	bpm DOUBLE PRECISION NOT NULL,
+	ar REAL NOT NULL,
+	od REAL NOT NULL,
+	cs REAL NOT NULL,
+	hp REAL NOT NULL,
+	total_length INTEGER NOT NULL,
+	hit_length INTEGER NOT NULL,
+	playcount INTEGER NOT NULL,
+	passcount INTEGER NOT NULL,
+	max_combo INTEGER NOT NULL,
+	difficulty_rating DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY(id),
+	FOREIGN KEY (parent_set_id) REFERENCES sets(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);
+CREATE INDEX beatmaps_parent_set_id ON beatmaps(parent_set_id);
+CREATE INDEX beatmaps_file_md5 ON beatmaps(file_md5);
+`,
+			Down: `DROP TABLE beatmaps;
+`,
+		},
+		{
+			Version: 3,
+			Up: `ALTER TABLE sets ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+	to_tsvector('simple', artist || ' ' || title || ' ' || creator || ' ' || source || ' ' || tags)
+) STORED;
+CREATE INDEX sets_search_vector ON sets USING GIN(search_vector);
+`,
+			Down: `DROP INDEX sets_search_vector;
+ALTER TABLE sets DROP COLUMN search_vector;
+`,
+		},
+	},
+	"sqlite3": {
+		{
+			Version: 1,
+			Up: `CREATE TABLE sets(
+	id INTEGER NOT NULL,
+	ranked_status INTEGER NOT NULL,
+	approved_date DATETIME NOT NULL,
+	last_update DATETIME NOT NULL,
+	last_checked DATETIME NOT NULL,
+	artist VARCHAR(1000) NOT NULL,
+	title VARCHAR(1000) NOT NULL,
+	creator VARCHAR(1000) NOT NULL,
+	source VARCHAR(1000) NOT NULL,
+	tags VARCHAR(1000) NOT NULL,
+	has_video BOOLEAN NOT NULL,
+	genre INTEGER NOT NULL,
+	language INTEGER NOT NULL,
+	favourites INTEGER NOT NULL,
+	set_modes INTEGER NOT NULL,
+	PRIMARY KEY(id)
+);
+`,
+			Down: `DROP TABLE sets;
+`,
+		},
+		{
+			Version: 2,
+			Up: `CREATE TABLE beatmaps(
+	id INTEGER NOT NULL,
+	parent_set_id INTEGER NOT NULL,
+	diff_name VARCHAR(1000) NOT NULL,
+	file_md5 CHAR(32) NOT NULL,
+	mode INTEGER NOT NULL,
+	bpm REAL NOT NULL,
+	ar REAL NOT NULL,
+	od REAL NOT NULL,
+	cs REAL NOT NULL,
+	hp REAL NOT NULL,
+	total_length INTEGER NOT NULL,
+	hit_length INTEGER NOT NULL,
+	playcount INTEGER NOT NULL,
+	passcount INTEGER NOT NULL,
+	max_combo INTEGER NOT NULL,
+	difficulty_rating REAL NOT NULL,
+	PRIMARY KEY(id),
+	FOREIGN KEY (parent_set_id) REFERENCES sets(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);
+CREATE INDEX beatmaps_parent_set_id ON beatmaps(parent_set_id);
+CREATE INDEX beatmaps_file_md5 ON beatmaps(file_md5);
+`,
+			Down: `DROP INDEX beatmaps_file_md5;
+DROP INDEX beatmaps_parent_set_id;
+DROP TABLE beatmaps;
 `,
-	`ALTER TABLE sets DROP INDEX artist;`,
+		},
+	},
 }
@@ -0,0 +1 @@
+ALTER TABLE sets DROP INDEX artist;
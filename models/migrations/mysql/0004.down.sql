@@ -0,0 +1 @@
+ALTER TABLE beatmaps MODIFY difficulty_rating INT NOT NULL;
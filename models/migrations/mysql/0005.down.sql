@@ -0,0 +1 @@
+ALTER TABLE sets ADD FULLTEXT(artist, title, creator, source, tags);
@@ -0,0 +1,19 @@
+CREATE TABLE sets(
+	id INTEGER NOT NULL,
+	ranked_status SMALLINT NOT NULL,
+	approved_date TIMESTAMP NOT NULL,
+	last_update TIMESTAMP NOT NULL,
+	last_checked TIMESTAMP NOT NULL,
+	artist VARCHAR(1000) NOT NULL,
+	title VARCHAR(1000) NOT NULL,
+	creator VARCHAR(1000) NOT NULL,
+	source VARCHAR(1000) NOT NULL,
+	tags VARCHAR(1000) NOT NULL,
+	has_video BOOLEAN NOT NULL,
+	genre SMALLINT NOT NULL,
+	language SMALLINT NOT NULL,
+	favourites INTEGER NOT NULL,
+	set_modes SMALLINT NOT NULL,
+	PRIMARY KEY(id)
+);
+CREATE INDEX sets_last_checked ON sets(last_checked);
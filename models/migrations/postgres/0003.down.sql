@@ -0,0 +1,2 @@
+DROP INDEX sets_search_vector;
+ALTER TABLE sets DROP COLUMN search_vector;
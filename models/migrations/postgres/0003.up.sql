@@ -0,0 +1,4 @@
+ALTER TABLE sets ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+	to_tsvector('simple', artist || ' ' || title || ' ' || creator || ' ' || source || ' ' || tags)
+) STORED;
+CREATE INDEX sets_search_vector ON sets USING GIN(search_vector);
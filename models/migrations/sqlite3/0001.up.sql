@@ -0,0 +1,18 @@
+CREATE TABLE sets(
+	id INTEGER NOT NULL,
+	ranked_status INTEGER NOT NULL,
+	approved_date DATETIME NOT NULL,
+	last_update DATETIME NOT NULL,
+	last_checked DATETIME NOT NULL,
+	artist VARCHAR(1000) NOT NULL,
+	title VARCHAR(1000) NOT NULL,
+	creator VARCHAR(1000) NOT NULL,
+	source VARCHAR(1000) NOT NULL,
+	tags VARCHAR(1000) NOT NULL,
+	has_video BOOLEAN NOT NULL,
+	genre INTEGER NOT NULL,
+	language INTEGER NOT NULL,
+	favourites INTEGER NOT NULL,
+	set_modes INTEGER NOT NULL,
+	PRIMARY KEY(id)
+);
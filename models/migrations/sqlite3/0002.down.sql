@@ -0,0 +1,3 @@
+DROP INDEX beatmaps_file_md5;
+DROP INDEX beatmaps_parent_set_id;
+DROP TABLE beatmaps;
@@ -0,0 +1,24 @@
+CREATE TABLE beatmaps(
+	id INTEGER NOT NULL,
+	parent_set_id INTEGER NOT NULL,
+	diff_name VARCHAR(1000) NOT NULL,
+	file_md5 CHAR(32) NOT NULL,
+	mode INTEGER NOT NULL,
+	bpm REAL NOT NULL,
+	ar REAL NOT NULL,
+	od REAL NOT NULL,
+	cs REAL NOT NULL,
+	hp REAL NOT NULL,
+	total_length INTEGER NOT NULL,
+	hit_length INTEGER NOT NULL,
+	playcount INTEGER NOT NULL,
+	passcount INTEGER NOT NULL,
+	max_combo INTEGER NOT NULL,
+	difficulty_rating REAL NOT NULL,
+	PRIMARY KEY(id),
+	FOREIGN KEY (parent_set_id) REFERENCES sets(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);
+CREATE INDEX beatmaps_parent_set_id ON beatmaps(parent_set_id);
+CREATE INDEX beatmaps_file_md5 ON beatmaps(file_md5);
@@ -3,10 +3,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"io"
+	"go/format"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -15,41 +17,82 @@ const fileHeader = `// THIS FILE HAS BEEN AUTOMATICALLY GENERATED
 
 package models
 
-var migrations = [...]string{
+// migrations contains the migrations for every dialect, indexed by the name
+// of the dialect.
+var migrations = map[string][]Migration{
 `
 
 func main() {
-	// ReadDir gets all the files in the directory and then sorts them
-	// alphabetically - thus we can be sure 0000 will come first and 0001 will
-	// come afterwards.
-	files, err := ioutil.ReadDir("migrations")
+	// Every folder inside of migrations contains the migrations for the
+	// dialect having the same name.
+	dialects, err := ioutil.ReadDir("migrations")
 	check(err)
 
-	out, err := os.Create("migrations.go")
-	check(err)
-
-	_, err = out.WriteString(fileHeader)
-	check(err)
+	out := &bytes.Buffer{}
+	out.WriteString(fileHeader)
 
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".sql") || file.IsDir() {
+	for _, dialect := range dialects {
+		if !dialect.IsDir() {
 			continue
 		}
-		f, err := os.Open("migrations/" + file.Name())
-		check(err)
+		fmt.Fprintf(out, "\t%q: {\n", dialect.Name())
 
-		out.WriteString("\t`")
-		_, err = io.Copy(out, f)
+		// ReadDir gets all the files in the directory and then sorts them
+		// alphabetically - thus we can be sure 0000 will come first and 0001
+		// will come afterwards, and that 0001.down.sql comes before
+		// 0001.up.sql.
+		files, err := ioutil.ReadDir("migrations/" + dialect.Name())
 		check(err)
-		out.WriteString("`,\n")
 
-		f.Close()
+		var version int
+		var up, down string
+		flush := func() {
+			if version == 0 {
+				return
+			}
+			if up == "" {
+				check(fmt.Errorf("migration %d of %s has no up file", version, dialect.Name()))
+			}
+			fmt.Fprintf(out, "\t\t{\n\t\t\tVersion: %d,\n\t\t\tUp: `%s`,\n\t\t\tDown: `%s`,\n\t\t},\n",
+				version, up, down)
+			up, down = "", ""
+		}
+
+		for _, file := range files {
+			name := file.Name()
+			if file.IsDir() || !strings.HasSuffix(name, ".sql") {
+				continue
+			}
+			// file names are in the form 0001.up.sql and 0001.down.sql
+			parts := strings.Split(name, ".")
+			if len(parts) != 3 || (parts[1] != "up" && parts[1] != "down") {
+				check(fmt.Errorf("invalid migration file name: %s/%s", dialect.Name(), name))
+			}
+			v, err := strconv.Atoi(parts[0])
+			check(err)
+			if v != version {
+				flush()
+				version = v
+			}
+
+			data, err := ioutil.ReadFile("migrations/" + dialect.Name() + "/" + name)
+			check(err)
+			if parts[1] == "up" {
+				up = string(data)
+			} else {
+				down = string(data)
+			}
+		}
+		flush()
+
+		out.WriteString("\t},\n")
 	}
 
-	_, err = out.WriteString("}\n")
-	check(err)
+	out.WriteString("}\n")
 
-	check(out.Close())
+	src, err := format.Source(out.Bytes())
+	check(err)
+	check(ioutil.WriteFile("migrations.go", src, 0644))
 }
 
 func check(err error) {
@@ -8,44 +8,77 @@ import (
 
 //go:generate go run migrations_gen.go
 
-// RunMigrations brings the database up to date following the migrations.
-func RunMigrations(db *sql.DB) error {
-	var version int
-	var _b []byte
-	err := db.QueryRow("SHOW TABLES LIKE 'db_version'").Scan(&_b)
-	switch err {
-	case nil:
-		// fetch version from db
-		err = db.QueryRow("SELECT version FROM db_version").Scan(&version)
-		if err != nil {
-			return err
-		}
-	case sql.ErrNoRows:
-		_, err = db.Exec("CREATE TABLE db_version(version INT NOT NULL)")
-		if err != nil {
-			return err
-		}
-		_, err = db.Exec("INSERT INTO db_version(version) VALUES ('-1')")
-		if err != nil {
-			return err
-		}
-		version = -1
-	default:
-		return err
+// Repository is the interface through which the rest of CheeseGull retrieves
+// and stores the metadata of beatmaps and beatmap sets.
+type Repository interface {
+	FetchSet(id int, withChildren bool) (*Set, error)
+	FetchSetChimu(id int, withChildren bool) (*SetChimu, error)
+	FetchSetsForBatchUpdate(limit int) ([]Set, error)
+	CreateSet(s Set) error
+	DeleteSet(id int) error
+	BiggestSetID() (int, error)
+	CountSets() (int, error)
+
+	FetchBeatmaps(ids ...int) ([]Beatmap, error)
+	FetchBeatmapsByMd5(md5 string) ([]Beatmap, error)
+	FetchBeatmapsChimu(ids ...int) ([]BeatmapChimu, error)
+	CreateBeatmaps(bms ...Beatmap) error
+
+	SearchSets(opts SearchOptions) ([]Set, error)
+	SearchSetsChimu(opts SearchOptions) ([]SetChimu, error)
+
+	RunMigrations() error
+}
+
+// Store is a Repository backed by an SQL database.
+type Store struct {
+	DB      *sql.DB
+	Dialect Dialect
+	// Search is the backend used for fulltext searches.
+	Search SearchBackend
+	// SearchDB is the connection to the SphinxQL server, used when Search is
+	// SearchSphinx.
+	SearchDB *sql.DB
+
+	migrations []Migration
+}
+
+var _ Repository = (*Store)(nil)
+
+// New creates a new Store using an already open database.
+func New(db *sql.DB, d Dialect) *Store {
+	d.setUp(db)
+	return &Store{
+		DB:      db,
+		Dialect: d,
+		Search:  SearchLike,
+
+		migrations: migrations[d.Name()],
 	}
+}
 
-	for {
-		version++
-		if version >= len(migrations) {
-			version--
-			db.Exec("UPDATE db_version SET version = ?", version)
-			return nil
-		}
-
-		s := migrations[version]
-		_, err = db.Exec(s)
-		if err != nil {
-			return err
-		}
+// Open opens the database having the given DSN, using the dialect with the
+// given name.
+func Open(dialect, dsn string) (*Store, error) {
+	d, err := DialectByName(dialect)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(d.Name(), d.DSN(dsn))
+	if err != nil {
+		return nil, err
 	}
+	return New(db, d), nil
+}
+
+func (s *Store) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.DB.Query(s.Dialect.Rebind(query), args...)
+}
+
+func (s *Store) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.DB.QueryRow(s.Dialect.Rebind(query), args...)
+}
+
+func (s *Store) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.DB.Exec(s.Dialect.Rebind(query), args...)
 }
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestStore opens an in-memory SQLite database.
+func openTestStore(t *testing.T) *Store {
+	s, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testStore opens an in-memory SQLite database, and migrates it.
+func testStore(t *testing.T) *Store {
+	s := openTestStore(t)
+	err := s.RunMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+var testSet = Set{
+	ID:           1,
+	RankedStatus: 1,
+	ApprovedDate: time.Date(2007, 10, 6, 17, 46, 31, 0, time.UTC),
+	LastUpdate:   time.Date(2007, 10, 6, 17, 46, 31, 0, time.UTC),
+	LastChecked:  time.Date(2017, 9, 21, 11, 11, 50, 0, time.UTC),
+	Artist:       "Kenji Ninuma",
+	Title:        "DISCO PRINCE",
+	Creator:      "peppy",
+	Tags:         "katamari",
+	Genre:        2,
+	Language:     3,
+	Favourites:   520,
+	ChildrenBeatmaps: []Beatmap{
+		{
+			ID:               75,
+			ParentSetID:      1,
+			DiffName:         "Normal",
+			FileMD5:          "a5b99395a42bd55bc5eb1d2411cbdf8b",
+			BPM:              119.999,
+			AR:               6,
+			OD:               6,
+			CS:               4,
+			HP:               6,
+			TotalLength:      142,
+			HitLength:        109,
+			Playcount:        310498,
+			Passcount:        60009,
+			MaxCombo:         314,
+			DifficultyRating: 2.4069502353668213,
+		},
+	},
+}
+
+func TestCreateFetchSet(t *testing.T) {
+	s := testStore(t)
+
+	err := s.CreateSet(testSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := s.FetchSet(testSet.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set == nil {
+		t.Fatal("set not found")
+	}
+	if !set.LastUpdate.Equal(testSet.LastUpdate) {
+		t.Errorf("LastUpdate: want %v got %v", testSet.LastUpdate, set.LastUpdate)
+	}
+	if !reflect.DeepEqual(set.ChildrenBeatmaps, testSet.ChildrenBeatmaps) {
+		t.Errorf("want %v got %v", testSet.ChildrenBeatmaps, set.ChildrenBeatmaps)
+	}
+
+	// creating the set again should update it
+	updated := testSet
+	updated.Title = "DISCO PRINCE (updated)"
+	err = s.CreateSet(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err = s.FetchSet(testSet.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Title != updated.Title {
+		t.Errorf("want title %q got %q", updated.Title, set.Title)
+	}
+
+	n, err := s.CountSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 set got %d", n)
+	}
+
+	set, err = s.FetchSet(2, false)
+	if err != nil || set != nil {
+		t.Errorf("want nil, nil got %v, %v", set, err)
+	}
+}
+
+func TestFetchBeatmaps(t *testing.T) {
+	s := testStore(t)
+	err := s.CreateSet(testSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bms, err := s.FetchBeatmapsByMd5("a5b99395a42bd55bc5eb1d2411cbdf8b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bms) != 1 || bms[0].ID != 75 {
+		t.Fatalf("unexpected result %v", bms)
+	}
+
+	chimu, err := s.FetchBeatmapsChimu(75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const osuFile = "Kenji Ninuma - DISCO PRINCE (peppy) [Normal].osu"
+	if len(chimu) != 1 || chimu[0].OsuFile != osuFile {
+		t.Fatalf("unexpected result %v", chimu)
+	}
+}
+
+func TestSearchSetsNative(t *testing.T) {
+	s := testStore(t)
+	err := s.CreateSet(testSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		opts SearchOptions
+		n    int
+	}{
+		{SearchOptions{Amount: 50}, 1},
+		{SearchOptions{Query: "disco", Amount: 50}, 1},
+		{SearchOptions{Query: "Disco Prince", Amount: 50}, 1},
+		{SearchOptions{Query: "KATAMARI", Amount: 50}, 1},
+		{SearchOptions{Query: "100%", Amount: 50}, 0},
+		{SearchOptions{Query: "katamari", Mode: []int{0}, Amount: 50}, 1},
+		{SearchOptions{Mode: []int{1}, Amount: 50}, 0},
+		{SearchOptions{Status: []int{4}, Amount: 50}, 0},
+	}
+	for _, tc := range tt {
+		sets, err := s.SearchSets(tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sets) != tc.n {
+			t.Errorf("%+v: want %d results got %d", tc.opts, tc.n, len(sets))
+			continue
+		}
+		if tc.n > 0 && len(sets[0].ChildrenBeatmaps) != 1 {
+			t.Errorf("%+v: children beatmaps not retrieved", tc.opts)
+		}
+	}
+}
+
+func TestCreateSetRemovesBeatmaps(t *testing.T) {
+	s := testStore(t)
+
+	set := testSet
+	set.ChildrenBeatmaps = append([]Beatmap{}, testSet.ChildrenBeatmaps...)
+	extra := set.ChildrenBeatmaps[0]
+	extra.ID = 76
+	extra.DiffName = "Hard"
+	set.ChildrenBeatmaps = append(set.ChildrenBeatmaps, extra)
+	err := s.CreateSet(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the Hard difficulty is removed upstream
+	err = s.CreateSet(testSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bms, err := s.FetchBeatmaps(75, 76)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bms) != 1 || bms[0].ID != 75 {
+		t.Fatalf("want only beatmap 75, got %v", bms)
+	}
+}
+
+func TestCreateSetRollback(t *testing.T) {
+	s := testStore(t)
+	err := s.CreateSet(testSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the beatmap points to a set which does not exist, so inserting it
+	// violates the foreign key and the whole update must be rolled back.
+	broken := testSet
+	broken.Title = "broken"
+	broken.ChildrenBeatmaps = append([]Beatmap{}, testSet.ChildrenBeatmaps...)
+	broken.ChildrenBeatmaps[0].ParentSetID = 999
+	err = s.CreateSet(broken)
+	if err == nil {
+		t.Fatal("want error creating set with invalid beatmap")
+	}
+
+	set, err := s.FetchSet(testSet.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Title != testSet.Title || len(set.ChildrenBeatmaps) != 1 {
+		t.Fatalf("set was modified by failed update: %+v", set)
+	}
+}
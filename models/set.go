@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 )
 
@@ -53,9 +54,9 @@ language, favourites`
 // RankedStatus is 3, 0 or -1 (qualified, pending or WIP), at least 30 minutes
 // must have passed from LastChecked. For all other statuses, at least 4 days
 // must have passed from LastChecked.
-func FetchSetsForBatchUpdate(db *sql.DB, limit int) ([]Set, error) {
-	n := time.Now()
-	rows, err := db.Query(`
+func (s *Store) FetchSetsForBatchUpdate(limit int) ([]Set, error) {
+	n := time.Now().UTC()
+	rows, err := s.query(`
 SELECT `+setFields+` FROM sets
 WHERE (ranked_status IN (3, 0, -1) AND last_checked <= ?) OR last_checked <= ?
 ORDER BY last_checked ASC
@@ -70,28 +71,28 @@ LIMIT ?`,
 
 	sets := make([]Set, 0, limit)
 	for rows.Next() {
-		var s Set
+		var set Set
 		err = rows.Scan(
-			&s.ID, &s.RankedStatus, &s.ApprovedDate, &s.LastUpdate, &s.LastChecked,
-			&s.Artist, &s.Title, &s.Creator, &s.Source, &s.Tags, &s.HasVideo, &s.Genre,
-			&s.Language, &s.Favourites,
+			&set.ID, &set.RankedStatus, &set.ApprovedDate, &set.LastUpdate, &set.LastChecked,
+			&set.Artist, &set.Title, &set.Creator, &set.Source, &set.Tags, &set.HasVideo, &set.Genre,
+			&set.Language, &set.Favourites,
 		)
 		if err != nil {
 			return nil, err
 		}
-		sets = append(sets, s)
+		sets = append(sets, set)
 	}
 
 	return sets, rows.Err()
 }
 
 // FetchSet retrieves a single set to show, alongside its children beatmaps.
-func FetchSet(db *sql.DB, id int, withChildren bool) (*Set, error) {
-	var s Set
-	err := db.QueryRow(`SELECT `+setFields+` FROM sets WHERE id = ? LIMIT 1`, id).Scan(
-		&s.ID, &s.RankedStatus, &s.ApprovedDate, &s.LastUpdate, &s.LastChecked,
-		&s.Artist, &s.Title, &s.Creator, &s.Source, &s.Tags, &s.HasVideo, &s.Genre,
-		&s.Language, &s.Favourites,
+func (s *Store) FetchSet(id int, withChildren bool) (*Set, error) {
+	var set Set
+	err := s.queryRow(`SELECT `+setFields+` FROM sets WHERE id = ? LIMIT 1`, id).Scan(
+		&set.ID, &set.RankedStatus, &set.ApprovedDate, &set.LastUpdate, &set.LastChecked,
+		&set.Artist, &set.Title, &set.Creator, &set.Source, &set.Tags, &set.HasVideo, &set.Genre,
+		&set.Language, &set.Favourites,
 	)
 	switch err {
 	case nil:
@@ -104,24 +105,24 @@ func FetchSet(db *sql.DB, id int, withChildren bool) (*Set, error) {
 	}
 
 	if !withChildren {
-		return &s, nil
+		return &set, nil
 	}
 
-	rows, err := db.Query(`SELECT `+beatmapFields+` FROM beatmaps WHERE parent_set_id = ?`, s.ID)
+	rows, err := s.query(`SELECT `+beatmapFields+` FROM beatmaps WHERE parent_set_id = ?`, set.ID)
 	if err != nil {
 		return nil, err
 	}
-	s.ChildrenBeatmaps, err = readBeatmapsFromRows(rows, 8)
-	return &s, err
+	set.ChildrenBeatmaps, err = readBeatmapsFromRows(rows, 8)
+	return &set, err
 }
 
-// FetchSet retrieves a single set to show, alongside its children beatmaps.
-func FetchSetChimu(db *sql.DB, id int, withChildren bool) (*SetChimu, error) {
-	var s SetChimu
-	err := db.QueryRow(`SELECT `+setFields+` FROM sets WHERE id = ? LIMIT 1`, id).Scan(
-		&s.ID, &s.RankedStatus, &s.ApprovedDate, &s.LastUpdate, &s.LastChecked,
-		&s.Artist, &s.Title, &s.Creator, &s.Source, &s.Tags, &s.HasVideo, &s.Genre,
-		&s.Language, &s.Favourites,
+// FetchSetChimu retrieves a single set to show, alongside its children beatmaps.
+func (s *Store) FetchSetChimu(id int, withChildren bool) (*SetChimu, error) {
+	var set SetChimu
+	err := s.queryRow(`SELECT `+setFields+` FROM sets WHERE id = ? LIMIT 1`, id).Scan(
+		&set.ID, &set.RankedStatus, &set.ApprovedDate, &set.LastUpdate, &set.LastChecked,
+		&set.Artist, &set.Title, &set.Creator, &set.Source, &set.Tags, &set.HasVideo, &set.Genre,
+		&set.Language, &set.Favourites,
 	)
 	switch err {
 	case nil:
@@ -134,26 +135,35 @@ func FetchSetChimu(db *sql.DB, id int, withChildren bool) (*SetChimu, error) {
 	}
 
 	if !withChildren {
-		return &s, nil
+		return &set, nil
 	}
 
-	rows, err := db.Query(`SELECT `+beatmapFields+`, sets.artist, sets.title, sets.creator FROM beatmaps RIGHT JOIN sets ON sets.id = beatmaps.parent_set_id WHERE beatmaps.parent_set_id = ?`, s.ID)
+	rows, err := s.query(`SELECT `+beatmapFields+`, sets.artist, sets.title, sets.creator FROM beatmaps INNER JOIN sets ON sets.id = beatmaps.parent_set_id WHERE beatmaps.parent_set_id = ?`, set.ID)
 	if err != nil {
 		return nil, err
 	}
-	s.ChildrenBeatmaps, err = readBeatmapsFromRowsChimu(rows, 8)
-	return &s, err
+	set.ChildrenBeatmaps, err = readBeatmapsFromRowsChimu(rows, 8)
+	return &set, err
 }
 
 // DeleteSet deletes a set from the database, removing also its children
 // beatmaps.
-func DeleteSet(db *sql.DB, set int) error {
-	_, err := db.Exec("DELETE FROM beatmaps WHERE parent_set_id = ?", set)
+func (s *Store) DeleteSet(set int) error {
+	tx, err := s.DB.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("DELETE FROM sets WHERE id = ?", set)
-	return err
+	_, err = tx.Exec(s.Dialect.Rebind("DELETE FROM beatmaps WHERE parent_set_id = ?"), set)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(s.Dialect.Rebind("DELETE FROM sets WHERE id = ?"), set)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 // createSetModes will generate the correct value for setModes, which is
@@ -169,42 +179,77 @@ func createSetModes(bms []Beatmap) (setModes uint8) {
 	return setModes
 }
 
-// CreateSet creates (and updates) a beatmap set in the database.
-func CreateSet(db *sql.DB, s Set) error {
-	// delete existing set, if any.
-	// This is mostly a lazy way to make sure updates work as well.
-	err := DeleteSet(db, s.ID)
+// setColumns are the columns of the sets table, in the order CreateSet
+// inserts them.
+var setColumns = []string{
+	"id", "ranked_status", "approved_date", "last_update", "last_checked",
+	"artist", "title", "creator", "source", "tags", "has_video", "genre",
+	"language", "favourites", "set_modes",
+}
+
+// CreateSet creates (and updates) a beatmap set in the database. Everything
+// is done in a single transaction, so that readers never see a set without its
+// beatmaps.
+func (s *Store) CreateSet(set Set) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	err = s.createSet(tx, set)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
+	return tx.Commit()
+}
 
-	_, err = db.Exec(`
-INSERT INTO sets(
-	id, ranked_status, approved_date, last_update, last_checked,
-	artist, title, creator, source, tags, has_video, genre,
-	language, favourites, set_modes
-)
+func (s *Store) createSet(tx *sql.Tx, set Set) error {
+	_, err := tx.Exec(s.Dialect.Rebind(`
+INSERT INTO sets(`+strings.Join(setColumns, ", ")+`)
 VALUES (
 	?, ?, ?, ?, ?,
 	?, ?, ?, ?, ?, ?, ?,
 	?, ?, ?
-)`, s.ID, s.RankedStatus, s.ApprovedDate, s.LastUpdate, s.LastChecked,
-		s.Artist, s.Title, s.Creator, s.Source, s.Tags, s.HasVideo, s.Genre,
-		s.Language, s.Favourites, createSetModes(s.ChildrenBeatmaps))
+)`+s.Dialect.Upsert(setColumns[:1], setColumns[1:])), set.ID, set.RankedStatus, set.ApprovedDate.UTC(), set.LastUpdate.UTC(), set.LastChecked.UTC(),
+		set.Artist, set.Title, set.Creator, set.Source, set.Tags, set.HasVideo, set.Genre,
+		set.Language, set.Favourites, createSetModes(set.ChildrenBeatmaps))
 	if err != nil {
 		return err
 	}
 
-	return CreateBeatmaps(db, s.ChildrenBeatmaps...)
+	err = s.createBeatmaps(tx, set.ChildrenBeatmaps...)
+	if err != nil {
+		return err
+	}
+
+	// remove the beatmaps which have been removed from the set upstream.
+	q := "DELETE FROM beatmaps WHERE parent_set_id = ?"
+	args := make([]interface{}, 1, len(set.ChildrenBeatmaps)+1)
+	args[0] = set.ID
+	if len(set.ChildrenBeatmaps) > 0 {
+		q += " AND id NOT IN (" + inClause(len(set.ChildrenBeatmaps)) + ")"
+		for _, bm := range set.ChildrenBeatmaps {
+			args = append(args, bm.ID)
+		}
+	}
+	_, err = tx.Exec(s.Dialect.Rebind(q), args...)
+	return err
 }
 
 // BiggestSetID retrieves the biggest set ID in the sets database. This is used
 // by discovery to have a starting point from which to discover new beatmaps.
-func BiggestSetID(db *sql.DB) (int, error) {
+func (s *Store) BiggestSetID() (int, error) {
 	var i int
-	err := db.QueryRow("SELECT id FROM sets ORDER BY id DESC LIMIT 1").Scan(&i)
+	err := s.queryRow("SELECT id FROM sets ORDER BY id DESC LIMIT 1").Scan(&i)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
 	return i, err
 }
+
+// CountSets returns the number of sets in the database.
+func (s *Store) CountSets() (int, error) {
+	var i int
+	err := s.queryRow("SELECT COUNT(*) FROM sets").Scan(&i)
+	return i, err
+}
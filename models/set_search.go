@@ -2,7 +2,6 @@ package models
 
 import (
 	"bytes"
-	"database/sql"
 	"fmt"
 	"strconv"
 	"strings"
@@ -78,14 +77,57 @@ const setFieldsWithRow = `sets.id, sets.ranked_status, sets.approved_date, sets.
 sets.artist, sets.title, sets.creator, sets.source, sets.tags, sets.has_video, sets.genre,
 language, sets.favourites`
 
+// SearchBackend is the way fulltext searches on the sets are carried out.
+type SearchBackend string
+
+// Search backends supported by Store.
+const (
+	// SearchSphinx sends fulltext searches to the SphinxQL server in
+	// Store.SearchDB, which must be indexing the MySQL database.
+	SearchSphinx SearchBackend = "sphinx"
+	// SearchLike looks for the query in the sets using LIKE. It works with
+	// every dialect, but it gets slow on large databases.
+	SearchLike SearchBackend = "like"
+	// SearchTSVector uses the search_vector column of the sets, and is only
+	// available on PostgreSQL.
+	SearchTSVector SearchBackend = "tsvector"
+)
+
+// searchCond creates the condition to look for query in the sets table, for
+// when searches are done directly on the database, alongside with the ORDER
+// BY clause sorting the results.
+func (s *Store) searchCond(query string) (cond string, args []interface{}, order string) {
+	if s.Search == SearchTSVector {
+		return "sets.search_vector @@ plainto_tsquery('simple', ?) ",
+			[]interface{}{query, query},
+			" ORDER BY ts_rank(sets.search_vector, plainto_tsquery('simple', ?)) DESC, last_update DESC "
+	}
+	// LIKE is case sensitive on PostgreSQL only: LOWER makes all the
+	// dialects find the same sets.
+	like := "%" + likeEscaper.Replace(query) + "%"
+	return "(LOWER(sets.artist) LIKE LOWER(?) ESCAPE '!' OR LOWER(sets.title) LIKE LOWER(?) ESCAPE '!' OR " +
+			"LOWER(sets.creator) LIKE LOWER(?) ESCAPE '!' OR LOWER(sets.source) LIKE LOWER(?) ESCAPE '!' OR " +
+			"LOWER(sets.tags) LIKE LOWER(?) ESCAPE '!') ",
+		[]interface{}{like, like, like, like, like},
+		" ORDER BY last_update DESC "
+}
+
+var likeEscaper = strings.NewReplacer(
+	"!", "!!",
+	"%", "!%",
+	"_", "!_",
+)
+
 // SearchSets retrieves sets, filtering them using SearchOptions.
-func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
+func (s *Store) SearchSets(opts SearchOptions) ([]Set, error) {
 	sm := strconv.Itoa(int(opts.setModes()))
 
 	// first, we create the where conditions that are valid for both querying mysql
 	// straight or querying sphinx first.
 	var whereConds string
-	var havingConds string
+	var modesCond string
+	var args []interface{}
+	order := " ORDER BY last_update DESC "
 	if len(opts.Status) != 0 {
 		whereConds = "ranked_status IN (" + sIntCommaSeparated(opts.Status) + ") "
 	}
@@ -93,7 +135,7 @@ func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
 		// This is a hack. Apparently, Sphinx does not support AND bitwise
 		// operations in the WHERE clause, so we're placing that in the SELECT
 		// clause and only making sure it's correct in this place.
-		havingConds = " valid_set_modes = " + sm + " "
+		modesCond = " valid_set_modes = " + sm + " "
 	}
 
 	// Limit user amount for beatmap asking
@@ -107,9 +149,9 @@ func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
 	// order given by sphinx.
 	setMap := make(map[int]int, opts.Amount)
 	// if Sphinx is used, limit will be cleared so that it's not used for the mysql query
-	limit := fmt.Sprintf(" LIMIT %d, %d ", opts.Offset, opts.Amount)
+	limit := fmt.Sprintf(" LIMIT %d OFFSET %d ", opts.Amount, opts.Offset)
 
-	if opts.Query != "" {
+	if opts.Query != "" && s.Search == SearchSphinx {
 		setIDsQuery := "SELECT id, set_modes & " + sm + " AS valid_set_modes FROM cg WHERE "
 
 		// add filters to query
@@ -119,17 +161,19 @@ func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
 		if whereConds != "" {
 			setIDsQuery += "AND " + whereConds
 		}
-		if havingConds != "" {
-			setIDsQuery += " AND " + havingConds
+		if modesCond != "" {
+			setIDsQuery += " AND " + modesCond
 		}
 		setIDsQuery = strings.ReplaceAll(setIDsQuery, "sets.", "")
 
 		// set limit
-		setIDsQuery += " ORDER BY WEIGHT() DESC, id DESC " + limit + " OPTION ranker=sph04, max_matches=20000 "
+		setIDsQuery += " ORDER BY WEIGHT() DESC, id DESC " +
+			fmt.Sprintf(" LIMIT %d, %d ", opts.Offset, opts.Amount) +
+			" OPTION ranker=sph04, max_matches=20000 "
 		limit = ""
 
 		// fetch rows
-		rows, err := searchDB.Query(setIDsQuery)
+		rows, err := s.SearchDB.Query(setIDsQuery)
 		if err != nil {
 			return nil, err
 		}
@@ -152,18 +196,28 @@ func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
 		}
 
 		whereConds = "sets.id IN (" + sIntCommaSeparated(setIDs) + ")"
-		havingConds = ""
+		modesCond = ""
+	} else if opts.Query != "" {
+		var queryCond string
+		queryCond, args, order = s.searchCond(opts.Query)
+		if whereConds != "" {
+			whereConds += "AND "
+		}
+		whereConds += queryCond
 	}
 
+	if modesCond != "" {
+		if whereConds != "" {
+			whereConds += "AND "
+		}
+		whereConds += "(sets.set_modes & " + sm + ") = " + sm + " "
+	}
 	if whereConds != "" {
 		whereConds = "WHERE " + whereConds
 	}
-	if havingConds != "" {
-		havingConds = " HAVING " + havingConds
-	}
 	setsQuery := "SELECT " + setFieldsWithRow + ", sets.set_modes & " + sm + " AS valid_set_modes FROM sets " +
-		whereConds + havingConds + " ORDER BY last_update DESC " + limit
-	rows, err := db.Query(setsQuery)
+		whereConds + order + limit
+	rows, err := s.query(setsQuery, args...)
 
 	if err != nil {
 		return nil, err
@@ -171,24 +225,24 @@ func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
 
 	// find all beatmaps, but leave children aside for the moment.
 	for rows.Next() {
-		var s Set
+		var set Set
 		err = rows.Scan(
-			&s.ID, &s.RankedStatus, &s.ApprovedDate, &s.LastUpdate, &s.LastChecked,
-			&s.Artist, &s.Title, &s.Creator, &s.Source, &s.Tags, &s.HasVideo, &s.Genre,
-			&s.Language, &s.Favourites, new(int),
+			&set.ID, &set.RankedStatus, &set.ApprovedDate, &set.LastUpdate, &set.LastChecked,
+			&set.Artist, &set.Title, &set.Creator, &set.Source, &set.Tags, &set.HasVideo, &set.Genre,
+			&set.Language, &set.Favourites, new(int),
 		)
 		if err != nil {
 			return nil, err
 		}
 		// we get the position we should place s in from the setMap, this way we
 		// keep the order of results as sphinx prefers.
-		pos, ok := setMap[s.ID]
+		pos, ok := setMap[set.ID]
 		if ok {
-			sets[pos] = s
+			sets[pos] = set
 		} else {
-			sets = append(sets, s)
-			setIDs = append(setIDs, s.ID)
-			setMap[s.ID] = len(sets) - 1
+			sets = append(sets, set)
+			setIDs = append(setIDs, set.ID)
+			setMap[set.ID] = len(sets) - 1
 		}
 	}
 
@@ -196,7 +250,7 @@ func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
 		return sets, nil
 	}
 
-	rows, err = db.Query(
+	rows, err = s.query(
 		"SELECT "+beatmapFields+" FROM beatmaps WHERE parent_set_id IN ("+
 			inClause(len(setIDs))+")",
 		sIntToSInterface(setIDs)...,
@@ -226,13 +280,15 @@ func SearchSets(db, searchDB *sql.DB, opts SearchOptions) ([]Set, error) {
 }
 
 // SearchSetsChimu retrieves sets, filtering them using SearchOptions.
-func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, error) {
+func (s *Store) SearchSetsChimu(opts SearchOptions) ([]SetChimu, error) {
 	sm := strconv.Itoa(int(opts.setModes()))
 
 	// first, we create the where conditions that are valid for both querying mysql
 	// straight or querying sphinx first.
 	var whereConds string
-	var havingConds string
+	var modesCond string
+	var args []interface{}
+	order := " ORDER BY last_update DESC "
 	var beforeWhereConds = " "
 	if len(opts.Status) != 0 {
 		whereConds = beforeWhereConds + "sets.ranked_status IN (" + sIntCommaSeparated(opts.Status) + ") "
@@ -250,7 +306,7 @@ func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, erro
 		// This is a hack. Apparently, Sphinx does not support AND bitwise
 		// operations in the WHERE clause, so we're placing that in the SELECT
 		// clause and only making sure it's correct in this place.
-		havingConds = " valid_set_modes = " + sm + " "
+		modesCond = " valid_set_modes = " + sm + " "
 	}
 
 	// TODO: REDONE THAT SHITCODDING!!!!! ASAP!!!!!
@@ -313,9 +369,9 @@ func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, erro
 	// order given by sphinx.
 	setMap := make(map[int]int, opts.Amount)
 	// if Sphinx is used, limit will be cleared so that it's not used for the mysql query
-	limit := fmt.Sprintf(" LIMIT %d, %d ", opts.Offset, opts.Amount)
+	limit := fmt.Sprintf(" LIMIT %d OFFSET %d ", opts.Amount, opts.Offset)
 
-	if opts.Query != "" {
+	if opts.Query != "" && s.Search == SearchSphinx {
 		setIDsQuery := "SELECT id, set_modes & " + sm + " AS valid_set_modes FROM cg WHERE "
 
 		// add filters to query
@@ -325,17 +381,19 @@ func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, erro
 		if whereConds != "" {
 			setIDsQuery += "AND " + whereConds
 		}
-		if havingConds != "" {
-			setIDsQuery += " AND " + havingConds
+		if modesCond != "" {
+			setIDsQuery += " AND " + modesCond
 		}
 		setIDsQuery = strings.ReplaceAll(setIDsQuery, "sets.", "")
 
 		// set limit
-		setIDsQuery += " ORDER BY WEIGHT() DESC, id DESC " + limit + " OPTION ranker=sph04, max_matches=20000 "
+		setIDsQuery += " ORDER BY WEIGHT() DESC, id DESC " +
+			fmt.Sprintf(" LIMIT %d, %d ", opts.Offset, opts.Amount) +
+			" OPTION ranker=sph04, max_matches=20000 "
 		limit = ""
 
 		// fetch rows
-		rows, err := searchDB.Query(setIDsQuery)
+		rows, err := s.SearchDB.Query(setIDsQuery)
 		if err != nil {
 			return nil, err
 		}
@@ -358,21 +416,26 @@ func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, erro
 		}
 
 		whereConds = "sets.id IN (" + sIntCommaSeparated(setIDs) + ")"
-		havingConds = ""
+		modesCond = ""
+	} else if opts.Query != "" {
+		var queryCond string
+		queryCond, args, order = s.searchCond(opts.Query)
+		whereConds += beforeWhereConds + queryCond
+		beforeWhereConds = " AND "
 	}
 
+	if modesCond != "" {
+		whereConds += beforeWhereConds + "(sets.set_modes & " + sm + ") = " + sm + " "
+	}
 	if whereConds != "" {
 		whereConds = "WHERE " + whereConds
 	}
 	if beatmapConds != "" && whereConds == "" {
 		beatmapConds = "WHERE " + strings.Replace(beatmapConds, " AND ", " ", 1)
 	}
-	if havingConds != "" {
-		havingConds = " HAVING " + havingConds
-	}
 	setsQuery := "SELECT " + setFieldsWithRow + ", sets.set_modes & " + sm + " AS valid_set_modes FROM sets " +
-		whereConds + beatmapConds + havingConds + " ORDER BY last_update DESC " + limit
-	rows, err := db.Query(setsQuery)
+		whereConds + beatmapConds + order + limit
+	rows, err := s.query(setsQuery, args...)
 
 	if err != nil {
 		return nil, err
@@ -380,24 +443,24 @@ func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, erro
 
 	// find all beatmaps, but leave children aside for the moment.
 	for rows.Next() {
-		var s SetChimu
+		var set SetChimu
 		err = rows.Scan(
-			&s.ID, &s.RankedStatus, &s.ApprovedDate, &s.LastUpdate, &s.LastChecked,
-			&s.Artist, &s.Title, &s.Creator, &s.Source, &s.Tags, &s.HasVideo, &s.Genre,
-			&s.Language, &s.Favourites, new(int),
+			&set.ID, &set.RankedStatus, &set.ApprovedDate, &set.LastUpdate, &set.LastChecked,
+			&set.Artist, &set.Title, &set.Creator, &set.Source, &set.Tags, &set.HasVideo, &set.Genre,
+			&set.Language, &set.Favourites, new(int),
 		)
 		if err != nil {
 			return nil, err
 		}
 		// we get the position we should place s in from the setMap, this way we
 		// keep the order of results as sphinx prefers.
-		pos, ok := setMap[s.ID]
+		pos, ok := setMap[set.ID]
 		if ok {
-			sets[pos] = s
+			sets[pos] = set
 		} else {
-			sets = append(sets, s)
-			setIDs = append(setIDs, s.ID)
-			setMap[s.ID] = len(sets) - 1
+			sets = append(sets, set)
+			setIDs = append(setIDs, set.ID)
+			setMap[set.ID] = len(sets) - 1
 		}
 	}
 
@@ -405,7 +468,7 @@ func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, erro
 		return sets, nil
 	}
 
-	rows, err = db.Query(
+	rows, err = s.query(
 		"SELECT "+beatmapFields+" FROM beatmaps WHERE parent_set_id IN ("+
 			inClause(len(setIDs))+")",
 		sIntToSInterface(setIDs)...,
@@ -427,10 +490,10 @@ func SearchSetsChimu(db, searchDB *sql.DB, opts SearchOptions) ([]SetChimu, erro
 
 		b.DownloadPath = fmt.Sprintf("/d/%d", b.ParentSetId)
 		parentSet, ok := setMap[b.ParentSetId]
-		b.OsuFile = fmt.Sprintf("%s - %s (%s) [%s].osu", sets[parentSet].Artist, sets[parentSet].Title, sets[parentSet].Creator, b.DiffName)
 		if !ok {
 			continue
 		}
+		b.OsuFile = fmt.Sprintf("%s - %s (%s) [%s].osu", sets[parentSet].Artist, sets[parentSet].Title, sets[parentSet].Creator, b.DiffName)
 		sets[parentSet].ChildrenBeatmaps = append(sets[parentSet].ChildrenBeatmaps, b)
 	}
 